@@ -17,11 +17,18 @@ package forwarder
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 )
 
+// ErrWSLProxy is returned when WSL Proxy fails to apply a port mapping.
+var ErrWSLProxy = errors.New("error from WSL Proxy")
+
 // WSLProxyForwarder forwards the PortMappings to Rancher Desktop WSLProxy process in
 // the default namespace over the unix socket.
 // For more information on Rancher Desktop WSL Proxy, refer to the source code at:
@@ -49,5 +56,34 @@ func (v *WSLProxyForwarder) Send(portMapping types.PortMapping) error {
 		return err
 	}
 
-	return nil
+	var response types.PortMappingResponse
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		// Older versions of WSL Proxy close the connection without a response.
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("failed to read response from WSL Proxy: %w", err)
+	}
+
+	return responseError(response)
+}
+
+// responseError returns an error describing the port bindings that
+// WSL Proxy failed to apply, or nil if all of them were applied.
+func responseError(response types.PortMappingResponse) error {
+	if response.Success {
+		return nil
+	}
+	if response.Error != "" {
+		return fmt.Errorf("%w: %s", ErrWSLProxy, response.Error)
+	}
+	var errs []string
+	for _, result := range response.Results {
+		if !result.Success {
+			errs = append(errs, fmt.Sprintf("%s on %s: %s",
+				result.Port, net.JoinHostPort(result.HostIP, result.HostPort), result.Error))
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrWSLProxy, strings.Join(errs, ", "))
 }
@@ -23,13 +23,58 @@ import "github.com/docker/go-connections/nat"
 type PortMapping struct {
 	// Remove indicates whether the port mappings should be removed (true) or added (false)
 	Remove bool `json:"remove"`
+	// RemoveAll removes every published port, whether or not it is listed in Ports,
+	// and closes the connections relayed through them. Ports is ignored when it is set.
+	RemoveAll bool `json:"removeAll,omitempty"`
+	// ReplaceAll makes Ports the complete set of published ports: the ports
+	// that are not listed are removed and the listed ones are published, all
+	// at once, so that ports published before and after are never briefly
+	// unpublished. Remove is ignored when it is set.
+	ReplaceAll bool `json:"replaceAll,omitempty"`
+	// Name tells what the ports are published for, e.g. the name of a
+	// container, in logs and connection events. It is optional, and not a
+	// metric label, so that metrics do not grow with every name.
+	Name string `json:"name,omitempty"`
 	// Ports contains the port mappings for both IPv4 and IPv6 addresses.  The host address
-	// listed refers to the machine running the VM, i.e. the Windows machine.
+	// listed refers to the machine running the VM, i.e. the Windows machine.  A host port
+	// can be a range such as 30000-30100, which publishes every port in the range, or 0,
+	// which publishes the port on a host port picked by the system.
 	Ports nat.PortMap `json:"ports"`
 	// ConnectAddrs lists the backend addresses for connections; the addresses are recorded
 	// in terms of the network namespace the container engine is running in (i.e. the
 	// "Rancher Desktop" network namespace).
 	ConnectAddrs []ConnectAddrs `json:"connectAddrs"`
+	// RateBytesPerSec caps the throughput of each of the TCP ports, independently
+	// in each direction. Zero or unset means unlimited. Sending the mapping again
+	// with a different rate applies it to new connections.
+	RateBytesPerSec int64 `json:"rateBytesPerSec,omitempty"`
+	// Target is where connections to the TCP ports are relayed to, instead of
+	// the same port on the upstream address. Only unix socket paths, written as
+	// unix:///path/to/socket, are supported. Empty or unset keeps the default.
+	Target string `json:"target,omitempty"`
+	// AllowedSources restricts the clients the TCP ports accept connections
+	// from to these CIDR prefixes or IP addresses; connections from other
+	// clients are closed right away. Empty or unset accepts every client.
+	// Bindings needing different allowed sources go in separate port
+	// mappings. Sending the mapping again replaces them.
+	AllowedSources []string `json:"allowedSources,omitempty"`
+	// UpstreamPort is the port connections to the ports are relayed to on
+	// the upstream address, instead of the host port, e.g. to publish host
+	// port 8080 relayed to port 80. Zero or unset keeps the host port, or
+	// the container port for a host port picked by the system. It cannot
+	// be combined with Target.
+	UpstreamPort int `json:"upstreamPort,omitempty"`
+	// Drain, when removing TCP ports, gives the connections relayed through
+	// them DrainTimeoutSeconds, or 5 seconds when unset, to finish before
+	// they are closed. Without it, removing a port stops accepting
+	// connections but leaves the relayed ones open until they end, unless
+	// the proxy is configured to close them right away.
+	Drain               bool `json:"drain,omitempty"`
+	DrainTimeoutSeconds int  `json:"drainTimeoutSeconds,omitempty"`
+	// DryRun checks the port mapping as if it were applied, reporting the
+	// outcome of each port binding, but nothing is published nor removed.
+	// Other port mappings of the same batch are not taken into account.
+	DryRun bool `json:"dryRun,omitempty"`
 }
 
 // ConnectAddrs defines a network address used for the WSL interface inside
@@ -40,3 +85,75 @@ type ConnectAddrs struct {
 	// Addr is the network address, which can be either IPv4 or IPv6 (e.g., "192.0.2.1:25", "[2001:db8::1]:80")
 	Addr string `json:"addr"`
 }
+
+// ControlMessage is the versioned envelope for messages sent to the WSL Proxy.
+// A PortMapping sent on its own, without an envelope, is treated as the legacy
+// unversioned protocol.
+type ControlMessage struct {
+	// Version is the control protocol version the message is encoded with.
+	Version int `json:"version"`
+	// PortMapping is the port mapping to apply.
+	PortMapping *PortMapping `json:"portMapping,omitempty"`
+	// PortMappings is a batch of port mappings to apply together, instead of
+	// PortMapping. The batch is applied without other control messages
+	// interleaving, with the removals before the additions, so that a combined
+	// update does not briefly take down the ports it keeps.
+	PortMappings []PortMapping `json:"portMappings,omitempty"`
+	// KeepOpen asks the WSL Proxy to keep the connection open once it has
+	// responded, and to read the next control message from it, instead of
+	// closing it. The connection is closed once the sender closes its side,
+	// sends a message without KeepOpen, or stays idle for too long.
+	KeepOpen bool `json:"keepOpen,omitempty"`
+}
+
+// PortMappingResponse is written back by the WSL Proxy after it has applied
+// a PortMapping, so that the sender can find out which port bindings failed.
+// Older versions of the WSL Proxy do not send a response at all.
+type PortMappingResponse struct {
+	// Version is the control protocol version the WSL Proxy handled the
+	// message with; it is omitted for legacy unversioned messages.
+	Version int `json:"version,omitempty"`
+	// Success is true when every port binding in the PortMapping was applied.
+	Success bool `json:"success"`
+	// Error describes why the PortMapping could not be processed at all,
+	// e.g. because it could not be decoded.
+	Error string `json:"error,omitempty"`
+	// Results holds the outcome for each of the port bindings.
+	Results []PortBindingResult `json:"results"`
+	// Removed is the number of listeners closed by RemoveAll.
+	Removed int `json:"removed,omitempty"`
+	// Mappings holds the outcome of each port mapping of a batch, in the
+	// order they were sent; it is omitted unless PortMappings was used.
+	Mappings []PortMappingResult `json:"mappings,omitempty"`
+}
+
+// PortMappingResult is the outcome of applying one port mapping of a batch.
+type PortMappingResult struct {
+	// Success is true when every port binding in the PortMapping was applied.
+	Success bool `json:"success"`
+	// Results holds the outcome for each of the port bindings.
+	Results []PortBindingResult `json:"results"`
+	// Removed is the number of listeners closed by RemoveAll.
+	Removed int `json:"removed,omitempty"`
+}
+
+// PortBindingResult is the outcome of applying a single port binding.
+type PortBindingResult struct {
+	// Port is the container port the binding belongs to (e.g. "80/tcp").
+	Port nat.Port `json:"port"`
+	// HostIP is the host address of the binding.
+	HostIP string `json:"hostIp"`
+	// HostPort is the host port of the binding; for a binding requesting
+	// host port 0 or an empty one, it is the port picked by the system.
+	HostPort string `json:"hostPort"`
+	// ListenAddr is the address the binding is listened on once published,
+	// e.g. "127.0.0.1:8080", with the host IP the proxy binds to instead of
+	// HostIP, if any, and the port picked by the system. It is empty for
+	// bindings that are removed or fail.
+	ListenAddr string `json:"listenAddr,omitempty"`
+	// Success is true when the binding was applied.
+	Success bool `json:"success"`
+	// Error describes why the binding could not be applied, e.g. because
+	// the port is already in use.
+	Error string `json:"error,omitempty"`
+}
@@ -15,9 +15,9 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
-	"os"
 	"os/signal"
 	"syscall"
 
@@ -54,22 +54,21 @@ func main() {
 		logrus.Fatalf("failed to create listener for published ports: %s", err)
 		return
 	}
-	proxy := portproxy.NewPortProxy(socket, bridgeIPAddr)
+	proxy, err := portproxy.NewPortProxy(socket, bridgeIPAddr)
+	if err != nil {
+		logrus.Fatalf("failed to create port proxy: %s", err)
+		return
+	}
 
 	// Handle graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	go func() {
-		<-sigCh
+		<-ctx.Done()
 		logrus.Println("Shutting down...")
-		if err := proxy.Close(); err != nil {
-			logrus.Errorf("proxy close error: %s", err)
-		}
-		os.Exit(0)
 	}()
 
-	err = proxy.Start()
+	err = proxy.StartContext(ctx)
 	if err != nil {
 		logrus.Errorf("failed to start accepting: %s", err)
 		return
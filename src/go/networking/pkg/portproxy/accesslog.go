@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// accessLog writes a JSON line for every TCP connection relayed through
+// a published port when it is opened and when it is closed.
+type accessLog struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+// accessLogEntry is a single line of the access log.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Port     string    `json:"port"`
+	Name     string    `json:"name,omitempty"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream"`
+	// Only set once the connection is closed.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	BytesIn         int64   `json:"bytesIn,omitempty"`
+	BytesOut        int64   `json:"bytesOut,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+func newAccessLog(w io.Writer) *accessLog {
+	return &accessLog{encoder: json.NewEncoder(w)}
+}
+
+// log writes event for a connection that was accepted at start.
+func (a *accessLog) log(event ConnEvent, start time.Time) error {
+	entry := accessLogEntry{
+		Time:     time.Now(),
+		Event:    event.Type.String(),
+		Port:     event.Port,
+		Name:     event.Name,
+		Client:   event.Client,
+		Upstream: event.Upstream,
+	}
+	if event.Type == ConnClosed {
+		entry.DurationSeconds = entry.Time.Sub(start).Seconds()
+		entry.BytesIn = event.BytesIn
+		entry.BytesOut = event.BytesOut
+		if event.Err != nil {
+			entry.Error = event.Err.Error()
+		}
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.encoder.Encode(entry)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyAccessLog(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// The access log is written while relaying, so it has to be read
+	// concurrently.
+	r, w := io.Pipe()
+	defer r.Close()
+	lines := make(chan []byte, 2)
+	decoded := make(chan error, 1)
+	go func() {
+		defer close(decoded)
+		decoder := json.NewDecoder(r)
+		for range 2 {
+			var line json.RawMessage
+			if err := decoder.Decode(&line); err != nil {
+				decoded <- err
+				return
+			}
+			lines <- line
+		}
+	}()
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithAccessLog(w))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	err = marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.Close())
+
+	type entry struct {
+		Time            time.Time `json:"time"`
+		Event           string    `json:"event"`
+		Port            string    `json:"port"`
+		Client          string    `json:"client"`
+		Upstream        string    `json:"upstream"`
+		DurationSeconds float64   `json:"durationSeconds"`
+		BytesIn         int64     `json:"bytesIn"`
+		BytesOut        int64     `json:"bytesOut"`
+		Error           string    `json:"error"`
+	}
+	var opened, closed entry
+	require.NoError(t, <-decoded)
+	require.NoError(t, json.Unmarshal(<-lines, &opened))
+	require.NoError(t, json.Unmarshal(<-lines, &closed))
+
+	for _, e := range []entry{opened, closed} {
+		require.False(t, e.Time.IsZero())
+		require.Equal(t, testPort, e.Port)
+		require.Equal(t, conn.LocalAddr().String(), e.Client)
+		require.Equal(t, net.JoinHostPort(testServerIP, testPort), e.Upstream)
+		require.Empty(t, e.Error)
+	}
+	require.Equal(t, "opened", opened.Event)
+	require.Zero(t, opened.BytesIn)
+	require.Equal(t, "closed", closed.Event)
+	require.Greater(t, closed.DurationSeconds, 0.0)
+	require.Equal(t, int64(4), closed.BytesIn)
+	require.Equal(t, int64(4), closed.BytesOut)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// sourceAllowlist lists the client addresses a published TCP port accepts
+// connections from; an empty allowlist accepts every client.
+type sourceAllowlist []netip.Prefix
+
+// parseAllowedSources parses the allowed sources of a port mapping, each a
+// CIDR prefix or a single IP address.
+func parseAllowedSources(sources []string) (sourceAllowlist, error) {
+	var allowlist sourceAllowlist
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			addr, err := netip.ParseAddr(source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed source %q", source)
+			}
+			allowlist = append(allowlist, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed source %q", source)
+		}
+		allowlist = append(allowlist, prefix.Masked())
+	}
+	return allowlist, nil
+}
+
+// allows reports whether a client connecting from addr is accepted.
+func (a sourceAllowlist) allows(addr net.Addr) bool {
+	if len(a) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	// Clients of dual-stack listeners connect over IPv4-mapped addresses.
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range a {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
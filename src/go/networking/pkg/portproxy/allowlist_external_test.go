@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyAllowedSources(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		AllowedSources: []string{"127.0.0.2", "127.0.1.0/24"},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	dialFrom := func(ip string) (net.Conn, error) {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		return dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	}
+	for _, ip := range []string{"127.0.0.2", "127.0.1.3"} {
+		conn, err := dialFrom(ip)
+		require.NoError(t, err)
+		require.NoErrorf(t, echo(conn), "client %s should be allowed", ip)
+		conn.Close()
+	}
+	conn, err := dialFrom("127.0.0.1")
+	require.NoError(t, err)
+	require.Error(t, echo(conn), "client outside the allowed sources should be closed")
+	conn.Close()
+
+	expected := `
+# HELP portproxy_conns_denied_total Number of connections closed because the client address is not allowed on the port.
+# TYPE portproxy_conns_denied_total counter
+portproxy_conns_denied_total 1
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_conns_denied_total")
+	require.NoError(t, err)
+
+	// Sending the mapping again without allowed sources accepts every
+	// client.
+	portMapping.AllowedSources = nil
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	conn, err = dialFrom("127.0.0.1")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// Invalid allowed sources, and allowed sources on UDP ports, fail the
+	// binding.
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		AllowedSources: []string{"127.0.0.1"},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.3", HostPort: testPort}},
+		},
+		AllowedSources: []string{"localhost"},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Contains(t, response.Results[0].Error, `invalid allowed source "localhost"`)
+}
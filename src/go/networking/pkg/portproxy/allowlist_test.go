@@ -0,0 +1,51 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceAllowlist(t *testing.T) {
+	allowlist, err := parseAllowedSources([]string{"192.0.2.1", "198.51.100.7/24", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{ip: "192.0.2.1", allowed: true},
+		{ip: "192.0.2.2", allowed: false},
+		{ip: "198.51.100.200", allowed: true},
+		{ip: "198.51.101.1", allowed: false},
+		{ip: "::ffff:192.0.2.1", allowed: true},
+		{ip: "2001:db8::1", allowed: true},
+		{ip: "2001:db9::1", allowed: false},
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1234}
+		require.Equalf(t, tt.allowed, allowlist.allows(addr), "client %s", tt.ip)
+	}
+
+	require.True(t, sourceAllowlist(nil).allows(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}))
+
+	for _, source := range []string{"localhost", "192.0.2.0/33", ""} {
+		_, err := parseAllowedSources([]string{source})
+		require.Errorf(t, err, "source %q", source)
+	}
+}
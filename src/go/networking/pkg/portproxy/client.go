@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// defaultClientTimeout is how long a Client call may take unless
+// WithClientTimeout says otherwise.
+const defaultClientTimeout = 30 * time.Second
+
+// ErrNoResponse is returned by a Client when the proxy closed the control
+// connection without responding, as versions predating responses do.
+var ErrNoResponse = errors.New("port proxy closed the connection without a response")
+
+// Client sends port mappings to the control listener of a port proxy and
+// reads back their outcome. Each call dials a connection of its own, which
+// is closed once the response is read. A Client is safe for concurrent use.
+type Client struct {
+	network string
+	addr    string
+	dialer  net.Dialer
+	timeout time.Duration
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithClientTimeout bounds how long each call may take, dialing included,
+// unless the context passed to it expires earlier. It defaults to
+// defaultClientTimeout, and zero leaves it up to the context.
+func WithClientTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if timeout >= 0 {
+			c.timeout = timeout
+		}
+	}
+}
+
+// NewClient returns a client of the port proxy whose control listener is
+// at addr on network, e.g. a unix socket path on "unix".
+func NewClient(network, addr string, opts ...ClientOption) *Client {
+	c := &Client{
+		network: network,
+		addr:    addr,
+		timeout: defaultClientTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ApplyResult is the outcome of a port mapping applied by the proxy.
+type ApplyResult struct {
+	// Version is the control protocol version the proxy handled the port
+	// mapping with.
+	Version int
+	types.PortMappingResult
+}
+
+// Apply sends pm to the proxy and returns the outcome of each of its port
+// bindings once it is applied. Port bindings failing to apply are reported
+// in the result; the error is set when the port mapping could not be sent,
+// or the proxy could not process it at all. Cancelling ctx aborts the call.
+func (c *Client) Apply(ctx context.Context, pm types.PortMapping) (ApplyResult, error) {
+	response, err := c.send(ctx, types.ControlMessage{Version: controlProtocolLatest, PortMapping: &pm})
+	if err != nil {
+		return ApplyResult{}, err
+	}
+	return ApplyResult{
+		Version: response.Version,
+		PortMappingResult: types.PortMappingResult{
+			Success: response.Success,
+			Results: response.Results,
+			Removed: response.Removed,
+		},
+	}, nil
+}
+
+// ApplyBatch sends pms to the proxy as a batch, applied without other
+// control messages interleaving, and returns the outcome of each of them,
+// in the order given, like Apply does.
+func (c *Client) ApplyBatch(ctx context.Context, pms []types.PortMapping) ([]ApplyResult, error) {
+	response, err := c.send(ctx, types.ControlMessage{Version: controlProtocolLatest, PortMappings: pms})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Mappings) != len(pms) {
+		return nil, fmt.Errorf("port proxy responded with %d results for %d port mappings", len(response.Mappings), len(pms))
+	}
+	results := make([]ApplyResult, len(pms))
+	for i, result := range response.Mappings {
+		results[i] = ApplyResult{Version: response.Version, PortMappingResult: result}
+	}
+	return results, nil
+}
+
+// send writes msg to a new control connection and reads the response.
+func (c *Client) send(ctx context.Context, msg types.ControlMessage) (types.PortMappingResponse, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	conn, err := c.dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return types.PortMappingResponse{}, fmt.Errorf("failed to connect to port proxy: %w", err)
+	}
+	defer conn.Close()
+	// A deadline in the past fails the blocked write or read right away
+	// once ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	var response types.PortMappingResponse
+	err = EncodeControlMessage(conn, msg)
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&response)
+		if errors.Is(err, io.EOF) {
+			err = ErrNoResponse
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		return types.PortMappingResponse{}, fmt.Errorf("failed to send port mapping to port proxy: %w", err)
+	}
+	if response.Error != "" {
+		return types.PortMappingResponse{}, fmt.Errorf("port proxy failed to process the port mapping: %s", response.Error)
+	}
+	return response, nil
+}
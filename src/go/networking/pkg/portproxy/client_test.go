@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+)
+
+func TestClientApply(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	localListener, _ := startPortProxy(t, testServerIP)
+	client := portproxy.NewClient(localListener.Addr().Network(), localListener.Addr().String())
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}}},
+	}
+	result, err := client.Apply(context.Background(), portMapping)
+	require.NoError(t, err)
+	require.Truef(t, result.Success, "the port mapping should apply: %+v", result)
+	require.Equal(t, 1, result.Version)
+	require.Len(t, result.Results, 1)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	conn.Close()
+
+	// Port bindings failing to apply are reported in the result.
+	result, err = client.Apply(context.Background(), types.PortMapping{
+		Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "invalid"}}},
+	})
+	require.NoError(t, err)
+	require.False(t, result.Success)
+	require.NotEmpty(t, result.Results[0].Error)
+
+	results, err := client.ApplyBatch(context.Background(), []types.PortMapping{
+		{Remove: true, Ports: portMapping.Ports},
+		{Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "0"}}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		require.Truef(t, result.Success, "the port mappings of the batch should apply: %+v", result)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	// The server accepts control connections but never responds.
+	listener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	portMapping := types.PortMapping{Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostPort: "80"}}}}
+
+	client := portproxy.NewClient(listener.Addr().Network(), listener.Addr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = client.Apply(ctx, portMapping)
+	require.ErrorIs(t, err, context.Canceled)
+
+	client = portproxy.NewClient(listener.Addr().Network(), listener.Addr().String(),
+		portproxy.WithClientTimeout(100*time.Millisecond))
+	_, err = client.Apply(context.Background(), portMapping)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientNoResponse(t *testing.T) {
+	// Proxies predating responses close the connection once they read
+	// the port mapping.
+	listener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = portproxy.DecodeControlMessage(conn)
+			conn.Close()
+		}
+	}()
+
+	client := portproxy.NewClient(listener.Addr().Network(), listener.Addr().String())
+	_, err = client.Apply(context.Background(), types.PortMapping{
+		Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostPort: "80"}}},
+	})
+	require.ErrorIs(t, err, portproxy.ErrNoResponse)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// slowCloser takes a while to close and tracks how many closers are
+// closing at once.
+type slowCloser struct {
+	closing, peak *atomic.Int32
+	closed        atomic.Bool
+}
+
+func (c *slowCloser) Close() error {
+	n := c.closing.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.closing.Add(-1)
+	c.closed.Store(true)
+	return nil
+}
+
+func TestCloseAll(t *testing.T) {
+	var closing, peak atomic.Int32
+	closers := make([]*slowCloser, 4*maxParallelClose)
+	toClose := make([]io.Closer, len(closers))
+	for i := range closers {
+		closers[i] = &slowCloser{closing: &closing, peak: &peak}
+		toClose[i] = closers[i]
+	}
+
+	start := time.Now()
+	closeAll(toClose)
+	elapsed := time.Since(start)
+
+	for i, c := range closers {
+		require.Truef(t, c.closed.Load(), "closer %d was not closed", i)
+	}
+	require.LessOrEqual(t, peak.Load(), int32(maxParallelClose))
+	require.Greater(t, peak.Load(), int32(1), "closers were closed one after the other")
+	require.Less(t, elapsed, time.Duration(len(closers))*10*time.Millisecond)
+}
+
+// publishPorts publishes n TCP and n UDP ports on host ports picked by the
+// system, and returns the addresses they are listened on.
+func publishPorts(tb testing.TB, p *PortProxy, n int) []string {
+	tb.Helper()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var addrs []string
+	for _, proto := range []string{"tcp", "udp"} {
+		for i := 0; i < n; i++ {
+			port := nat.Port(fmt.Sprintf("%d/%s", 10000+i, proto))
+			hostPort, err := p.execBinding(types.PortMapping{}, port, nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+			require.NoError(tb, err)
+			addrs = append(addrs, proto+"://"+net.JoinHostPort("127.0.0.1", hostPort))
+		}
+	}
+	return addrs
+}
+
+func TestCloseManyListeners(t *testing.T) {
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.2")
+	addrs := publishPorts(t, p, 200)
+
+	require.NoError(t, p.Close())
+
+	// Every port can be listened on again, so no listener was left open.
+	for _, addr := range addrs {
+		network, hostPort, _ := strings.Cut(addr, "://")
+		var l io.Closer
+		if network == "tcp" {
+			l, err = net.Listen(network, hostPort)
+		} else {
+			l, err = net.ListenPacket(network, hostPort)
+		}
+		require.NoErrorf(t, err, "listener of %s was not closed", addr)
+		_ = l.Close()
+	}
+}
+
+// BenchmarkClose measures shutting down a proxy with many published ports.
+func BenchmarkClose(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		control, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(b, err)
+		p := MustNewPortProxy(control, "127.0.0.2")
+		publishPorts(b, p, 250)
+		b.StartTimer()
+		require.NoError(b, p.Close())
+	}
+}
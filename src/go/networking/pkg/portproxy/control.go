@@ -0,0 +1,164 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// Versions of the control protocol.
+const (
+	// controlProtocolLegacy is a bare types.PortMapping without an envelope.
+	controlProtocolLegacy = 0
+	// controlProtocolV1 wraps the port mapping in a types.ControlMessage.
+	controlProtocolV1 = 1
+	// controlProtocolLatest is the newest version the proxy understands.
+	controlProtocolLatest = controlProtocolV1
+)
+
+var (
+	errMissingPortMapping   = errors.New("control message does not contain a port mapping")
+	errAmbiguousPortMapping = errors.New("control message contains both a port mapping and a batch")
+)
+
+// EncodeControlMessage writes msg to w the way the proxy expects to read
+// it. A message with version 0 is written as a bare legacy port mapping,
+// which requires a single PortMapping; other versions are written in the
+// envelope as is. Nothing follows the message unless it has KeepOpen set,
+// since the proxy closes the connection without reading past it otherwise.
+func EncodeControlMessage(w io.Writer, msg types.ControlMessage) error {
+	var payload any = msg
+	switch {
+	case msg.PortMapping != nil && len(msg.PortMappings) > 0:
+		return errAmbiguousPortMapping
+	case msg.PortMapping == nil && len(msg.PortMappings) == 0:
+		return errMissingPortMapping
+	case msg.Version < controlProtocolLegacy:
+		return fmt.Errorf("invalid control protocol version %d", msg.Version)
+	case msg.Version == controlProtocolLegacy:
+		if msg.PortMapping == nil {
+			return errors.New("a batch of port mappings requires a versioned control message")
+		}
+		if msg.KeepOpen {
+			return errors.New("keeping the connection open requires a versioned control message")
+		}
+		payload = msg.PortMapping
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// DecodeControlMessage reads a single control message from r the way the
+// proxy does. The version of the returned message is the one the proxy
+// handles it with, 0 for a legacy port mapping sent without an envelope,
+// which is returned in PortMapping.
+func DecodeControlMessage(r io.Reader) (types.ControlMessage, error) {
+	return NewControlDecoder(r).Decode()
+}
+
+// ControlDecoder reads the successive control messages sent on a
+// connection kept open with KeepOpen, the way the proxy does.
+type ControlDecoder struct {
+	dec *json.Decoder
+}
+
+// NewControlDecoder returns a decoder of the control messages read from r.
+func NewControlDecoder(r io.Reader) *ControlDecoder {
+	return &ControlDecoder{dec: json.NewDecoder(r)}
+}
+
+// Decode reads the next control message, like DecodeControlMessage does.
+// It returns io.EOF once the sender closed the connection.
+func (d *ControlDecoder) Decode() (types.ControlMessage, error) {
+	msg, err := decodeControlMessage(d.dec)
+	if err != nil {
+		return types.ControlMessage{}, err
+	}
+	if msg.batch {
+		return types.ControlMessage{Version: msg.version, PortMappings: msg.portMappings, KeepOpen: msg.keepOpen}, nil
+	}
+	return types.ControlMessage{Version: msg.version, PortMapping: &msg.portMappings[0], KeepOpen: msg.keepOpen}, nil
+}
+
+// controlMessage is a decoded control message.
+type controlMessage struct {
+	// version is the protocol version the message is handled with.
+	version int
+	// portMappings holds the port mappings to apply, a single one
+	// unless the message is a batch.
+	portMappings []types.PortMapping
+	// batch is set when the port mappings were sent as a batch.
+	batch bool
+	// keepOpen is set when the sender keeps the connection open for
+	// further messages.
+	keepOpen bool
+}
+
+// decodeControlMessage reads the next control message from dec along with
+// the protocol version it is handled with. Messages without a version are
+// legacy port mappings, and messages from newer clients are handled with
+// the latest known version.
+func decodeControlMessage(dec *json.Decoder) (controlMessage, error) {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return controlMessage{}, err
+	}
+
+	var envelope struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return controlMessage{}, err
+	}
+	if envelope.Version == nil {
+		var pm types.PortMapping
+		if err := json.Unmarshal(raw, &pm); err != nil {
+			return controlMessage{}, err
+		}
+		return controlMessage{version: controlProtocolLegacy, portMappings: []types.PortMapping{pm}}, nil
+	}
+
+	version := *envelope.Version
+	if version < controlProtocolV1 {
+		return controlMessage{}, fmt.Errorf("invalid control protocol version %d", version)
+	}
+	if version > controlProtocolLatest {
+		version = controlProtocolLatest
+	}
+
+	// Only version 1 exists so far; later versions get their own case.
+	var msg types.ControlMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return controlMessage{}, err
+	}
+	switch {
+	case msg.PortMapping != nil && len(msg.PortMappings) > 0:
+		return controlMessage{}, errAmbiguousPortMapping
+	case msg.PortMapping != nil:
+		return controlMessage{version: version, portMappings: []types.PortMapping{*msg.PortMapping}, keepOpen: msg.KeepOpen}, nil
+	case len(msg.PortMappings) > 0:
+		return controlMessage{version: version, portMappings: msg.PortMappings, batch: true, keepOpen: msg.KeepOpen}, nil
+	}
+	return controlMessage{}, errMissingPortMapping
+}
@@ -0,0 +1,421 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func TestPortProxyTCPControlListener(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	defer localListener.Close()
+	portProxy := portproxy.MustNewPortProxy(localListener, testServerIP)
+	go portProxy.Start()
+	<-portProxy.Ready()
+	defer portProxy.Close()
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Len(t, response.Results, 1)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	portMapping.Remove = true
+	response, err = sendControlMessage(localListener, types.ControlMessage{
+		Version:      1,
+		PortMappings: []types.PortMapping{portMapping},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, response.Version)
+	require.True(t, response.Success)
+	require.Len(t, response.Mappings, 1)
+	require.Empty(t, portProxy.ActivePorts())
+
+	c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("not json"))
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(c).Decode(&response))
+	require.False(t, response.Success)
+	require.NotEmpty(t, response.Error)
+}
+
+func TestPortProxyMalformedControlMessages(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	payloads := map[string][]byte{
+		"garbage":   {0x00, 0xff, 0x13, 0x37, '{', '\n'},
+		"truncated": []byte(`{"ports":{"80/tcp":[{"HostIp":"127.0.0.1",`),
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write(payload)
+			require.NoError(t, err)
+			// Stop writing so that a truncated payload is not waited on.
+			require.NoError(t, c.(*net.UnixConn).CloseWrite())
+			var response types.PortMappingResponse
+			require.NoError(t, json.NewDecoder(c).Decode(&response))
+			require.False(t, response.Success)
+			require.NotEmpty(t, response.Error)
+		})
+	}
+
+	expected := `
+# HELP portproxy_control_decode_errors_total Number of control messages dropped because they could not be decoded.
+# TYPE portproxy_control_decode_errors_total counter
+portproxy_control_decode_errors_total 2
+`
+	require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+		"portproxy_control_decode_errors_total"))
+
+	// The mapping applied before is untouched and new ones are still served.
+	require.Equal(t, []nat.Port{port}, portProxy.ActivePorts())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Empty(t, portProxy.ActivePorts())
+}
+
+func TestPortProxyMaxControlConns(t *testing.T) {
+	localListener, portProxy := startPortProxy(t, "127.0.0.1", portproxy.WithMaxControlConns(2))
+
+	// Connections that do not send anything hold their slot until they
+	// are closed.
+	var held []net.Conn
+	for range 2 {
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		held = append(held, c)
+	}
+
+	// The connection over the limit is closed without a response.
+	c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	expected := `
+# HELP portproxy_control_conns_rejected_total Number of control connections closed because the control connection limit was reached.
+# TYPE portproxy_control_conns_rejected_total counter
+portproxy_control_conns_rejected_total 1
+`
+	require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+		"portproxy_control_conns_rejected_total"))
+
+	// Once a slot is freed, port mappings are handled again.
+	require.NoError(t, held[0].Close())
+	require.Eventually(t, func() bool {
+		response, err := sendPortMapping(localListener, types.PortMapping{Ports: nat.PortMap{}})
+		return err == nil && response.Success
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPortProxyControlKeepOpen(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	dec := json.NewDecoder(c)
+	send := func(msg types.ControlMessage) types.PortMappingResponse {
+		require.NoError(t, portproxy.EncodeControlMessage(c, msg))
+		var response types.PortMappingResponse
+		require.NoError(t, dec.Decode(&response))
+		return response
+	}
+
+	// Each message is applied and answered as it arrives on the same
+	// connection.
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}}},
+	}
+	response := send(types.ControlMessage{Version: 1, PortMapping: &portMapping, KeepOpen: true})
+	require.Truef(t, response.Success, "the port mapping should apply: %+v", response)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	conn.Close()
+
+	removal := portMapping
+	removal.Remove = true
+	response = send(types.ControlMessage{Version: 1, PortMapping: &removal, KeepOpen: true})
+	require.Truef(t, response.Success, "the removal should apply: %+v", response)
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.Error(t, err)
+
+	// A message without keepOpen is the last one.
+	response = send(types.ControlMessage{Version: 1, PortMapping: &portMapping})
+	require.True(t, response.Success)
+	_, err = c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "the proxy should close the connection")
+}
+
+func TestPortProxyMaxControlMessageSize(t *testing.T) {
+	const maxSize = 64 << 10
+	localListener, _ := startPortProxy(t, "127.0.0.1",
+		portproxy.WithMaxControlMessageSize(maxSize))
+
+	t.Run("rejects oversized messages", func(t *testing.T) {
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		// A string that never ends, which the proxy would otherwise keep
+		// buffering; the writes fail once the proxy drops the connection.
+		go func() {
+			if _, err := c.Write([]byte(`{"ports": {"80/tcp": [{"hostPort": "`)); err != nil {
+				return
+			}
+			chunk := bytes.Repeat([]byte("8"), 16<<10)
+			for range 64 {
+				if _, err := c.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+
+		var response types.PortMappingResponse
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, json.NewDecoder(c).Decode(&response))
+		require.False(t, response.Success)
+		require.Contains(t, response.Error, "larger than 65536 bytes")
+	})
+
+	t.Run("accepts messages within the limit", func(t *testing.T) {
+		response, err := sendPortMapping(localListener, types.PortMapping{
+			Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: freePort(t)}}},
+		})
+		require.NoError(t, err)
+		require.Truef(t, response.Success, "the port mapping should apply: %+v", response)
+	})
+}
+
+func TestPortProxyControlReadTimeout(t *testing.T) {
+	localListener, _ := startPortProxy(t, "127.0.0.1",
+		portproxy.WithControlReadTimeout(500*time.Millisecond))
+
+	t.Run("drops stalled senders", func(t *testing.T) {
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte(`{"ports":`))
+		require.NoError(t, err)
+
+		// The response arrives once the proxy gives up on the payload.
+		var response types.PortMappingResponse
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, json.NewDecoder(c).Decode(&response))
+		require.False(t, response.Success)
+		require.NotEmpty(t, response.Error)
+	})
+
+	t.Run("decodes mappings sent in several segments", func(t *testing.T) {
+		ports := nat.PortMap{}
+		for i := range 200 {
+			port, err := nat.NewPort("tcp", strconv.Itoa(21000+i))
+			require.NoError(t, err)
+			ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "invalid"}}
+		}
+		b, err := json.Marshal(types.PortMapping{Ports: ports})
+		require.NoError(t, err)
+
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		const segments = 4
+		size := len(b)/segments + 1
+		for len(b) > 0 {
+			n := min(size, len(b))
+			_, err = c.Write(b[:n])
+			require.NoError(t, err)
+			b = b[n:]
+			time.Sleep(50 * time.Millisecond)
+		}
+		var response types.PortMappingResponse
+		require.NoError(t, json.NewDecoder(c).Decode(&response))
+		require.Empty(t, response.Error)
+		require.Len(t, response.Results, 200)
+	})
+
+	t.Run("keeps idle connections kept open", func(t *testing.T) {
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.SetDeadline(time.Now().Add(10*time.Second)))
+		dec := json.NewDecoder(c)
+		portMapping := types.PortMapping{
+			Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "invalid"}}},
+		}
+		for range 2 {
+			require.NoError(t, portproxy.EncodeControlMessage(c, types.ControlMessage{
+				Version: 1, PortMapping: &portMapping, KeepOpen: true,
+			}))
+			var response types.PortMappingResponse
+			require.NoError(t, dec.Decode(&response))
+			require.Empty(t, response.Error)
+			require.Len(t, response.Results, 1)
+			// Idle for longer than the read timeout.
+			time.Sleep(time.Second)
+		}
+
+		// Once the next message starts, it has to arrive in time.
+		_, err = c.Write([]byte(`{"version":1,`))
+		require.NoError(t, err)
+		_, err = c.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF, "the proxy should drop the stalled connection")
+	})
+}
+
+func TestPortProxyControlIdleTimeout(t *testing.T) {
+	localListener, _ := startPortProxy(t, "127.0.0.1",
+		portproxy.WithMaxControlConns(1),
+		portproxy.WithControlIdleTimeout(300*time.Millisecond))
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "invalid"}}},
+	}
+
+	idle, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	require.NoError(t, idle.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, portproxy.EncodeControlMessage(idle, types.ControlMessage{
+		Version: 1, PortMapping: &portMapping, KeepOpen: true,
+	}))
+	dec := json.NewDecoder(idle)
+	var response types.PortMappingResponse
+	require.NoError(t, dec.Decode(&response))
+	require.Len(t, response.Results, 1)
+
+	// The idle connection is closed, which frees its control connection
+	// slot for the next sender.
+	require.ErrorIs(t, dec.Decode(&response), io.EOF, "the proxy should close the idle connection")
+	require.Eventually(t, func() bool {
+		response, err := sendPortMapping(localListener, portMapping)
+		return err == nil && response.Error == "" && len(response.Results) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPortProxyBatch(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	mapping := func(remove bool, hostPorts ...string) types.PortMapping {
+		pm := types.PortMapping{Remove: remove, Ports: nat.PortMap{}}
+		for _, hostPort := range hostPorts {
+			port, err := nat.NewPort("tcp", hostPort)
+			require.NoError(t, err)
+			pm.Ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}
+		}
+		return pm
+	}
+	kept, removed, added := freePort(t), freePort(t), freePort(t)
+	response, err := sendPortMapping(localListener, mapping(false, kept, removed))
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Empty(t, response.Mappings, "results per mapping are only reported for batches")
+
+	// The removal is listed last, yet it is processed before the
+	// additions, so the kept port is published again.
+	response, err = sendControlMessage(localListener, types.ControlMessage{
+		Version: 1,
+		PortMappings: []types.PortMapping{
+			mapping(false, kept, added),
+			{Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "invalid"}}}},
+			mapping(true, kept, removed),
+		},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Len(t, response.Results, 5)
+	require.Len(t, response.Mappings, 3)
+	require.True(t, response.Mappings[0].Success)
+	require.Len(t, response.Mappings[0].Results, 2)
+	require.False(t, response.Mappings[1].Success)
+	require.Len(t, response.Mappings[1].Results, 1)
+	require.True(t, response.Mappings[2].Success)
+	require.Len(t, response.Mappings[2].Results, 2)
+
+	var expected []nat.Port
+	for _, hostPort := range []string{kept, added} {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		expected = append(expected, port)
+	}
+	require.ElementsMatch(t, expected, portProxy.ActivePorts())
+}
@@ -0,0 +1,202 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeControlMessage(t *testing.T) {
+	expected := types.PortMapping{
+		Remove: true,
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		},
+	}
+	portMapping := `{"remove":true,"ports":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"8080"}]},"connectAddrs":null}`
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected controlMessage
+	}{
+		{
+			name:    "legacy payload without a version",
+			payload: portMapping,
+			expected: controlMessage{
+				version:      controlProtocolLegacy,
+				portMappings: []types.PortMapping{expected},
+			},
+		},
+		{
+			name:    "version 1 envelope",
+			payload: `{"version":1,"portMapping":` + portMapping + `}`,
+			expected: controlMessage{
+				version:      controlProtocolV1,
+				portMappings: []types.PortMapping{expected},
+			},
+		},
+		{
+			name:    "newer version is handled with the latest known version",
+			payload: `{"version":42,"portMapping":` + portMapping + `,"unknown":true}`,
+			expected: controlMessage{
+				version:      controlProtocolLatest,
+				portMappings: []types.PortMapping{expected},
+			},
+		},
+		{
+			name:    "batch of port mappings",
+			payload: `{"version":1,"portMappings":[` + portMapping + `,` + portMapping + `]}`,
+			expected: controlMessage{
+				version:      controlProtocolV1,
+				portMappings: []types.PortMapping{expected, expected},
+				batch:        true,
+			},
+		},
+		{
+			name:    "connection kept open",
+			payload: `{"version":1,"portMapping":` + portMapping + `,"keepOpen":true}`,
+			expected: controlMessage{
+				version:      controlProtocolV1,
+				portMappings: []types.PortMapping{expected},
+				keepOpen:     true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeControlMessage(json.NewDecoder(strings.NewReader(tt.payload)))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, msg)
+		})
+	}
+}
+
+func TestDecodeControlMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{name: "malformed JSON", payload: `{"version":`},
+		{name: "not an object", payload: `[]`},
+		{name: "invalid version", payload: `{"version":0,"portMapping":{}}`},
+		{name: "missing port mapping", payload: `{"version":1}`},
+		{name: "empty batch", payload: `{"version":1,"portMappings":[]}`},
+		{name: "port mapping and batch", payload: `{"version":1,"portMapping":{},"portMappings":[{}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeControlMessage(json.NewDecoder(strings.NewReader(tt.payload)))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestControlDecoder(t *testing.T) {
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		},
+	}
+	var buf bytes.Buffer
+	for _, keepOpen := range []bool{true, false} {
+		msg := types.ControlMessage{Version: controlProtocolV1, PortMapping: &portMapping, KeepOpen: keepOpen}
+		require.NoError(t, EncodeControlMessage(&buf, msg))
+		buf.WriteString("\n")
+	}
+
+	dec := NewControlDecoder(&buf)
+	for _, keepOpen := range []bool{true, false} {
+		msg, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, types.ControlMessage{Version: controlProtocolV1, PortMapping: &portMapping, KeepOpen: keepOpen}, msg)
+	}
+	_, err := dec.Decode()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestEncodeControlMessage(t *testing.T) {
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		},
+	}
+	tests := []struct {
+		name string
+		msg  types.ControlMessage
+	}{
+		{
+			name: "legacy port mapping",
+			msg:  types.ControlMessage{PortMapping: &portMapping},
+		},
+		{
+			name: "version 1 envelope",
+			msg:  types.ControlMessage{Version: controlProtocolV1, PortMapping: &portMapping},
+		},
+		{
+			name: "batch of port mappings",
+			msg:  types.ControlMessage{Version: controlProtocolV1, PortMappings: []types.PortMapping{portMapping, portMapping}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, EncodeControlMessage(&buf, tt.msg))
+			msg, err := DecodeControlMessage(&buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.msg, msg)
+		})
+	}
+
+	t.Run("legacy port mapping has no envelope", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, EncodeControlMessage(&buf, types.ControlMessage{PortMapping: &portMapping}))
+		require.NotContains(t, buf.String(), `"version"`)
+	})
+}
+
+func TestEncodeControlMessageErrors(t *testing.T) {
+	portMapping := types.PortMapping{}
+	tests := []struct {
+		name string
+		msg  types.ControlMessage
+	}{
+		{name: "missing port mapping", msg: types.ControlMessage{Version: controlProtocolV1}},
+		{name: "legacy batch", msg: types.ControlMessage{PortMappings: []types.PortMapping{portMapping}}},
+		{name: "invalid version", msg: types.ControlMessage{Version: -1, PortMapping: &portMapping}},
+		{name: "legacy kept open", msg: types.ControlMessage{PortMapping: &portMapping, KeepOpen: true}},
+		{
+			name: "port mapping and batch",
+			msg: types.ControlMessage{
+				Version:      controlProtocolV1,
+				PortMapping:  &portMapping,
+				PortMappings: []types.PortMapping{portMapping},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Error(t, EncodeControlMessage(io.Discard, tt.msg))
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// pendingUpdate is a control message waiting for the debounce window to
+// end before it is applied.
+type pendingUpdate struct {
+	mappings []types.PortMapping
+	results  []types.PortMappingResult
+	// closed once results are set
+	done chan struct{}
+}
+
+// bindingOp is a single port binding to add or remove, out of the port
+// mapping at index of the pending update it was sent with.
+type bindingOp struct {
+	update *pendingUpdate
+	index  int
+	pm     types.PortMapping
+	// bindings with the same key are published on the same listener
+	key string
+}
+
+// applyMappings applies the port mappings of a control message, once the
+// debounce window is over when WithApplyDebounce is used. Messages that
+// remove or replace every port or are dry runs are not debounced, and
+// apply the pending messages first.
+func (p *PortProxy) applyMappings(pms []types.PortMapping) []types.PortMappingResult {
+	if p.applyDebounce == 0 || !debounceable(pms) {
+		p.flushPending()
+		return p.execMappings(pms)
+	}
+	update := &pendingUpdate{mappings: pms, done: make(chan struct{})}
+	p.pendingMutex.Lock()
+	p.pending = append(p.pending, update)
+	if p.pendingTimer == nil {
+		// The window starts with the first message, so that a steady
+		// stream of messages does not hold them back indefinitely.
+		p.pendingTimer = time.AfterFunc(p.applyDebounce, p.flushPending)
+	}
+	p.pendingMutex.Unlock()
+	<-update.done
+	return update.results
+}
+
+func debounceable(pms []types.PortMapping) bool {
+	for _, pm := range pms {
+		if pm.RemoveAll || pm.ReplaceAll || pm.DryRun {
+			return false
+		}
+	}
+	return true
+}
+
+// flushPending applies the control messages received during the debounce
+// window, if any.
+func (p *PortProxy) flushPending() {
+	p.pendingMutex.Lock()
+	updates := p.pending
+	p.pending = nil
+	if p.pendingTimer != nil {
+		p.pendingTimer.Stop()
+		p.pendingTimer = nil
+	}
+	p.pendingMutex.Unlock()
+	if len(updates) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	before := p.activePorts()
+	p.execCoalesced(updates)
+	after := p.activePorts()
+	p.mutex.Unlock()
+	p.notifyApplied(before, after)
+	for _, update := range updates {
+		close(update.done)
+	}
+}
+
+// execCoalesced applies the net result of updates: only the last of the
+// operations on the same port binding is carried out, e.g. adding a port
+// and removing it in the same window leaves it alone. Removals are
+// processed before additions, as within a single control message. The
+// operations that are superseded are only checked for errors, and each
+// update gets the results of its own operations. The caller must hold
+// p.mutex.
+func (p *PortProxy) execCoalesced(updates []*pendingUpdate) {
+	var ops []bindingOp
+	for _, update := range updates {
+		update.results = make([]types.PortMappingResult, len(update.mappings))
+		for i, pm := range update.mappings {
+			for containerPort, portBindings := range pm.Ports {
+				for _, portBinding := range portBindings {
+					single := pm
+					single.Ports = nat.PortMap{containerPort: {portBinding}}
+					key := containerPort.Proto() + " " + net.JoinHostPort(portBinding.HostIP, portBinding.HostPort)
+					if p.reverse {
+						// A reverse proxy publishes the container port.
+						key = containerPort.Proto() + " " + containerPort.Port()
+					} else if isEphemeralPort(portBinding.HostPort) {
+						// Each of them is published on a port of its own.
+						key = fmt.Sprintf("%s %d", key, len(ops))
+					}
+					ops = append(ops, bindingOp{update: update, index: i, pm: single, key: key})
+				}
+			}
+		}
+	}
+	last := make(map[string]int, len(ops))
+	for i, op := range ops {
+		last[op.key] = i
+	}
+
+	results := make([][]types.PortBindingResult, len(ops))
+	for _, remove := range []bool{true, false} {
+		for i, op := range ops {
+			if op.pm.Remove == remove && last[op.key] == i {
+				results[i] = p.execListener(op.pm).Results
+			}
+		}
+	}
+	for i, op := range ops {
+		if last[op.key] != i {
+			p.logger.Debugf("skipping port binding %v superseded within the debounce window", op.pm.Ports)
+			results[i] = p.eachBinding(op.pm, func(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+				_, err := p.checkBinding(pm, containerPort, portBinding)
+				return "", err
+			})
+		}
+	}
+
+	bindingResults := make(map[*pendingUpdate][][]types.PortBindingResult, len(updates))
+	for _, update := range updates {
+		bindingResults[update] = make([][]types.PortBindingResult, len(update.mappings))
+	}
+	for i, op := range ops {
+		bindingResults[op.update][op.index] = append(bindingResults[op.update][op.index], results[i]...)
+	}
+	for _, update := range updates {
+		for i, results := range bindingResults[update] {
+			if results == nil {
+				results = []types.PortBindingResult{}
+			}
+			update.results[i] = newPortMappingResult(results)
+		}
+	}
+}
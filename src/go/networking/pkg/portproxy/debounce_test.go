@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyApplyDebounce(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// The other port is in use, so that publishing it would fail.
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inUse.Close()
+	_, inUsePort, err := net.SplitHostPort(inUse.Addr().String())
+	require.NoError(t, err)
+
+	debounce := 300 * time.Millisecond
+	localListener, portProxy := startPortProxy(t, testServerIP, portproxy.WithApplyDebounce(debounce))
+
+	mapping := func(remove bool, hostPort string) types.PortMapping {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		return types.PortMapping{
+			Remove: remove,
+			Ports:  nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}},
+		}
+	}
+	updates := []types.PortMapping{
+		mapping(false, inUsePort),
+		mapping(true, inUsePort),
+		mapping(false, testPort),
+	}
+	start := time.Now()
+	type sent struct {
+		response types.PortMappingResponse
+		err      error
+	}
+	responses := make([]chan sent, len(updates))
+	for i, update := range updates {
+		responses[i] = make(chan sent, 1)
+		go func() {
+			response, err := sendPortMapping(localListener, update)
+			responses[i] <- sent{response: response, err: err}
+		}()
+		// Keep the updates in order.
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, responseCh := range responses {
+		sent := <-responseCh
+		require.NoError(t, sent.err)
+		require.True(t, sent.response.Success)
+		require.Len(t, sent.response.Results, 1)
+	}
+	require.GreaterOrEqual(t, time.Since(start), debounce)
+
+	// The port in use was added and removed within the window, so it was
+	// never published at all.
+	require.Equal(t, []nat.Port{nat.Port(testPort + "/tcp")}, portProxy.ActivePorts())
+	expected := `
+# HELP portproxy_bind_errors_total Number of published ports that could not be listened on.
+# TYPE portproxy_bind_errors_total counter
+portproxy_bind_errors_total{reason="in_use"} 0
+portproxy_bind_errors_total{reason="other"} 0
+portproxy_bind_errors_total{reason="permission_denied"} 0
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_bind_errors_total")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
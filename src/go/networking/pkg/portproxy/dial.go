@@ -0,0 +1,202 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dialRetryTimeout bounds the total time spent dialing the upstream for
+// a single connection, including the delays between retries, so that
+// connections do not pile up while the upstream is unreachable.
+const dialRetryTimeout = 30 * time.Second
+
+// defaultDialTimeout bounds how long a single dial to the upstream takes
+// unless WithDialTimeout says otherwise.
+const defaultDialTimeout = 10 * time.Second
+
+// fallbackDelay is how long the dial to an upstream address gets before
+// the next address is dialed alongside it, as recommended by RFC 8305.
+const fallbackDelay = 250 * time.Millisecond
+
+// dialUpstream connects to the upstream, retrying with an exponential
+// backoff when dial retries are enabled. It gives up early when ctx, which
+// derives from p.ctx, is cancelled as the proxy force closes its
+// connections.
+func (p *PortProxy) dialUpstream(ctx context.Context, logger *logrus.Entry, target upstreamTarget) (upstream net.Conn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, dialRetryTimeout)
+	defer cancel()
+	ctx, span := p.startSpan(ctx, dialSpanName)
+	if span != nil {
+		span.SetAttributes(Attribute{Key: "portproxy.upstream", Value: target.String()})
+		defer func() {
+			span.End(err)
+		}()
+	}
+
+	dialer := p.dialer
+	if target.network == "unix" && dialer.LocalAddr != nil {
+		// The local address is a TCP one, which unix sockets cannot use.
+		unixDialer := *dialer
+		unixDialer.LocalAddr = nil
+		dialer = &unixDialer
+	}
+	delay := p.dialRetryDelay
+	for attempt := 1; ; attempt++ {
+		upstream, err = p.dialAttempt(ctx, dialer, target, attempt)
+		if err == nil || attempt >= p.dialAttempts {
+			return upstream, err
+		}
+		wait := p.retryDelay(delay)
+		logger.Debugf("dial attempt %d to upstream %s failed, retrying in %s: %s", attempt, target, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// retryDelay returns how long to wait before the next dial attempt, delay
+// spread randomly by the dial retry jitter, so that connections whose
+// dials failed together do not all retry in lockstep.
+func (p *PortProxy) retryDelay(delay time.Duration) time.Duration {
+	if p.dialRetryJitter == 0 {
+		return delay
+	}
+	spread := p.dialRetryJitter * (2*p.jitterRand() - 1)
+	return time.Duration(float64(delay) * (1 + spread))
+}
+
+// dialAttempt makes a single attempt at dialing the upstream.
+func (p *PortProxy) dialAttempt(ctx context.Context, dialer *net.Dialer, target upstreamTarget, attempt int) (net.Conn, error) {
+	ctx, span := p.startSpan(ctx, dialAttemptSpanName)
+	conn, err := dialFirst(ctx, dialer, target.network, target.addresses)
+	if err == nil && p.upstreamProbe > 0 {
+		conn, err = probeUpstream(conn, p.upstreamProbe)
+	}
+	if span != nil {
+		span.SetAttributes(Attribute{Key: "portproxy.dial.attempt", Value: int64(attempt)})
+		span.End(err)
+	}
+	return conn, err
+}
+
+// probeUpstream waits up to timeout for conn to either send its first
+// bytes or be closed by the upstream. A connection that is closed fails
+// the probe and is closed, otherwise it is returned ready to be relayed,
+// with the bytes read while probing still to be read.
+func probeUpstream(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	_, err := reader.Peek(1)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	switch {
+	case err == nil:
+		return &bufferedConn{halfCloser: halfCloser{conn}, reader: reader}, nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// Nothing was read, the connection can be relayed as it is.
+		return conn, nil
+	}
+	_ = conn.Close()
+	return nil, fmt.Errorf("upstream closed the connection before it was ready: %w", err)
+}
+
+// isDialTimeout reports whether dialing failed because it took too long,
+// e.g. when the VM is wedged, as opposed to being refused.
+func isDialTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// dialFirst dials the addresses in the style of happy eyeballs: each
+// address is dialed fallbackDelay after the previous one, or as soon as the
+// previous one fails, and the first connection established is returned
+// while the other dials are cancelled.
+func dialFirst(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, network, addrs[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered so that the dials that lose the race do not block.
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	dialNext := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	dialNext()
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				cancel()
+				// Close the connections of dials that succeed anyway.
+				go func(pending int) {
+					for range pending {
+						if result := <-results; result.conn != nil {
+							_ = result.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			if next < len(addrs) {
+				dialNext()
+				timer.Reset(fallbackDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				dialNext()
+				timer.Reset(fallbackDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyWithDialer(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// The upstream answers with the address the connection comes from.
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			_, _ = conn.Write([]byte(host))
+			conn.Close()
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.5")}}
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithDialer(dialer))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	err = marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.5", string(b))
+}
+
+func TestPortProxyDialRetry(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// Reserve a port for the upstream, which only starts listening after
+	// the first connection is accepted by the proxy.
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	upstreamAddr := l.Addr().String()
+	_, testPort, err := net.SplitHostPort(upstreamAddr)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithDialRetry(10, 20*time.Millisecond))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	upstream, err := net.Listen("tcp", upstreamAddr)
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestPortProxyUpstreamProbe(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// The upstream closes the first connections it accepts, like an
+	// application that is not ready yet, and echoes the later ones.
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) <= 2 {
+				_ = c.Close()
+				continue
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithDialRetry(5, 10*time.Millisecond), portproxy.WithUpstreamProbe(time.Second))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, echo(conn))
+	require.Equal(t, int32(3), accepted.Load())
+}
+
+func TestPortProxyServerSpeaksFirst(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// The upstream greets every client with a banner before reading
+	// anything, like SMTP or MySQL servers do, and then echoes.
+	const banner = "220 ready\r\n"
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := c.Write([]byte(banner)); err != nil {
+					return
+				}
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opts []portproxy.Option
+	}{
+		{name: "default"},
+		// The banner ends the probe early rather than being held back
+		// until the probe times out.
+		{name: "upstream probe", opts: []portproxy.Option{portproxy.WithUpstreamProbe(5 * time.Second)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localListener, _ := startPortProxy(t, testServerIP, tt.opts...)
+			port, err := nat.NewPort("tcp", testPort)
+			require.NoError(t, err)
+			response, err := sendPortMapping(localListener, types.PortMapping{
+				Ports: nat.PortMap{
+					port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+				},
+			})
+			require.NoError(t, err)
+			require.True(t, response.Success)
+
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+			require.NoError(t, err)
+			defer conn.Close()
+			// The banner arrives without the client sending anything.
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			buf := make([]byte, len(banner))
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, banner, string(buf))
+			require.NoError(t, conn.SetReadDeadline(time.Time{}))
+			require.NoError(t, echo(conn))
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialFirst(t *testing.T) {
+	hanging, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer hanging.Close()
+	working, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer working.Close()
+
+	// Dials to the first address hang until they are cancelled.
+	cancelled := make(chan struct{})
+	dialer := net.Dialer{
+		ControlContext: func(ctx context.Context, _, address string, _ syscall.RawConn) error {
+			if address == hanging.Addr().String() {
+				<-ctx.Done()
+				close(cancelled)
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+
+	start := time.Now()
+	conn, err := dialFirst(context.Background(), &dialer, "tcp",
+		[]string{hanging.Addr().String(), working.Addr().String()})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, working.Addr().String(), conn.RemoteAddr().String())
+	require.GreaterOrEqual(t, time.Since(start), fallbackDelay)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the losing dial was not cancelled")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Dials hang until they time out.
+	dialer := net.Dialer{
+		Timeout: 100 * time.Millisecond,
+		ControlContext: func(ctx context.Context, _, _ string, _ syscall.RawConn) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	for _, addrs := range [][]string{
+		{l.Addr().String()},
+		{l.Addr().String(), l.Addr().String()},
+	} {
+		_, err := dialFirst(context.Background(), &dialer, "tcp", addrs)
+		require.Error(t, err)
+		require.Truef(t, isDialTimeout(err), "dialing %d addresses should time out: %s", len(addrs), err)
+	}
+
+	var refusing net.Dialer
+	require.NoError(t, l.Close())
+	_, err = dialFirst(context.Background(), &refusing, "tcp", []string{l.Addr().String()})
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	require.False(t, isDialTimeout(err))
+}
+
+func TestDialFirstErrors(t *testing.T) {
+	var addrs []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addrs = append(addrs, l.Addr().String())
+		require.NoError(t, l.Close())
+	}
+
+	var dialer net.Dialer
+	_, err := dialFirst(context.Background(), &dialer, "tcp", addrs)
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestProbeUpstream(t *testing.T) {
+	t.Run("upstream closing the connection fails the probe", func(t *testing.T) {
+		conn, upstream := tcpPair(t)
+		require.NoError(t, upstream.Close())
+		_, err := probeUpstream(conn, 5*time.Second)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("bytes sent by the upstream are kept", func(t *testing.T) {
+		conn, upstream := tcpPair(t)
+		defer upstream.Close()
+		_, err := upstream.Write([]byte("banner"))
+		require.NoError(t, err)
+		probed, err := probeUpstream(conn, 5*time.Second)
+		require.NoError(t, err)
+		defer probed.Close()
+		buf := make([]byte, len("banner"))
+		_, err = io.ReadFull(probed, buf)
+		require.NoError(t, err)
+		require.Equal(t, "banner", string(buf))
+	})
+
+	t.Run("silent upstream passes the probe", func(t *testing.T) {
+		conn, upstream := tcpPair(t)
+		defer upstream.Close()
+		start := time.Now()
+		probed, err := probeUpstream(conn, 50*time.Millisecond)
+		require.NoError(t, err)
+		defer probed.Close()
+		require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		require.True(t, probed == conn, "a connection nothing was read from should not be wrapped")
+		// The read deadline of the probe is cleared.
+		_, err = upstream.Write([]byte("x"))
+		require.NoError(t, err)
+		_, err = probed.Read(make([]byte, 1))
+		require.NoError(t, err)
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := &PortProxy{}
+	require.Equal(t, 100*time.Millisecond, p.retryDelay(100*time.Millisecond), "no jitter by default")
+
+	var random float64
+	p = &PortProxy{dialRetryJitter: 0.2, jitterRand: func() float64 { return random }}
+	for _, tc := range []struct {
+		random   float64
+		expected time.Duration
+	}{
+		{random: 0, expected: 80 * time.Millisecond},
+		{random: 0.5, expected: 100 * time.Millisecond},
+		{random: 0.75, expected: 110 * time.Millisecond},
+	} {
+		random = tc.random
+		require.Equal(t, tc.expected, p.retryDelay(100*time.Millisecond).Round(time.Microsecond),
+			fmt.Sprintf("delay for random value %g", tc.random))
+	}
+}
+
+func TestWithDialRetryJitter(t *testing.T) {
+	for _, tc := range []struct {
+		factor   float64
+		expected float64
+	}{
+		{factor: 0.5, expected: 0.5},
+		{factor: 1, expected: 1},
+		{factor: -0.1, expected: 0},
+		{factor: 1.5, expected: 0},
+	} {
+		p := MustNewPortProxy(nil, "127.0.0.1", WithDialRetryJitter(tc.factor))
+		require.Equalf(t, tc.expected, p.dialRetryJitter, "jitter of %g", tc.factor)
+		require.NotNil(t, p.jitterRand)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultDialingWarnThreshold is the number of connections dialing
+	// the upstream at once that is considered a backlog.
+	defaultDialingWarnThreshold = 32
+	// defaultDialingWarnAfter is how long the backlog lasts before it is
+	// warned about, which is also the least time between warnings.
+	defaultDialingWarnAfter = 10 * time.Second
+)
+
+// dialingWatch warns when connections keep piling up while the upstream
+// is dialed, which points at a slow upstream rather than a slow host.
+type dialingWatch struct {
+	threshold int64
+	after     time.Duration
+	// when the number of connections dialing reached the threshold, as
+	// Unix nanoseconds, 0 while it is below
+	since atomic.Int64
+	// when the backlog was last warned about, as Unix nanoseconds
+	warned atomic.Int64
+}
+
+// startDialing counts a connection that is about to dial the upstream,
+// and warns when the connections dialing have been at the threshold for
+// long enough.
+func (p *PortProxy) startDialing(logger *logrus.Entry) {
+	dialing := p.metrics.connsDialing.Add(1)
+	if dialing < p.dialing.threshold {
+		return
+	}
+	now := time.Now().UnixNano()
+	p.dialing.since.CompareAndSwap(0, now)
+	since := p.dialing.since.Load()
+	warned := p.dialing.warned.Load()
+	after := p.dialing.after.Nanoseconds()
+	if since == 0 || now-since < after || now-warned < after {
+		return
+	}
+	if p.dialing.warned.CompareAndSwap(warned, now) {
+		logger.Warnf("%d connections are waiting for the upstream to accept them, "+
+			"at least %d of them for %s", dialing, p.dialing.threshold, time.Duration(now-since).Round(time.Millisecond))
+	}
+}
+
+// endDialing counts a connection that is done dialing the upstream,
+// whether it succeeded or not.
+func (p *PortProxy) endDialing() {
+	if p.metrics.connsDialing.Add(-1) < p.dialing.threshold {
+		p.dialing.since.Store(0)
+	}
+}
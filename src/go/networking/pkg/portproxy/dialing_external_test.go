@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyConnectionsDialing(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// Dials are held until released.
+	dialing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	dialer := &net.Dialer{
+		Control: func(_, _ string, _ syscall.RawConn) error {
+			dialing <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+	localListener, portProxy := startPortProxy(t, testServerIP, portproxy.WithDialer(dialer))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	<-dialing
+	gauge := func(value int) string {
+		return fmt.Sprintf(`
+# HELP portproxy_connections_dialing Number of accepted connections currently waiting for the upstream to be dialed.
+# TYPE portproxy_connections_dialing gauge
+portproxy_connections_dialing %d
+`, value)
+	}
+	require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(gauge(1)), "portproxy_connections_dialing"))
+
+	close(release)
+	require.NoError(t, echo(conn))
+	require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(gauge(0)), "portproxy_connections_dialing"))
+}
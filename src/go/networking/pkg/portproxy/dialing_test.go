@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialingWatch(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	p := &PortProxy{dialing: dialingWatch{threshold: 2, after: 50 * time.Millisecond}}
+	entry := logrus.NewEntry(logger)
+
+	// Below the threshold, nothing is warned about however long it lasts.
+	p.startDialing(entry)
+	time.Sleep(60 * time.Millisecond)
+	p.startDialing(entry)
+	require.Empty(t, hook.AllEntries())
+	require.EqualValues(t, 2, p.metrics.connsDialing.Load())
+
+	// At the threshold, but not for long enough yet.
+	p.startDialing(entry)
+	require.Empty(t, hook.AllEntries())
+
+	time.Sleep(60 * time.Millisecond)
+	p.startDialing(entry)
+	require.Len(t, hook.AllEntries(), 1)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+
+	// Warnings are spaced out.
+	p.startDialing(entry)
+	require.Len(t, hook.AllEntries(), 1)
+
+	// Dropping below the threshold starts over.
+	for range 4 {
+		p.endDialing()
+	}
+	require.EqualValues(t, 1, p.metrics.connsDialing.Load())
+	time.Sleep(60 * time.Millisecond)
+	p.startDialing(entry)
+	require.Len(t, hook.AllEntries(), 1, "the backlog only just started again")
+}
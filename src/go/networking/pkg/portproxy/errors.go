@@ -0,0 +1,69 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// The error a port binding fails to apply with wraps one of these when
+// the failure falls into its category, so that callers can tell apart,
+// e.g., a port that is taken for now from a port that will never apply.
+var (
+	// ErrPortInUse is wrapped when the host port is already listened on.
+	ErrPortInUse = errors.New("port is already in use")
+	// ErrPermissionDenied is wrapped when the host port may not be
+	// listened on, e.g. a privileged port.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrInvalidPort is wrapped when a port of the binding is malformed or
+	// out of range, or its protocol is not supported.
+	ErrInvalidPort = errors.New("invalid port")
+	// ErrResourceExhausted is wrapped when the host ran out of file
+	// descriptors, buffers or memory to listen on the host port.
+	ErrResourceExhausted = errors.New("out of resources")
+	// ErrTooManyPorts is wrapped when publishing the port would exceed
+	// the limit set with WithMaxPorts.
+	ErrTooManyPorts = errors.New("too many published ports")
+)
+
+// maxPrivilegedPort is the highest port only privileged processes may
+// listen on by default.
+const maxPrivilegedPort = 1023
+
+// bindError wraps err, from listening on hostPort, with the error of its
+// category, if any.
+func bindError(err error, hostPort string) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Errorf("%w: %w", ErrPortInUse, err)
+	case errors.Is(err, os.ErrPermission):
+		if port, perr := strconv.Atoi(hostPort); perr == nil && port > 0 && port <= maxPrivilegedPort {
+			return fmt.Errorf("%w: port %d is privileged, publishing it needs the proxy to run as root or with "+
+				"the CAP_NET_BIND_SERVICE capability, or a lower net.ipv4.ip_unprivileged_port_start: %w",
+				ErrPermissionDenied, port, err)
+		}
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return fmt.Errorf("%w: %w", ErrResourceExhausted, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+func TestBindError(t *testing.T) {
+	listenError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", errno)}
+	}
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{err: listenError(syscall.EADDRINUSE), expected: ErrPortInUse},
+		{err: listenError(syscall.EACCES), expected: ErrPermissionDenied},
+		{err: listenError(syscall.EPERM), expected: ErrPermissionDenied},
+		{err: listenError(syscall.EMFILE), expected: ErrResourceExhausted},
+		{err: listenError(syscall.ENFILE), expected: ErrResourceExhausted},
+		{err: listenError(syscall.ENOBUFS), expected: ErrResourceExhausted},
+		{err: listenError(syscall.ENOMEM), expected: ErrResourceExhausted},
+	}
+	for _, tt := range tests {
+		err := bindError(tt.err, "8080")
+		require.ErrorIsf(t, err, tt.expected, "%s", tt.err)
+		require.ErrorIsf(t, err, tt.err.(*net.OpError).Err, "%s keeps the underlying error", tt.err)
+	}
+
+	other := errors.New("something else")
+	require.Equal(t, other, bindError(other, "8080"))
+
+	// Privileged ports get a hint about how to publish them.
+	err := bindError(listenError(syscall.EACCES), "443")
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	require.ErrorContains(t, err, "port 443 is privileged")
+	require.NotContains(t, bindError(listenError(syscall.EACCES), "8080").Error(), "privileged")
+}
+
+func TestApplyPrivilegedPort(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root may listen on privileged ports")
+	}
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err != nil {
+		t.Skipf("privileged ports are not restricted here: %s", err)
+	} else if start, err := strconv.Atoi(strings.TrimSpace(string(b))); err != nil || start <= 443 {
+		t.Skip("port 443 is not privileged here")
+	}
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.1")
+	t.Cleanup(func() { _ = p.Close() })
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err = p.execBinding(types.PortMapping{}, "443/tcp", nat.PortBinding{HostIP: "127.0.0.1", HostPort: "443"})
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	require.ErrorContains(t, err, "CAP_NET_BIND_SERVICE")
+}
+
+func TestApplyErrors(t *testing.T) {
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.1")
+	t.Cleanup(func() { _ = p.Close() })
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = taken.Close() })
+	_, takenPort, err := net.SplitHostPort(taken.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		pm          types.PortMapping
+		port        nat.Port
+		hostPort    string
+		expectedErr error
+	}{
+		{name: "port in use", port: "80/tcp", hostPort: takenPort, expectedErr: ErrPortInUse},
+		{name: "malformed host port", port: "80/tcp", hostPort: "http", expectedErr: ErrInvalidPort},
+		{name: "host port out of range", port: "80/tcp", hostPort: "70000", expectedErr: ErrInvalidPort},
+		{name: "unsupported protocol", port: "80/sctp", hostPort: "0", expectedErr: ErrInvalidPort},
+		{
+			name:        "upstream port out of range",
+			pm:          types.PortMapping{UpstreamPort: 70000},
+			port:        "80/tcp",
+			hostPort:    "0",
+			expectedErr: ErrInvalidPort,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			_, err := p.execBinding(tt.pm, tt.port, nat.PortBinding{HostIP: "127.0.0.1", HostPort: tt.hostPort})
+			require.ErrorIs(t, err, tt.expectedErr)
+		})
+	}
+
+	_, err = expandPortRange("80-81/tcp", nat.PortBinding{HostPort: "8080-8082"})
+	require.ErrorIs(t, err, ErrInvalidPort)
+}
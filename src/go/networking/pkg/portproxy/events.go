@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUpstreamDial is wrapped by the error of a ConnClosed event when the
+// connection was closed because the upstream could not be dialed.
+var ErrUpstreamDial = errors.New("failed to dial upstream")
+
+// ErrConnectionFiltered is wrapped by the error of a ConnClosed event when
+// the connection was rejected by the filter of WithConnectionFilter.
+var ErrConnectionFiltered = errors.New("connection rejected by filter")
+
+// ErrSlowConsumer is wrapped by the error of a ConnClosed event when the
+// connection was closed because a write did not complete within the
+// timeout of WithWriteTimeout.
+var ErrSlowConsumer = errors.New("peer is not reading fast enough")
+
+// ConnEventType is the point in the lifecycle of a relayed connection
+// that a ConnEvent reports.
+type ConnEventType int
+
+const (
+	// ConnOpened is reported when a connection to a published port is
+	// accepted, before the upstream is dialed.
+	ConnOpened ConnEventType = iota
+	// ConnClosed is reported once the relay is done and both the client
+	// and the upstream connections are closed.
+	ConnClosed
+	// ConnProgress is reported periodically while the connection is
+	// relayed when WithConnectionProgress is used.
+	ConnProgress
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnOpened:
+		return "opened"
+	case ConnClosed:
+		return "closed"
+	case ConnProgress:
+		return "progress"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent describes a TCP connection relayed through a published port.
+type ConnEvent struct {
+	Type ConnEventType
+	// Port is the published host port the connection was accepted on.
+	Port string
+	// Name is the name of the port mapping that published the port, if
+	// it has one.
+	Name string
+	// Client is the address of the client that connected to the port.
+	Client string
+	// Upstream is the address the connection is relayed to, or a
+	// unix:// URL when it is relayed to a unix socket.
+	Upstream string
+	// BytesIn is the number of bytes relayed from the client to the
+	// upstream, and BytesOut the number relayed back to the client.
+	// Both are only set for ConnClosed, with the totals, and ConnProgress,
+	// with the bytes relayed so far.
+	BytesIn  int64
+	BytesOut int64
+	// Err is set for ConnClosed when the connection did not end normally.
+	// It wraps ErrUpstreamDial when the upstream could not be reached,
+	// ErrConnectionFiltered when the connection was rejected and
+	// ErrSlowConsumer when a peer stopped reading, otherwise it is the
+	// error that interrupted the relay mid-stream.
+	Err error
+}
+
+// ListenerError is published on the Errors channel when the listener of a
+// published TCP port fails to accept a connection.
+type ListenerError struct {
+	// Port is the published host port.
+	Port string
+	// Addr is the address the listener is bound to.
+	Addr string
+	// Fatal is set when the listener stopped accepting connections for
+	// good. The port is unpublished and has to be published again.
+	Fatal bool
+	Err   error
+}
+
+func (e *ListenerError) Error() string {
+	if e.Fatal {
+		return fmt.Sprintf("listener for port %s on %s stopped: %s", e.Port, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("listener for port %s on %s failed to accept: %s", e.Port, e.Addr, e.Err)
+}
+
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
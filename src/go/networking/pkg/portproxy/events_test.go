@@ -0,0 +1,79 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func TestPortProxyConnectionHook(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer localListener.Close()
+	events := make(chan portproxy.ConnEvent, 2)
+	var portProxy *portproxy.PortProxy
+	portProxy = portproxy.MustNewPortProxy(localListener, testServerIP, portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+		// Calling back into the proxy must not deadlock.
+		_ = portProxy.ActivePorts()
+		events <- event
+	}))
+	go portProxy.Start()
+	<-portProxy.Ready()
+	defer portProxy.Close()
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.Close())
+
+	expected := portproxy.ConnEvent{
+		Type:     portproxy.ConnOpened,
+		Port:     testPort,
+		Client:   conn.LocalAddr().String(),
+		Upstream: net.JoinHostPort(testServerIP, testPort),
+	}
+	require.Equal(t, expected, <-events)
+	expected.Type = portproxy.ConnClosed
+	expected.BytesIn = 4
+	expected.BytesOut = 4
+	select {
+	case event := <-events:
+		require.Equal(t, expected, event)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "connection closed event was not reported")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// httpSniffTimeout bounds how long the proxy waits for the first
+	// request of a connection to a port it injects X-Forwarded-For on.
+	httpSniffTimeout = 5 * time.Second
+	// maxHTTPHeaderBytes bounds the size of the request line and headers
+	// the proxy buffers to inject X-Forwarded-For.
+	maxHTTPHeaderBytes = 64 * 1024
+)
+
+var (
+	headerForwardedFor = []byte("X-Forwarded-For")
+	headerRealIP       = []byte("X-Real-Ip")
+)
+
+// bufferedConn reads from a bufio.Reader wrapping its connection, so that
+// bytes buffered while sniffing are relayed.
+type bufferedConn struct {
+	halfCloser
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// forwardFor reads the first HTTP/1.x request from conn and writes it to
+// upstream with X-Forwarded-For and X-Real-IP headers carrying the address
+// of the client. Whatever is read from conn that does not look like the
+// request line and headers of an HTTP request is written to upstream as
+// is. It returns the connection to keep reading from the client with and
+// the number of bytes read from the client and relayed.
+func forwardFor(conn, upstream net.Conn) (net.Conn, int64, error) {
+	reader := bufio.NewReader(conn)
+	buffered := &bufferedConn{halfCloser: halfCloser{conn}, reader: reader}
+	if err := conn.SetReadDeadline(time.Now().Add(httpSniffTimeout)); err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	// head holds what was read so far, in case it has to be relayed as is.
+	var head []byte
+	passThrough := func() (net.Conn, int64, error) {
+		return buffered, int64(len(head)), writeFull(upstream, head)
+	}
+	requestLine, err := readLine(reader)
+	head = append(head, requestLine...)
+	if err != nil || !isRequestLine(requestLine) {
+		return passThrough()
+	}
+
+	var forwardedFor []byte
+	var headers [][]byte
+	for {
+		line, err := readLine(reader)
+		head = append(head, line...)
+		if err != nil || len(head) > maxHTTPHeaderBytes {
+			return passThrough()
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		switch {
+		case !ok:
+			return passThrough()
+		case bytes.EqualFold(bytes.TrimSpace(name), headerForwardedFor):
+			forwardedFor = bytes.TrimSpace(value)
+		case bytes.EqualFold(bytes.TrimSpace(name), headerRealIP):
+		default:
+			headers = append(headers, line)
+		}
+	}
+
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if len(forwardedFor) > 0 {
+		forwardedFor = fmt.Appendf(nil, "%s, %s", forwardedFor, clientIP)
+	} else {
+		forwardedFor = []byte(clientIP)
+	}
+	var request bytes.Buffer
+	request.Write(requestLine)
+	for _, header := range headers {
+		request.Write(header)
+	}
+	fmt.Fprintf(&request, "%s: %s\r\n%s: %s\r\n\r\n", headerForwardedFor, forwardedFor, headerRealIP, clientIP)
+	if err := writeFull(upstream, request.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	return buffered, int64(len(head)), nil
+}
+
+// readLine reads up to and including the next newline, or what could be
+// read before an error.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	// ReadSlice returns a slice of the reader's buffer, which is
+	// overwritten by the next read.
+	return bytes.Clone(line), err
+}
+
+// isRequestLine reports whether line is the request line of an HTTP/1.x
+// request, e.g. "GET /index.html HTTP/1.1\r\n".
+func isRequestLine(line []byte) bool {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || !bytes.HasSuffix(line, []byte("\n")) {
+		return false
+	}
+	for _, c := range fields[0] {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return bytes.HasPrefix(fields[2], []byte("HTTP/1."))
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyHTTPForwardedFor(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	testServer := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-Ip"))
+		}),
+	}
+	defer testServer.Close()
+	go testServer.Serve(upstream)
+	_, httpPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+	echoPort := startEchoServer(t, testServerIP)
+
+	httpTCP, err := nat.NewPort("tcp", httpPort)
+	require.NoError(t, err)
+	echoTCP, err := nat.NewPort("tcp", echoPort)
+	require.NoError(t, err)
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithHTTPForwardedFor(httpTCP, echoTCP))
+	err = marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			httpTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: httpPort}},
+			echoTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: echoPort}},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("adds the client address to HTTP requests", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%s", httpPort), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "192.0.2.1, 127.0.0.1|127.0.0.1", string(body))
+	})
+
+	t.Run("relays other protocols untouched", func(t *testing.T) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", echoPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping\n"))
+		require.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		require.Equal(t, "ping\n", string(b))
+	})
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:  "request",
+			input: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expected: "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+				"X-Forwarded-For: 127.0.0.1\r\nX-Real-Ip: 127.0.0.1\r\n\r\n",
+		},
+		{
+			name: "request with a body",
+			input: "POST /submit HTTP/1.0\r\nContent-Length: 4\r\n\r\nping" +
+				"GET /next HTTP/1.1\r\n\r\n",
+			expected: "POST /submit HTTP/1.0\r\nContent-Length: 4\r\n" +
+				"X-Forwarded-For: 127.0.0.1\r\nX-Real-Ip: 127.0.0.1\r\n\r\nping" +
+				"GET /next HTTP/1.1\r\n\r\n",
+		},
+		{
+			name: "request through other proxies",
+			input: "GET / HTTP/1.1\r\nx-forwarded-for: 192.0.2.1\r\n" +
+				"X-Real-IP: 192.0.2.1\r\nAccept: */*\r\n\r\n",
+			expected: "GET / HTTP/1.1\r\nAccept: */*\r\n" +
+				"X-Forwarded-For: 192.0.2.1, 127.0.0.1\r\nX-Real-Ip: 127.0.0.1\r\n\r\n",
+		},
+		{
+			name:     "not HTTP",
+			input:    "SSH-2.0-OpenSSH_9.6\r\nmore bytes",
+			expected: "SSH-2.0-OpenSSH_9.6\r\nmore bytes",
+		},
+		{
+			name:     "HTTP/2 preface",
+			input:    "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+			expected: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+		},
+		{
+			name:     "truncated headers",
+			input:    "GET / HTTP/1.1\r\nHost: exam",
+			expected: "GET / HTTP/1.1\r\nHost: exam",
+		},
+		{
+			name:     "malformed header",
+			input:    "GET / HTTP/1.1\r\nnot a header\r\n\r\n",
+			expected: "GET / HTTP/1.1\r\nnot a header\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			defer client.Close()
+			defer conn.Close()
+			upstream, server := tcpPair(t)
+			defer server.Close()
+			defer upstream.Close()
+
+			_, err := client.Write([]byte(tt.input))
+			require.NoError(t, err)
+			require.NoError(t, client.(*net.TCPConn).CloseWrite())
+
+			received := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(server)
+				received <- b
+			}()
+			// Injected headers must survive short writes.
+			rest, n, err := forwardFor(conn, &shortWriteConn{Conn: upstream})
+			require.NoError(t, err)
+			m, err := io.Copy(upstream, rest)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(tt.input)), n+m, "bytes read from the client")
+			require.NoError(t, upstream.Close())
+			require.Equal(t, tt.expected, string(<-received))
+		})
+	}
+}
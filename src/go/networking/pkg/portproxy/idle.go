@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// idleTimeout closes a set of connections once no data has been read
+// from any of them for the configured duration. Activity in either
+// direction of a relay keeps the whole relay alive.
+type idleTimeout struct {
+	logger       *logrus.Entry
+	timeout      time.Duration
+	conns        []net.Conn
+	lastActivity atomic.Int64
+	timer        *time.Timer
+	// set by stop, so that a check fired just before does not re-arm the
+	// timer
+	stopped bool
+	mutex   sync.Mutex
+}
+
+func newIdleTimeout(logger *logrus.Entry, timeout time.Duration, conns ...net.Conn) *idleTimeout {
+	t := &idleTimeout{
+		logger:  logger,
+		timeout: timeout,
+		conns:   conns,
+	}
+	t.touch()
+	t.mutex.Lock()
+	t.timer = time.AfterFunc(timeout, t.check)
+	t.mutex.Unlock()
+	return t
+}
+
+func (t *idleTimeout) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// check closes the connections when they have been idle long enough,
+// otherwise it re-arms the timer for the remaining time.
+func (t *idleTimeout) check() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, t.lastActivity.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+	t.logger.Debugf("closing relay after being idle for %s", idle)
+	for _, conn := range t.conns {
+		_ = conn.Close()
+	}
+}
+
+func (t *idleTimeout) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// wrap returns a connection that records activity on every read.
+func (t *idleTimeout) wrap(conn net.Conn) net.Conn {
+	return &idleConn{halfCloser: halfCloser{conn}, idle: t}
+}
+
+type idleConn struct {
+	halfCloser
+	idle *idleTimeout
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyIdleTimeout(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// The upstream never answers, it only reports when its side is closed.
+	upstreamClosed := make(chan struct{})
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+		close(upstreamClosed)
+	}()
+
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	idleTimeout := 200 * time.Millisecond
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithIdleTimeout(idleTimeout))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "the idle relay should be closed by the proxy")
+	require.GreaterOrEqual(t, time.Since(start), idleTimeout/2)
+
+	select {
+	case <-upstreamClosed:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the upstream side of the idle relay was not closed")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// ListenerFiles returns the sockets of the published TCP ports, for a new
+// process to take over without unbinding them, e.g. while upgrading. The
+// files can be passed on with exec.Cmd.ExtraFiles and given to
+// NewPortProxyWithListeners.
+//
+// Extracting a file dups the file descriptor of the socket: the ports stay
+// published in this proxy, and connections to them are accepted by either
+// process until this one removes them or is closed. The caller must close
+// the files. A port published on more than one host IP cannot be
+// returned, since the files are keyed by port only, and fails the call.
+func (p *PortProxy) ListenerFiles() (map[nat.Port]*os.File, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	files := make(map[nat.Port]*os.File, len(p.activeListeners))
+	fail := func(err error) (map[nat.Port]*os.File, error) {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, err
+	}
+	for addr, l := range p.activeListeners {
+		_, hostPort, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fail(err)
+		}
+		port := nat.Port(hostPort + "/tcp")
+		if _, ok := files[port]; ok {
+			return fail(fmt.Errorf("port %s is published on more than one host IP", port))
+		}
+		listener, ok := l.(*closeNotifyListener)
+		if !ok || listener.tcp == nil {
+			return fail(fmt.Errorf("listener of port %s has no socket", port))
+		}
+		f, err := listener.tcp.File()
+		if err != nil {
+			return fail(fmt.Errorf("failed to extract the listener of port %s: %w", port, err))
+		}
+		files[port] = f
+	}
+	return files, nil
+}
+
+// NewPortProxyWithListeners is like NewPortProxy, and takes over the
+// listening sockets in files, as returned by ListenerFiles of the process
+// being replaced. The sockets are not relayed until their port is
+// published again on the host IP they are bound to, an empty host IP
+// matching sockets bound to ::, and connections to them wait in the listen
+// backlog meanwhile. Sockets whose port is not published again are closed
+// along with the proxy. files can be closed once it returns.
+func NewPortProxyWithListeners(listener net.Listener, upstreamAddr string, files map[nat.Port]*os.File, opts ...Option) (*PortProxy, error) {
+	portProxy, err := NewPortProxy(listener, upstreamAddr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for port, f := range files {
+		l, err := inheritListener(port, f)
+		if err != nil {
+			portProxy.closeInheritedListeners()
+			return nil, err
+		}
+		portProxy.inheritedListeners[port.Port()] = l
+	}
+	return portProxy, nil
+}
+
+// inheritListener returns the TCP listener of port in f.
+func inheritListener(port nat.Port, f *os.File) (*net.TCPListener, error) {
+	if port.Proto() != "tcp" {
+		return nil, fmt.Errorf("cannot inherit the listener of port %s, only TCP ports are supported", port)
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit the listener of port %s: %w", port, err)
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener inherited for port %s is not a TCP listener", port)
+	}
+	if _, hostPort, err := net.SplitHostPort(l.Addr().String()); err != nil || hostPort != port.Port() {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener inherited for port %s listens on %s", port, l.Addr())
+	}
+	return tcpListener, nil
+}
+
+// takeInheritedListener returns the inherited listener of the host port
+// when it is bound to hostIP, and hands it over to the caller. The caller
+// must hold p.mutex.
+func (p *PortProxy) takeInheritedListener(hostIP, hostPort string) *net.TCPListener {
+	l, ok := p.inheritedListeners[hostPort]
+	if !ok {
+		return nil
+	}
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	boundIP, _ := netip.AddrFromSlice(addr.IP)
+	if hostIP == "" {
+		hostIP = "::"
+	}
+	if ip, err := netip.ParseAddr(hostIP); err != nil || ip.Unmap() != boundIP.Unmap() {
+		return nil
+	}
+	delete(p.inheritedListeners, hostPort)
+	return l
+}
+
+// closeInheritedListeners closes the inherited listeners that were not
+// taken over by a published port. The caller must hold p.mutex, unless the
+// proxy is not started yet.
+func (p *PortProxy) closeInheritedListeners() {
+	for port, l := range p.inheritedListeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.Errorf("error closing inherited listener of port [%s]: %s", port, err)
+		}
+	}
+	clear(p.inheritedListeners)
+}
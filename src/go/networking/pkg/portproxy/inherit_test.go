@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func TestPortProxyListenerFiles(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+
+	oldListener, oldProxy := startPortProxy(t, testServerIP)
+	response, err := sendPortMapping(oldListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	files, err := oldProxy.ListenerFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Contains(t, files, port)
+
+	newListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer newListener.Close()
+	newProxy, err := portproxy.NewPortProxyWithListeners(newListener, testServerIP, files)
+	require.NoError(t, err)
+	for _, f := range files {
+		require.NoError(t, f.Close())
+	}
+	go newProxy.Start()
+	<-newProxy.Ready()
+	defer newProxy.Close()
+
+	// The port stays bound while the old proxy goes away: the connection
+	// waits in the backlog until the new proxy publishes the port.
+	require.NoError(t, oldProxy.Close())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	response, err = sendPortMapping(newListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing the inherited port should succeed: %+v", response)
+	require.NoError(t, echo(conn))
+
+	_, err = portproxy.NewPortProxyWithListeners(newListener, testServerIP, map[nat.Port]*os.File{
+		nat.Port(testPort + "/udp"): os.Stdin,
+	})
+	require.Error(t, err, "only TCP listeners can be inherited")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAlive enables TCP keep-alive probes on conn once it has been
+// idle for period.
+// Connections other than TCP are left alone.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// setNoDelay sets TCP_NODELAY on conn, so that small writes are sent
+// right away instead of being batched by Nagle's algorithm.
+// Connections other than TCP are left alone.
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tcpConn, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetNoDelay(noDelay)
+}
+
+// setLinger sets SO_LINGER on conn to linger, rounded up to whole seconds,
+// so that 0 makes closing it send an RST.
+// Connections other than TCP are left alone.
+func setLinger(conn net.Conn, linger time.Duration) error {
+	tcpConn, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetLinger(int((linger + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetKeepAlive(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	require.NoError(t, setKeepAlive(server, 42*time.Second))
+
+	rawConn, err := server.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var keepAlive, idle int
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	require.NoError(t, err)
+	require.NoError(t, sockErr)
+	require.Equal(t, 1, keepAlive)
+	require.Equal(t, 42, idle)
+}
+
+func TestSetLinger(t *testing.T) {
+	for _, tt := range []struct {
+		linger  time.Duration
+		seconds int32
+	}{
+		{linger: 0, seconds: 0},
+		{linger: 1500 * time.Millisecond, seconds: 2},
+		{linger: 3 * time.Second, seconds: 3},
+	} {
+		client, server := tcpPair(t)
+		require.NoError(t, setLinger(server, tt.linger))
+
+		rawConn, err := server.(*net.TCPConn).SyscallConn()
+		require.NoError(t, err)
+		var linger *unix.Linger
+		var sockErr error
+		require.NoError(t, rawConn.Control(func(fd uintptr) {
+			linger, sockErr = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+		}))
+		require.NoError(t, sockErr)
+		require.Equalf(t, int32(1), linger.Onoff, "linger %s", tt.linger)
+		require.Equalf(t, tt.seconds, linger.Linger, "linger %s", tt.linger)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSetKeepAliveIgnoresOtherConns(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	require.NoError(t, setKeepAlive(server, time.Second))
+}
+
+func TestSetNoDelay(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	rawConn, err := server.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	for _, noDelay := range []bool{false, true} {
+		require.NoError(t, setNoDelay(server, noDelay))
+		var value int
+		var sockErr error
+		require.NoError(t, rawConn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		}))
+		require.NoError(t, sockErr)
+		require.Equalf(t, noDelay, value != 0, "TCP_NODELAY set to %t", noDelay)
+	}
+}
+
+func TestWithNoDelay(t *testing.T) {
+	p := MustNewPortProxy(nil, "127.0.0.1")
+	require.True(t, p.noDelayFor("22"), "TCP_NODELAY should be set by default")
+
+	p = MustNewPortProxy(nil, "127.0.0.1",
+		WithNoDelay(false, "8080/tcp", "53/udp"),
+		WithNoDelay(true, "2222/tcp"),
+		WithNoDelay(false))
+	require.False(t, p.noDelayFor("8080"))
+	require.False(t, p.noDelayFor("22"))
+	require.True(t, p.noDelayFor("2222"), "a port listed on its own keeps its setting")
+	require.NotContains(t, p.noDelayPorts, "53", "UDP ports have no TCP_NODELAY")
+}
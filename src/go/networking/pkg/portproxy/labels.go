@@ -0,0 +1,27 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+// Keys and values of the pprof labels of the goroutines relaying traffic,
+// so that goroutine profiles group them by published port and by the
+// direction they copy in. Goroutines inherit the labels of the goroutine
+// that starts them, and pprof.Do adds to the labels of its context.
+const (
+	labelPort      = "port"
+	labelDirection = "direction"
+
+	directionToUpstream = "to_upstream"
+	directionToClient   = "to_client"
+)
@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyPprofLabels(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// The goroutines copying the open connection are grouped by port and
+	// direction in the goroutine profile.
+	var profile bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&profile, 1))
+	for _, direction := range []string{"to_upstream", "to_client"} {
+		labels := fmt.Sprintf(`"direction":%q`, direction)
+		found := false
+		for _, line := range strings.Split(profile.String(), "\n") {
+			if strings.Contains(line, labels) && strings.Contains(line, fmt.Sprintf(`"port":%q`, testPort)) {
+				found = true
+			}
+		}
+		require.Truef(t, found, "no goroutine is labelled with %s for port %s", labels, testPort)
+	}
+}
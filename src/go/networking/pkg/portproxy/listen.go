@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound how long a listener waits
+	// before accepting again after a temporary error.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	// defaultListenAttempts and defaultListenRetryDelay are how often and
+	// how soon listening on an address that is not available is retried,
+	// unless WithListenRetry says otherwise, waiting under a second in total.
+	defaultListenAttempts   = 4
+	defaultListenRetryDelay = 100 * time.Millisecond
+)
+
+// listenConfig is used to create the listeners for published TCP ports.
+//
+// Listeners are created with SO_REUSEADDR so that a port can be published
+// again right after it was removed, even while connections it accepted
+// are still in TIME_WAIT. SO_REUSEPORT is deliberately not set: it would
+// allow several listeners, including ones from other processes, to bind
+// the same port, hiding mappings that conflict with each other.
+var listenConfig = net.ListenConfig{
+	Control: func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setReuseAddr(fd)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	},
+}
+
+// portListenConfig returns the ListenConfig creating the listeners of
+// published ports of proto: TCP ones are created with listenConfig, and
+// the control function given to WithListenControl, if any, runs after
+// the socket options the proxy sets itself.
+func (p *PortProxy) portListenConfig(proto string) *net.ListenConfig {
+	var lc net.ListenConfig
+	if proto == "tcp" {
+		lc = listenConfig
+	}
+	if p.listenControl == nil {
+		return &lc
+	}
+	control := lc.Control
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return p.listenControl(network, address, c)
+	}
+	return &lc
+}
+
+// setListenBacklog sets the backlog of a TCP listener. Go picks the
+// backlog on its own when listening, and ListenConfig.Control runs before
+// that, so the backlog can only be changed once the socket is listening.
+func setListenBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = setBacklog(fd, backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isTemporaryAcceptError reports whether a listener that failed to accept
+// a connection with err can be expected to accept again later, e.g. once
+// file descriptors are freed up.
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNABORTED, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryUnavailable calls listen until it stops failing with EADDRNOTAVAIL,
+// up to the listen attempts, waiting the listen retry delay before the
+// first retry and doubling it after every attempt: on resume or a network
+// change, the host IP of a binding may not be usable until its interface
+// is fully up again. Other errors are returned right away. The caller must
+// hold p.mutex, which is released while waiting so that other port
+// mappings, connections and Close are not held back; listen is therefore
+// called again only if the proxy is not closing, and has to check the
+// state it depends on anew.
+func (p *PortProxy) retryUnavailable(hostPort string, listen func() error) error {
+	delay := p.listenRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := listen()
+		if err == nil || !errors.Is(err, syscall.EADDRNOTAVAIL) || attempt >= p.listenAttempts {
+			return err
+		}
+		p.logger.Debugf("address of port [%s] is not available, retrying in %s: %s", hostPort, delay, err)
+		p.mutex.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+			timer.Stop()
+		}
+		p.mutex.Lock()
+		if p.closing || p.ctx.Err() != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerErrors(t *testing.T) {
+	p := MustNewPortProxy(nil, "127.0.0.1")
+	defer p.cancel()
+
+	pm := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "0"}},
+		},
+	}
+	results := p.execMappings([]types.PortMapping{pm})
+	require.True(t, results[0].Success)
+	port := results[0].Results[0].HostPort
+	addr := net.JoinHostPort("127.0.0.1", port)
+	p.mutex.Lock()
+	listener := p.activeListeners[addr]
+	p.mutex.Unlock()
+	require.NotNil(t, listener)
+
+	// Shutting the socket down fails the pending Accept for good.
+	rawConn, err := listener.(*closeNotifyListener).Listener.(*net.TCPListener).SyscallConn()
+	require.NoError(t, err)
+	var shutdownErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		shutdownErr = syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+	}))
+	require.NoError(t, shutdownErr)
+
+	select {
+	case err := <-p.Errors():
+		var listenerErr *ListenerError
+		require.ErrorAs(t, err, &listenerErr)
+		require.Equal(t, port, listenerErr.Port)
+		require.Equal(t, addr, listenerErr.Addr)
+		require.True(t, listenerErr.Fatal)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the listener error was not reported")
+	}
+	require.Empty(t, p.ActivePorts())
+
+	// The port can be published again.
+	results = p.execMappings([]types.PortMapping{pm})
+	require.True(t, results[0].Success)
+	require.Len(t, p.ActivePorts(), 1)
+	p.cleanupListeners()
+}
+
+func TestListenBacklog(t *testing.T) {
+	p := MustNewPortProxy(nil, "127.0.0.1", WithListenBacklog(1))
+	defer p.cancel()
+	defer p.cleanupListeners()
+
+	pm := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "0"}},
+		},
+	}
+	results := p.execMappings([]types.PortMapping{pm})
+	require.True(t, results[0].Success)
+	port := results[0].Results[0].HostPort
+	require.NoError(t, p.PausePort(nat.Port(port+"/tcp")))
+
+	// Nothing is accepted while the port is paused, so the connections
+	// past the backlog are dropped; Linux queues one more than asked for.
+	var connected int
+	for range 10 {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 200*time.Millisecond)
+		if err != nil {
+			continue
+		}
+		defer conn.Close()
+		connected++
+	}
+	require.Less(t, connected, 10)
+}
+
+func TestPublishErrorDoesNotBlock(t *testing.T) {
+	p := MustNewPortProxy(nil, "127.0.0.1")
+	defer p.cancel()
+
+	for range errorsBuffer + 1 {
+		p.publishError(&ListenerError{Port: "80", Addr: "127.0.0.1:80", Err: syscall.EMFILE})
+	}
+	require.Len(t, p.Errors(), errorsBuffer)
+}
@@ -0,0 +1,276 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// failingListener fails every Accept with err until it is closed.
+type failingListener struct {
+	err     error
+	accepts atomic.Int64
+	closed  atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	if l.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	return nil, l.err
+}
+
+func (l *failingListener) Close() error {
+	l.closed.Store(true)
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	p := MustNewPortProxy(nil, "127.0.0.1")
+	defer p.cancel()
+
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	failing := &failingListener{err: emfile}
+	listener := newCloseNotifyListener(failing)
+	done := make(chan struct{})
+	go func() {
+		p.acceptTraffic(context.Background(), listener, "127.0.0.1:80", "80")
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, listener.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the accept loop did not stop once the listener was closed")
+	}
+
+	// Backing off from 5ms doubles the delay after each failure, so only
+	// a handful of attempts fit in the time a busy loop makes thousands.
+	require.LessOrEqual(t, failing.accepts.Load(), int64(10))
+	require.GreaterOrEqual(t, failing.accepts.Load(), int64(3))
+	err := <-p.Errors()
+	var listenerErr *ListenerError
+	require.ErrorAs(t, err, &listenerErr)
+	require.False(t, listenerErr.Fatal)
+	require.ErrorIs(t, listenerErr, syscall.EMFILE)
+}
+
+func TestRetryUnavailable(t *testing.T) {
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.1", WithListenRetry(3, time.Millisecond))
+	t.Cleanup(func() { _ = p.Close() })
+	unavailable := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)}
+
+	t.Run("address coming back", func(t *testing.T) {
+		attempts := 0
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		err := p.retryUnavailable("8080", func() error {
+			attempts++
+			if attempts < 3 {
+				return unavailable
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("address staying away", func(t *testing.T) {
+		attempts := 0
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		err := p.retryUnavailable("8080", func() error {
+			attempts++
+			return unavailable
+		})
+		require.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("other errors fail fast", func(t *testing.T) {
+		attempts := 0
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		err := p.retryUnavailable("8080", func() error {
+			attempts++
+			return bindError(&net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, "8080")
+		})
+		require.ErrorIs(t, err, ErrPortInUse)
+		require.Equal(t, 1, attempts)
+	})
+
+	t.Run("lock released while waiting", func(t *testing.T) {
+		control, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		p := MustNewPortProxy(control, "127.0.0.1", WithListenRetry(2, 100*time.Millisecond))
+		t.Cleanup(func() { _ = p.Close() })
+		locked := make(chan struct{})
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		err = p.retryUnavailable("8080", func() error {
+			select {
+			case <-locked:
+				return nil
+			default:
+			}
+			go func() {
+				p.mutex.Lock()
+				close(locked)
+				p.mutex.Unlock()
+			}()
+			return unavailable
+		})
+		require.NoError(t, err)
+		select {
+		case <-locked:
+		default:
+			t.Fatal("p.mutex should be released between attempts")
+		}
+	})
+
+	t.Run("closing while waiting", func(t *testing.T) {
+		control, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		p := MustNewPortProxy(control, "127.0.0.1", WithListenRetry(3, 100*time.Millisecond))
+		attempts := 0
+		p.mutex.Lock()
+		err = p.retryUnavailable("8080", func() error {
+			attempts++
+			if attempts == 1 {
+				go func() { _ = p.Close() }()
+			}
+			return unavailable
+		})
+		p.mutex.Unlock()
+		require.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+		require.Equal(t, 1, attempts, "listening should not be retried once the proxy is closing")
+	})
+
+	t.Run("identical binding while waiting", func(t *testing.T) {
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		_, port, err := net.SplitHostPort(free.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, free.Close())
+
+		// The first attempt to listen finds the address unavailable, and
+		// the identical binding applied meanwhile publishes the port.
+		var listens atomic.Int64
+		waiting := make(chan struct{})
+		control, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		p := MustNewPortProxy(control, "127.0.0.1",
+			WithListenRetry(2, 200*time.Millisecond),
+			WithListenControl(func(network, address string, c syscall.RawConn) error {
+				if listens.Add(1) == 1 {
+					close(waiting)
+					return syscall.EADDRNOTAVAIL
+				}
+				return nil
+			}))
+		t.Cleanup(func() { _ = p.Close() })
+		binding := nat.PortBinding{HostIP: "127.0.0.1", HostPort: port}
+		retried := make(chan error)
+		go func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			_, err := p.execBinding(types.PortMapping{}, "80/tcp", binding)
+			retried <- err
+		}()
+
+		<-waiting
+		p.mutex.Lock()
+		_, err = p.execBinding(types.PortMapping{}, "80/tcp", binding)
+		p.mutex.Unlock()
+		require.NoError(t, err)
+		require.NoError(t, <-retried, "the retry should find the port published")
+		require.Equal(t, int64(2), listens.Load(), "the retry should not listen again")
+		p.mutex.Lock()
+		require.Len(t, p.activeListeners, 1)
+		p.mutex.Unlock()
+	})
+
+	t.Run("host IP missing from the host", func(t *testing.T) {
+		control, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		p := MustNewPortProxy(control, "127.0.0.1", WithListenRetry(3, time.Second))
+		t.Cleanup(func() { _ = p.Close() })
+		// 192.0.2.0/24 is reserved for documentation, and not assigned.
+		start := time.Now()
+		p.mutex.Lock()
+		_, err = p.execBinding(types.PortMapping{}, "80/tcp", nat.PortBinding{HostIP: "192.0.2.1", HostPort: "8080"})
+		p.mutex.Unlock()
+		require.ErrorContains(t, err, "host IP 192.0.2.1 is not an address of this host")
+		require.Less(t, time.Since(start), time.Second, "the binding should not be retried")
+	})
+}
+
+func TestWithListenControl(t *testing.T) {
+	type call struct{ network, address string }
+	var calls []call
+	controlErr := errors.New("control failed")
+	var fail bool
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.2", WithListenControl(func(network, address string, c syscall.RawConn) error {
+		calls = append(calls, call{network: network, address: address})
+		if fail {
+			return controlErr
+		}
+		return nil
+	}))
+	t.Cleanup(func() { _ = p.Close() })
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	tcpPort, err := p.execBinding(types.PortMapping{}, "80/tcp", nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	require.NoError(t, err)
+	udpPort, err := p.execBinding(types.PortMapping{}, "53/udp", nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+	require.Equal(t, "tcp4", calls[0].network)
+	require.Equal(t, "udp4", calls[1].network)
+	// The hook sees the address being bound, before a port is picked.
+	require.Equal(t, "127.0.0.1:0", calls[0].address)
+	require.NotEqual(t, "0", tcpPort)
+	require.NotEqual(t, "0", udpPort)
+
+	fail = true
+	_, err = p.execBinding(types.PortMapping{}, "81/tcp", nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	require.ErrorIs(t, err, controlErr)
+	_, err = p.execBinding(types.PortMapping{}, "54/udp", nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	require.ErrorIs(t, err, controlErr)
+}
@@ -0,0 +1,30 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import "errors"
+
+// setReuseAddr is a no-op on Windows, where SO_REUSEADDR allows another
+// socket to take over a port that is already bound, and a port in
+// TIME_WAIT does not prevent binding in the first place.
+func setReuseAddr(_ uintptr) error {
+	return nil
+}
+
+// setBacklog is not supported on Windows, where listening again on a
+// socket that is already listening leaves its backlog as it was.
+func setBacklog(_ uintptr, _ int) error {
+	return errors.ErrUnsupported
+}
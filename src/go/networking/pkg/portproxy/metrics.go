@@ -0,0 +1,281 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of the direction label of portproxy_bytes_relayed_total.
+const (
+	directionUpstream   = "upstream"
+	directionDownstream = "downstream"
+)
+
+// Values of the limit label of portproxy_conns_rejected_total.
+const (
+	limitPort   = "port"
+	limitGlobal = "global"
+	limitRate   = "rate"
+)
+
+// Values of the reason label of portproxy_bind_errors_total.
+const (
+	bindReasonInUse            = "in_use"
+	bindReasonPermissionDenied = "permission_denied"
+	bindReasonOther            = "other"
+)
+
+var (
+	activeMappingsDesc = prometheus.NewDesc(
+		"portproxy_active_mappings",
+		"Number of published ports with an active listener.",
+		nil, nil)
+	activeConnectionsDesc = prometheus.NewDesc(
+		"portproxy_active_connections",
+		"Number of connections currently being relayed per published port.",
+		[]string{"port"}, nil)
+	connectionsDialingDesc = prometheus.NewDesc(
+		"portproxy_connections_dialing",
+		"Number of accepted connections currently waiting for the upstream to be dialed.",
+		nil, nil)
+	bytesRelayedDesc = prometheus.NewDesc(
+		"portproxy_bytes_relayed_total",
+		"Bytes relayed from clients to the upstream and from the upstream to clients.",
+		[]string{"direction"}, nil)
+	upstreamDialErrorsDesc = prometheus.NewDesc(
+		"portproxy_upstream_dial_errors_total",
+		"Number of relayed connections whose upstream could not be dialed.",
+		nil, nil)
+	upstreamDialTimeoutsDesc = prometheus.NewDesc(
+		"portproxy_upstream_dial_timeouts_total",
+		"Number of relayed connections whose upstream could not be dialed in time.",
+		nil, nil)
+	relayErrorsDesc = prometheus.NewDesc(
+		"portproxy_relay_errors_total",
+		"Number of relayed connections interrupted by an error after the upstream was dialed.",
+		nil, nil)
+	connsRejectedDesc = prometheus.NewDesc(
+		"portproxy_conns_rejected_total",
+		"Number of connections closed because a connection limit was reached.",
+		[]string{"limit"}, nil)
+	connsDeniedDesc = prometheus.NewDesc(
+		"portproxy_conns_denied_total",
+		"Number of connections closed because the client address is not allowed on the port.",
+		nil, nil)
+	connsFilteredDesc = prometheus.NewDesc(
+		"portproxy_conns_filtered_total",
+		"Number of connections closed because the connection filter rejected them.",
+		nil, nil)
+	slowConsumersDesc = prometheus.NewDesc(
+		"portproxy_slow_consumer_total",
+		"Number of connections closed because a write to the client or the upstream timed out.",
+		nil, nil)
+	controlDecodeErrorsDesc = prometheus.NewDesc(
+		"portproxy_control_decode_errors_total",
+		"Number of control messages dropped because they could not be decoded.",
+		nil, nil)
+	controlConnsRejectedDesc = prometheus.NewDesc(
+		"portproxy_control_conns_rejected_total",
+		"Number of control connections closed because the control connection limit was reached.",
+		nil, nil)
+	connsDrainedDesc = prometheus.NewDesc(
+		"portproxy_connections_drained_total",
+		"Number of connections that finished on their own while the proxy was closing.",
+		nil, nil)
+	connsForceClosedDesc = prometheus.NewDesc(
+		"portproxy_connections_force_closed_total",
+		"Number of connections closed because they did not finish within the grace period of Close.",
+		nil, nil)
+	bindErrorsDesc = prometheus.NewDesc(
+		"portproxy_bind_errors_total",
+		"Number of published ports that could not be listened on.",
+		[]string{"reason"}, nil)
+)
+
+// metrics holds the counters that are updated as traffic is relayed.
+type metrics struct {
+	// listeners of published ports and relayed connections, kept up to
+	// date as they come and go so that Stats does not need p.mutex
+	activeMappings     atomic.Int64
+	activeConns        atomic.Int64
+	connsDialing       atomic.Int64
+	bytesToUpstream    atomic.Uint64
+	bytesToClient      atomic.Uint64
+	upstreamDialErrors atomic.Uint64
+	// dial errors whose last attempt timed out
+	upstreamDialTimeouts atomic.Uint64
+	relayErrors          atomic.Uint64
+	// connections rejected by the per-port and the global limit, and by
+	// the accept rate
+	portLimitRejections   atomic.Uint64
+	globalLimitRejections atomic.Uint64
+	rateLimitRejections   atomic.Uint64
+	// connections from clients outside the allowed sources of the port
+	connsDenied         atomic.Uint64
+	controlDecodeErrors atomic.Uint64
+	// connections rejected by the connection filter
+	connsFiltered atomic.Uint64
+	// relays closed because a write did not complete in time
+	slowConsumers atomic.Uint64
+	// control connections rejected by the control connection limit
+	controlConnsRejected atomic.Uint64
+	// connections that were relayed when the proxy started closing,
+	// depending on whether they finished within the grace period
+	connsDrained     atomic.Uint64
+	connsForceClosed atomic.Uint64
+	// ports that could not be listened on, by reason
+	bindErrorsInUse            atomic.Uint64
+	bindErrorsPermissionDenied atomic.Uint64
+	bindErrorsOther            atomic.Uint64
+}
+
+// bindFailed accounts for a published port that could not be listened
+// on with err, as wrapped by bindError, and returns the reason it failed.
+func (m *metrics) bindFailed(err error) string {
+	switch {
+	case errors.Is(err, ErrPortInUse):
+		m.bindErrorsInUse.Add(1)
+		return bindReasonInUse
+	case errors.Is(err, ErrPermissionDenied):
+		m.bindErrorsPermissionDenied.Add(1)
+		return bindReasonPermissionDenied
+	default:
+		m.bindErrorsOther.Add(1)
+		return bindReasonOther
+	}
+}
+
+// Collector returns a prometheus.Collector exposing the proxy metrics,
+// for callers to register with the registry of their choice. Bytes of
+// a TCP connection are accounted for once each direction is done.
+func (p *PortProxy) Collector() prometheus.Collector {
+	return &collector{proxy: p}
+}
+
+type collector struct {
+	proxy *PortProxy
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeMappingsDesc
+	ch <- activeConnectionsDesc
+	ch <- connectionsDialingDesc
+	ch <- bytesRelayedDesc
+	ch <- upstreamDialErrorsDesc
+	ch <- upstreamDialTimeoutsDesc
+	ch <- relayErrorsDesc
+	ch <- connsRejectedDesc
+	ch <- connsDeniedDesc
+	ch <- connsFilteredDesc
+	ch <- slowConsumersDesc
+	ch <- controlDecodeErrorsDesc
+	ch <- controlConnsRejectedDesc
+	ch <- connsDrainedDesc
+	ch <- connsForceClosedDesc
+	ch <- bindErrorsDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	p := c.proxy
+
+	p.mutex.Lock()
+	connsPerPort := make(map[string]int)
+	for _, active := range p.activeConns {
+		connsPerPort[active.port]++
+	}
+	p.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(activeMappingsDesc, prometheus.GaugeValue, float64(p.metrics.activeMappings.Load()))
+	for port, count := range connsPerPort {
+		ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue, float64(count), port)
+	}
+	ch <- prometheus.MustNewConstMetric(connectionsDialingDesc, prometheus.GaugeValue, float64(p.metrics.connsDialing.Load()))
+	ch <- prometheus.MustNewConstMetric(bytesRelayedDesc, prometheus.CounterValue,
+		float64(p.metrics.bytesToUpstream.Load()), directionUpstream)
+	ch <- prometheus.MustNewConstMetric(bytesRelayedDesc, prometheus.CounterValue,
+		float64(p.metrics.bytesToClient.Load()), directionDownstream)
+	ch <- prometheus.MustNewConstMetric(upstreamDialErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.upstreamDialErrors.Load()))
+	ch <- prometheus.MustNewConstMetric(upstreamDialTimeoutsDesc, prometheus.CounterValue,
+		float64(p.metrics.upstreamDialTimeouts.Load()))
+	ch <- prometheus.MustNewConstMetric(relayErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.relayErrors.Load()))
+	ch <- prometheus.MustNewConstMetric(connsRejectedDesc, prometheus.CounterValue,
+		float64(p.metrics.portLimitRejections.Load()), limitPort)
+	ch <- prometheus.MustNewConstMetric(connsRejectedDesc, prometheus.CounterValue,
+		float64(p.metrics.globalLimitRejections.Load()), limitGlobal)
+	ch <- prometheus.MustNewConstMetric(connsRejectedDesc, prometheus.CounterValue,
+		float64(p.metrics.rateLimitRejections.Load()), limitRate)
+	ch <- prometheus.MustNewConstMetric(connsDeniedDesc, prometheus.CounterValue,
+		float64(p.metrics.connsDenied.Load()))
+	ch <- prometheus.MustNewConstMetric(connsFilteredDesc, prometheus.CounterValue,
+		float64(p.metrics.connsFiltered.Load()))
+	ch <- prometheus.MustNewConstMetric(slowConsumersDesc, prometheus.CounterValue,
+		float64(p.metrics.slowConsumers.Load()))
+	ch <- prometheus.MustNewConstMetric(controlDecodeErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.controlDecodeErrors.Load()))
+	ch <- prometheus.MustNewConstMetric(controlConnsRejectedDesc, prometheus.CounterValue,
+		float64(p.metrics.controlConnsRejected.Load()))
+	ch <- prometheus.MustNewConstMetric(connsDrainedDesc, prometheus.CounterValue,
+		float64(p.metrics.connsDrained.Load()))
+	ch <- prometheus.MustNewConstMetric(connsForceClosedDesc, prometheus.CounterValue,
+		float64(p.metrics.connsForceClosed.Load()))
+	ch <- prometheus.MustNewConstMetric(bindErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.bindErrorsInUse.Load()), bindReasonInUse)
+	ch <- prometheus.MustNewConstMetric(bindErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.bindErrorsPermissionDenied.Load()), bindReasonPermissionDenied)
+	ch <- prometheus.MustNewConstMetric(bindErrorsDesc, prometheus.CounterValue,
+		float64(p.metrics.bindErrorsOther.Load()), bindReasonOther)
+}
+
+// countMappings records the number of listeners of published ports. The
+// caller must hold p.mutex.
+func (p *PortProxy) countMappings() {
+	p.metrics.activeMappings.Store(int64(len(p.activeListeners) + len(p.activeUDPListeners)))
+}
+
+// Stats is a snapshot of the activity of the proxy, a lighter alternative
+// to the Prometheus metrics.
+type Stats struct {
+	// ActiveMappings is the number of listeners of published ports, one
+	// per host IP and port.
+	ActiveMappings int64 `json:"activeMappings"`
+	// ActiveConnections is the number of TCP connections being relayed.
+	ActiveConnections int64 `json:"activeConnections"`
+	// BytesIn is the number of bytes relayed from clients to the upstream,
+	// and BytesOut the number relayed back, across all connections.
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// DialErrors is the number of connections the upstream could not be
+	// dialed for.
+	DialErrors uint64 `json:"dialErrors"`
+}
+
+// Stats returns a snapshot of the activity of the proxy. It does not take
+// any lock, so it is cheap enough to poll. Each value is read atomically,
+// but they are not read all at once.
+func (p *PortProxy) Stats() Stats {
+	return Stats{
+		ActiveMappings:    p.metrics.activeMappings.Load(),
+		ActiveConnections: p.metrics.activeConns.Load(),
+		BytesIn:           p.metrics.bytesToUpstream.Load(),
+		BytesOut:          p.metrics.bytesToClient.Load(),
+		DialErrors:        p.metrics.upstreamDialErrors.Load(),
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyCollector(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err == nil {
+			_, _ = conn.Write([]byte("pong"))
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	// Find a port nothing listens on upstream, so dialing it fails.
+	unused, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	_, unusedPort, err := net.SplitHostPort(unused.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, unused.Close())
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	deadPort, err := nat.NewPort("tcp", unusedPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port:     []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			deadPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: unusedPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(b))
+	conn.Close()
+
+	conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", unusedPort))
+	require.NoError(t, err)
+	_, _ = io.ReadAll(conn)
+	conn.Close()
+
+	expected := `
+# HELP portproxy_active_mappings Number of published ports with an active listener.
+# TYPE portproxy_active_mappings gauge
+portproxy_active_mappings 2
+# HELP portproxy_bytes_relayed_total Bytes relayed from clients to the upstream and from the upstream to clients.
+# TYPE portproxy_bytes_relayed_total counter
+portproxy_bytes_relayed_total{direction="downstream"} 4
+portproxy_bytes_relayed_total{direction="upstream"} 4
+# HELP portproxy_upstream_dial_errors_total Number of relayed connections whose upstream could not be dialed.
+# TYPE portproxy_upstream_dial_errors_total counter
+portproxy_upstream_dial_errors_total 1
+`
+	require.Eventually(t, func() bool {
+		err := testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+			"portproxy_active_mappings", "portproxy_bytes_relayed_total", "portproxy_upstream_dial_errors_total")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPortProxyStats(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+	require.Equal(t, portproxy.Stats{}, portProxy.Stats())
+
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	bindings := []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}}
+	portMapping := types.PortMapping{Ports: nat.PortMap{tcpPort: bindings, udpPort: bindings}}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+	require.Equal(t, portproxy.Stats{ActiveMappings: 2, ActiveConnections: 1}, portProxy.Stats())
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return portProxy.Stats() == portproxy.Stats{ActiveMappings: 2, BytesIn: 4, BytesOut: 4}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Zero(t, portProxy.Stats().ActiveMappings)
+}
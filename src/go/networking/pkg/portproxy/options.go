@@ -0,0 +1,655 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// Option configures optional behavior of a PortProxy.
+type Option func(*PortProxy)
+
+// WithProxyProtocol makes the proxy send a HAProxy PROXY protocol header
+// carrying the real client address at the start of every upstream TCP
+// connection. Version 1 is the human-readable format and version 2 the
+// binary one.
+func WithProxyProtocol(version int) Option {
+	return func(p *PortProxy) {
+		if version != proxyProtocolV1 && version != proxyProtocolV2 {
+			p.logger.Errorf("unsupported PROXY protocol version %d, not sending PROXY headers", version)
+			return
+		}
+		p.proxyProtocolVersion = version
+	}
+}
+
+// WithIdleTimeout closes relayed TCP connections when no data has moved
+// in either direction for the given duration, which reaps relays whose
+// peer went away without closing the connection. A zero duration, the
+// default, keeps idle connections open indefinitely.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		p.idleTimeout = timeout
+	}
+}
+
+// WithUDPSessionTimeout frees the upstream socket of a UDP client once
+// no datagram has been relayed from or to it for the given duration.
+// Every client address gets its own upstream socket, so a short timeout
+// keeps one-shot clients such as DNS queries from piling up sockets, while
+// a long one suits clients that are quiet for a while between datagrams.
+// It defaults to 30 seconds.
+func WithUDPSessionTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout <= 0 {
+			p.logger.Errorf("invalid UDP session timeout %s, using %s", timeout, p.udpSessionTimeout)
+			return
+		}
+		p.udpSessionTimeout = timeout
+	}
+}
+
+// WithMaxConnLifetime closes relayed TCP connections once they have been
+// relayed for the given duration, whether or not they are active, which
+// makes clients reconnect, e.g. to an upstream that was restarted. The
+// connection hook reports os.ErrDeadlineExceeded for such connections. A
+// zero duration, the default, lets connections live indefinitely.
+func WithMaxConnLifetime(lifetime time.Duration) Option {
+	return func(p *PortProxy) {
+		if lifetime < 0 {
+			p.logger.Errorf("invalid maximum connection lifetime %s, not limiting it", lifetime)
+			return
+		}
+		p.maxConnLifetime = lifetime
+	}
+}
+
+// WithWriteTimeout closes relayed TCP connections when a write to either
+// the client or the upstream does not complete within the given duration,
+// because that peer stopped reading, or reads slower than the other one
+// sends. This keeps a wedged peer from holding a relay, and the data
+// buffered for it, indefinitely. The connection hook reports
+// ErrSlowConsumer for such connections. It also keeps the relay from
+// using splice. A zero duration, the default, lets writes block
+// indefinitely.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout < 0 {
+			p.logger.Errorf("invalid write timeout %s, not limiting writes", timeout)
+			return
+		}
+		p.writeTimeout = timeout
+	}
+}
+
+// WithBufferSize sets the size in bytes of the buffers used to relay TCP
+// connections. Buffers are pooled and reused across connections. Without
+// this option the relay uses io.Copy, which lets the kernel copy between
+// sockets where supported and falls back to a 32KiB buffer otherwise.
+// Larger buffers, e.g. 64KiB or 256KiB, can speed up bulk transfers.
+func WithBufferSize(size int) Option {
+	return func(p *PortProxy) {
+		if size <= 0 {
+			p.logger.Errorf("invalid relay buffer size %d, using the default", size)
+			return
+		}
+		p.bufferPool = newBufferPool(size)
+	}
+}
+
+// WithSplice relays TCP connections without copying the data through the
+// proxy, with splice(2) on Linux, even when WithBufferSize is set; the
+// buffers are then only used for the connections that cannot be relayed
+// this way. It takes the client and upstream connections to be bare
+// sockets: connections to ports with an idle timeout, a rate limit, TLS
+// or X-Forwarded-For are wrapped by the proxy, and still copied through a
+// buffer.
+func WithSplice() Option {
+	return func(p *PortProxy) {
+		p.splice = true
+	}
+}
+
+// WithDialTimeout bounds how long each attempt to connect to the upstream
+// may take, 10s by default, so that client connections do not pile up
+// while the VM is unresponsive. A timeout set on the dialer given to
+// WithDialer takes precedence. The client connection is closed when the
+// upstream cannot be reached in time, which is counted in
+// portproxy_upstream_dial_timeouts_total.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout <= 0 {
+			p.logger.Errorf("invalid dial timeout %s, using the default of %s", timeout, defaultDialTimeout)
+			return
+		}
+		p.dialTimeout = timeout
+	}
+}
+
+// WithDialer makes the proxy connect to the upstream with a copy of dialer,
+// shared by all relayed connections, e.g. with a LocalAddr so that
+// connections originate from the interface the VM is reachable through on
+// a multi-homed host. UDP sessions are dialed with it too, from the IP of
+// the LocalAddr, which is ignored for ports relayed to a unix socket.
+func WithDialer(dialer *net.Dialer) Option {
+	return func(p *PortProxy) {
+		if dialer == nil {
+			p.logger.Errorf("invalid nil dialer, using the default one")
+			return
+		}
+		d := *dialer
+		p.dialer = &d
+	}
+}
+
+// WithDialRetry makes the proxy try to connect to the upstream up to
+// attempts times before giving up on a relayed connection, waiting base
+// before the first retry and doubling the wait after every attempt. This
+// covers the upstream not listening yet while the VM boots.
+func WithDialRetry(attempts int, base time.Duration) Option {
+	return func(p *PortProxy) {
+		if attempts < 1 || base <= 0 {
+			p.logger.Errorf("invalid dial retry of %d attempts every %s, not retrying", attempts, base)
+			return
+		}
+		p.dialAttempts = attempts
+		p.dialRetryDelay = base
+	}
+}
+
+// WithListenRetry makes the proxy try to listen on a host IP that is not
+// available up to attempts times before failing the port binding, waiting
+// base before the first retry and doubling the wait after every attempt,
+// since after a resume or a network change the address is often usable
+// again within a second, e.g. once an IPv6 address is no longer tentative.
+// A host IP that is not an address of this host at all, and other errors
+// listening, fail right away. It defaults to defaultListenAttempts every
+// defaultListenRetryDelay, and one attempt disables it.
+func WithListenRetry(attempts int, base time.Duration) Option {
+	return func(p *PortProxy) {
+		if attempts < 1 || base <= 0 {
+			p.logger.Errorf("invalid listen retry of %d attempts every %s, using %d every %s",
+				attempts, base, p.listenAttempts, p.listenRetryDelay)
+			return
+		}
+		p.listenAttempts = attempts
+		p.listenRetryDelay = base
+	}
+}
+
+// WithDialRetryJitter spreads the waits between the dial retries of
+// WithDialRetry randomly by up to factor of their length, e.g. 0.2 waits
+// between 80 and 120 milliseconds instead of 100, so that the many
+// connections failing at once when the VM restarts do not retry in
+// lockstep. The factor must be between 0, the default, and 1.
+func WithDialRetryJitter(factor float64) Option {
+	return func(p *PortProxy) {
+		if factor < 0 || factor > 1 {
+			p.logger.Errorf("invalid dial retry jitter %g, not spreading dial retries", factor)
+			return
+		}
+		p.dialRetryJitter = factor
+	}
+}
+
+// WithUpstreamProbe makes the proxy watch every upstream connection for
+// up to timeout after dialing it, before relaying it. The upstream may
+// accept connections from its kernel backlog while the application is not
+// ready yet, e.g. right after a container starts; such connections are
+// closed or reset shortly after, and the probe fails the dial attempt
+// instead of relaying a dead connection, so that WithDialRetry dials
+// again. An upstream that sends nothing until timeout, e.g. an HTTP
+// server waiting for the request, passes the probe, and bytes the
+// upstream sends first are relayed as usual. The probe delays every
+// relayed connection that the upstream does not speak first on by
+// timeout, so it should be short.
+func WithUpstreamProbe(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout <= 0 {
+			p.logger.Errorf("invalid upstream probe timeout %s, not probing", timeout)
+			return
+		}
+		p.upstreamProbe = timeout
+	}
+}
+
+// WithMaxConnsPerPort limits how many connections each published port
+// relays at once. Connections accepted beyond the limit are closed right
+// away and counted in portproxy_conns_rejected_total{limit="port"}, while
+// portproxy_active_connections shows how close a port is to its limit.
+// Zero, the default, means no limit.
+func WithMaxConnsPerPort(limit int) Option {
+	return func(p *PortProxy) {
+		if limit < 0 {
+			p.logger.Errorf("invalid limit of %d connections per port, not limiting connections", limit)
+			return
+		}
+		p.maxConnsPerPort = limit
+	}
+}
+
+// WithMaxPorts limits how many distinct ports, counting each protocol
+// apart, the proxy publishes at once, so that a runaway port mapping does
+// not exhaust the host. Port bindings that would publish more fail with
+// ErrTooManyPorts, while the ports already published remain; binding a
+// published port on another host IP does not count against the limit.
+// Zero, the default, means no limit.
+func WithMaxPorts(limit int) Option {
+	return func(p *PortProxy) {
+		if limit < 0 {
+			p.logger.Errorf("invalid limit of %d published ports, not limiting ports", limit)
+			return
+		}
+		p.maxPorts = limit
+	}
+}
+
+// WithMaxConns limits how many connections the proxy relays at once
+// across all published ports, to protect the host from running out of
+// file descriptors. Connections accepted beyond the limit are closed right
+// away and counted in portproxy_conns_rejected_total{limit="global"}.
+// Zero, the default, means no limit.
+func WithMaxConns(limit int) Option {
+	return func(p *PortProxy) {
+		if limit < 0 {
+			p.logger.Errorf("invalid limit of %d connections, not limiting connections", limit)
+			return
+		}
+		if limit > 0 {
+			p.connsSemaphore = semaphore.NewWeighted(int64(limit))
+		}
+	}
+}
+
+// WithAcceptRate limits how many new connections each published port
+// accepts per second, allowing bursts of up to burst connections, to
+// smooth out connection floods before they reach the upstream.
+// Connections accepted beyond the rate are closed right away and counted
+// in portproxy_conns_rejected_total{limit="rate"}. Zero, the default,
+// means no limit.
+func WithAcceptRate(perSec, burst int) Option {
+	return func(p *PortProxy) {
+		if perSec < 0 || (perSec > 0 && burst <= 0) {
+			p.logger.Errorf("invalid accept rate of %d connections per second with a burst of %d, not limiting the accept rate",
+				perSec, burst)
+			return
+		}
+		p.acceptRate = perSec
+		p.acceptBurst = burst
+	}
+}
+
+// WithBindAddress makes every published port listen on ip, taking
+// precedence over the HostIP of the port bindings received over the control
+// socket, wildcard addresses included. It only affects the listening side;
+// connections are still relayed to the upstream address. Since bindings
+// that differ only by HostIP then share a listener, removing any of them
+// closes it.
+func WithBindAddress(ip string) Option {
+	return func(p *PortProxy) {
+		if net.ParseIP(ip) == nil {
+			p.logger.Errorf("invalid bind address %q, using the host IP of each port binding", ip)
+			return
+		}
+		p.bindAddress = ip
+	}
+}
+
+// WithLogger routes the proxy logs through logger instead of the standard
+// logrus logger. Logs about a relayed connection carry the port, client
+// and upstream fields. Pass it before the other options so that invalid
+// options are reported through logger too.
+func WithLogger(logger *logrus.Entry) Option {
+	return func(p *PortProxy) {
+		p.logger = logger
+	}
+}
+
+// WithConnectionFilter calls filter with the address of the client and the
+// host port of every TCP connection, before the upstream is dialed. The
+// port is the one the connection was accepted on, e.g. 8080/tcp for a
+// container port 80/tcp published on host port 8080. When filter returns
+// an error, the connection is closed, counted in
+// portproxy_conns_filtered_total, and reported by the ConnClosed event
+// with an error wrapping ErrConnectionFiltered. Unlike the allowed sources
+// of a port mapping, the decision can be deferred to e.g. a policy engine.
+// The filter runs on the goroutine relaying the connection, and may be
+// called concurrently.
+func WithConnectionFilter(filter func(client net.Addr, hostPort nat.Port) error) Option {
+	return func(p *PortProxy) {
+		p.connFilter = filter
+	}
+}
+
+// WithConnectionHook calls hook when a TCP connection to a published port
+// is opened and when it is closed, the latter with the number of bytes
+// relayed in each direction. The hook runs on the goroutine relaying the
+// connection, so it should return quickly.
+func WithConnectionHook(hook func(ConnEvent)) Option {
+	return func(p *PortProxy) {
+		p.connHook = hook
+	}
+}
+
+// WithConnectionProgress makes the hook of WithConnectionHook also be
+// called every interval while a TCP connection is relayed, with a
+// ConnProgress event carrying the bytes relayed in each direction so far.
+// These events are reported from a goroutine of their own, never after
+// the connection is reported closed. Counting the bytes keeps relayed
+// connections from being spliced.
+func WithConnectionProgress(interval time.Duration) Option {
+	return func(p *PortProxy) {
+		if interval <= 0 {
+			p.logger.Errorf("invalid connection progress interval %s, not reporting progress", interval)
+			return
+		}
+		p.connProgressInterval = interval
+	}
+}
+
+// WithCloseExistingOnRemove sets what happens to the connections relayed
+// through a TCP port when it is removed. By default they are left to end
+// on their own, only new connections are refused; with closeExisting, they
+// are closed right away too, like a firewall rule would. Removals asking
+// to drain the connections close them once the drain timeout is over
+// either way, and UDP sessions end with their port.
+func WithCloseExistingOnRemove(closeExisting bool) Option {
+	return func(p *PortProxy) {
+		p.closeOnRemove = closeExisting
+	}
+}
+
+// WithApplyHook calls hook once a control message changed the published
+// ports, with the ports it published and the ones it removed, in the
+// order of ActivePorts. It is not called for messages that leave the
+// ports as they were, e.g. ones publishing ports again or dry runs, nor
+// for debounced messages that cancel each other out. The hook runs
+// without the proxy being locked, so it can call ActivePorts, but before
+// the response to the control message is sent, so it should return
+// quickly.
+func WithApplyHook(hook func(applied, removed []nat.Port)) Option {
+	return func(p *PortProxy) {
+		p.applyHook = hook
+	}
+}
+
+// WithAccessLog writes a JSON line to w whenever a TCP connection to a
+// published port is opened and closed, with the port, the name of its
+// port mapping, the client and upstream addresses and, once closed, how
+// long the connection lasted and the number of bytes relayed in each
+// direction. Writes to w are serialized and made while relaying, so w
+// should not block.
+func WithAccessLog(w io.Writer) Option {
+	return func(p *PortProxy) {
+		p.accessLog = newAccessLog(w)
+	}
+}
+
+// WithTracer records a span for each TCP connection relayed through a
+// published port, with the port, the client and upstream addresses and
+// the number of bytes relayed as attributes. Dialing the upstream, and
+// each dial attempt, are recorded as child spans.
+func WithTracer(tracer Tracer) Option {
+	return func(p *PortProxy) {
+		p.tracer = tracer
+	}
+}
+
+// WithKeepAlive enables TCP keep-alive probes after period of inactivity
+// on both the client and the upstream side of relayed TCP connections, so
+// that long lived idle connections are not dropped by NAT along the way
+// and dead peers are noticed. It does not apply to UDP.
+func WithKeepAlive(period time.Duration) Option {
+	return func(p *PortProxy) {
+		if period <= 0 {
+			p.logger.Errorf("invalid keep-alive period %s, using the system defaults", period)
+			return
+		}
+		p.keepAlivePeriod = period
+	}
+}
+
+// WithNoDelay sets TCP_NODELAY on both the client and the upstream side of
+// connections relayed through the given TCP ports, or through every port
+// when none are given; ports listed in another WithNoDelay keep their own
+// setting. It is set by default, so that interactive protocols like SSH do
+// not wait for small writes to be batched; WithNoDelay(false, ports...)
+// enables Nagle's algorithm again, which may help throughput on ports that
+// carry bulk transfers made of small writes.
+func WithNoDelay(noDelay bool, ports ...nat.Port) Option {
+	return func(p *PortProxy) {
+		if len(ports) == 0 {
+			p.noDelay = noDelay
+			return
+		}
+		for _, port := range ports {
+			if port.Proto() != "tcp" || port.Int() == 0 {
+				p.logger.Errorf("cannot set TCP_NODELAY on port %s, only TCP ports are supported", port)
+				continue
+			}
+			p.noDelayPorts[port.Port()] = noDelay
+		}
+	}
+}
+
+// WithListenBacklog sets the size of the queue of connections to the
+// published TCP ports that are waiting to be accepted, beyond which new
+// connections are dropped. On Linux, the system caps it to the
+// net.core.somaxconn sysctl, which is also the default, so raising it
+// past that takes raising the sysctl; lowering it makes an overloaded
+// port refuse connections sooner. It is not supported on Windows, where
+// the system default is kept and a warning is logged.
+func WithListenBacklog(n int) Option {
+	return func(p *PortProxy) {
+		if n <= 0 {
+			p.logger.Errorf("invalid listen backlog %d, using the system default", n)
+			return
+		}
+		p.listenBacklog = n
+	}
+}
+
+// WithListenControl calls control on the socket of every listener of a
+// published TCP or UDP port before it is bound, after the socket options
+// the proxy sets itself, e.g. to set SO_MARK or IP_TRANSPARENT for routing
+// on the host. It is used as the Control of a net.ListenConfig, so the
+// options available and how to set them, through c.Control on a file
+// descriptor or a Windows socket handle, depend on the platform. An error
+// from control fails the port binding. The control listener given to
+// NewPortProxy is not affected.
+func WithListenControl(control func(network, address string, c syscall.RawConn) error) Option {
+	return func(p *PortProxy) {
+		p.listenControl = control
+	}
+}
+
+// WithLinger sets how closing both the client and the upstream side of
+// relayed TCP connections behaves, as SO_LINGER does: 0 resets them with
+// an RST, discarding data not sent yet, which frees their resources right
+// away, and a positive linger, rounded up to whole seconds, waits that
+// long for unsent data to go out. A negative linger, the default, keeps
+// the graceful FIN of the system defaults.
+//
+// Connections drained by Close are closed this way too once done, as are
+// the ones force closed when the grace period expires. A positive linger
+// can make closing a connection block, which delays Close by as much.
+func WithLinger(linger time.Duration) Option {
+	return func(p *PortProxy) {
+		p.linger = linger
+	}
+}
+
+// WithResetOnDialFailure makes the proxy reset client connections with a
+// TCP RST when the upstream cannot be dialed, instead of closing them
+// gracefully. Clients can then tell a refused connection apart from one
+// that the upstream accepted and closed.
+func WithResetOnDialFailure() Option {
+	return func(p *PortProxy) {
+		p.resetOnDialFailure = true
+	}
+}
+
+// WithApplyDebounce collects the control messages received within d of
+// the first one and applies their net result at once, so that a burst of
+// updates, e.g. while containers start, does not create and close
+// listeners over and over. Adding a port and removing it within the window
+// leaves it alone, and only the last update of a port is applied. Senders
+// get their response once the window is over.
+func WithApplyDebounce(d time.Duration) Option {
+	return func(p *PortProxy) {
+		if d < 0 {
+			p.logger.Errorf("invalid apply debounce %s, applying port mappings right away", d)
+			return
+		}
+		p.applyDebounce = d
+	}
+}
+
+// WithControlReadTimeout bounds how long a control client has to send its
+// port mapping once connected, so that a stalled sender does not tie up
+// the proxy; the connection is dropped when the timeout expires. On a
+// connection kept open, the timeout starts over once the next message
+// starts arriving, and WithControlIdleTimeout bounds the wait in between.
+// It defaults to defaultControlReadTimeout, and zero disables the timeout.
+func WithControlReadTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout < 0 {
+			p.logger.Errorf("invalid control read timeout %s, using %s", timeout, p.controlReadTimeout)
+			return
+		}
+		p.controlReadTimeout = timeout
+	}
+}
+
+// WithControlIdleTimeout bounds how long a control connection kept open
+// may wait for its next message, so that idle senders do not hold on to
+// the slots of WithMaxControlConns forever; the connection is closed when
+// the timeout expires, and the sender connects again for its next message.
+// It defaults to defaultControlIdleTimeout, and zero waits until the proxy
+// closes.
+func WithControlIdleTimeout(timeout time.Duration) Option {
+	return func(p *PortProxy) {
+		if timeout < 0 {
+			p.logger.Errorf("invalid control idle timeout %s, using %s", timeout, p.controlIdleTimeout)
+			return
+		}
+		p.controlIdleTimeout = timeout
+	}
+}
+
+// WithMaxControlMessageSize bounds how many bytes of a control message
+// are read, so that a client sending a gigantic one cannot exhaust the
+// memory of the proxy; larger messages fail to decode and the connection
+// is dropped. It defaults to defaultMaxControlSize, and zero lifts the
+// limit.
+func WithMaxControlMessageSize(size int64) Option {
+	return func(p *PortProxy) {
+		if size < 0 {
+			p.logger.Errorf("invalid maximum control message size %d, using %d", size, p.maxControlSize)
+			return
+		}
+		p.maxControlSize = size
+	}
+}
+
+// WithMaxControlConns limits how many control connections the proxy
+// handles at once, so that a client opening them in a loop cannot spawn
+// an unbounded number of goroutines. Control connections accepted beyond
+// the limit are closed right away, without a response, and counted in
+// portproxy_control_conns_rejected_total. A connection kept open for
+// further control messages counts until it is closed. Zero, the default,
+// means no limit.
+func WithMaxControlConns(limit int) Option {
+	return func(p *PortProxy) {
+		if limit < 0 {
+			p.logger.Errorf("invalid limit of %d control connections, not limiting control connections", limit)
+			return
+		}
+		if limit > 0 {
+			p.controlSemaphore = semaphore.NewWeighted(int64(limit))
+		}
+	}
+}
+
+// WithTLS makes the proxy terminate TLS with cert on the published host
+// port, relaying the decrypted traffic to the upstream over plain TCP.
+// Other ports are relayed as they are. It can be passed once per port.
+func WithTLS(port nat.Port, cert tls.Certificate) Option {
+	return withTLSConfig(port, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+// WithTLSGetCertificate is like WithTLS, but calls getCertificate during
+// every handshake to pick the certificate, e.g. by the server name the
+// client asked for.
+func WithTLSGetCertificate(port nat.Port, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) Option {
+	return withTLSConfig(port, &tls.Config{GetCertificate: getCertificate})
+}
+
+func withTLSConfig(port nat.Port, config *tls.Config) Option {
+	return func(p *PortProxy) {
+		if port.Proto() != "tcp" || port.Int() == 0 {
+			p.logger.Errorf("cannot terminate TLS on port %s, only TCP ports are supported", port)
+			return
+		}
+		p.tlsConfigs[port.Port()] = config
+	}
+}
+
+// WithHTTPForwardedFor makes the proxy add X-Forwarded-For and X-Real-IP
+// headers carrying the address of the client to HTTP/1.x requests relayed
+// through the given TCP ports, for upstreams that do not support the PROXY
+// protocol. Only the first request of each connection is rewritten; later
+// requests on a kept-alive connection are relayed as is. Connections that
+// do not start with an HTTP request line are relayed untouched, after
+// waiting up to 5s for the client to send something.
+func WithHTTPForwardedFor(ports ...nat.Port) Option {
+	return func(p *PortProxy) {
+		for _, port := range ports {
+			if port.Proto() != "tcp" || port.Int() == 0 {
+				p.logger.Errorf("cannot forward the client address on port %s, only TCP ports are supported", port)
+				continue
+			}
+			p.forwardedForPorts[port.Port()] = struct{}{}
+		}
+	}
+}
+
+// WithUpstreamAddresses adds addresses to relay TCP connections to along
+// with the upstream address given to NewPortProxy, e.g. the IPv6 address of
+// the VM next to its IPv4 one. The addresses are dialed in order, each one
+// 250ms after the previous one unless that one failed earlier, and the first
+// to connect is used, so that a dead address does not fail the relay. UDP
+// is only relayed to the first address.
+func WithUpstreamAddresses(ips ...string) Option {
+	return func(p *PortProxy) {
+		for _, ip := range ips {
+			ip = strings.Trim(ip, "[]")
+			if net.ParseIP(ip) == nil {
+				p.logger.Errorf("invalid upstream address %q, not relaying to it", ip)
+				continue
+			}
+			p.upstreamAddresses = append(p.upstreamAddresses, ip)
+		}
+	}
+}
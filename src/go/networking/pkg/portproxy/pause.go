@@ -0,0 +1,121 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// closeNotifyListener closes done once the listener is closed, so that an
+// accept loop waiting for its port to be resumed can stop.
+type closeNotifyListener struct {
+	net.Listener
+	done chan struct{}
+	once sync.Once
+	// listening socket under any TLS, see ListenerFiles
+	tcp *net.TCPListener
+	// set while connections are accepted from the listener, see Healthy
+	accepting atomic.Bool
+}
+
+func newCloseNotifyListener(l net.Listener) *closeNotifyListener {
+	return &closeNotifyListener{Listener: l, done: make(chan struct{})}
+}
+
+func (l *closeNotifyListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// PausePort stops accepting new connections on the published TCP port,
+// while keeping it bound and relaying the connections already accepted.
+// Connections made while the port is paused wait in the listen backlog
+// until it is resumed, and may time out in the meantime. Removing the
+// port also resumes it.
+func (p *PortProxy) PausePort(port nat.Port) error {
+	if port.Proto() != "tcp" {
+		return fmt.Errorf("cannot pause port %s, only TCP ports are supported", port)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.isPublished(port.Port()) {
+		return fmt.Errorf("port %s is not published", port)
+	}
+	if _, paused := p.pausedPorts[port.Port()]; !paused {
+		p.logger.Infof("pausing port [%s]", port.Port())
+		p.pausedPorts[port.Port()] = make(chan struct{})
+	}
+	return nil
+}
+
+// ResumePort accepts new connections on the published TCP port again after
+// PausePort. Resuming a port that is not paused does nothing.
+func (p *PortProxy) ResumePort(port nat.Port) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.resume(port.Port())
+}
+
+// resume wakes up the accept loops of port if it is paused. The caller
+// must hold p.mutex.
+func (p *PortProxy) resume(port string) {
+	if resumed, paused := p.pausedPorts[port]; paused {
+		p.logger.Infof("resuming port [%s]", port)
+		close(resumed)
+		delete(p.pausedPorts, port)
+	}
+}
+
+// resumeIfUnpublished resumes port once none of its listeners are left,
+// so that publishing it again starts afresh. The caller must hold p.mutex.
+func (p *PortProxy) resumeIfUnpublished(port string) {
+	if !p.isPublished(port) {
+		p.resume(port)
+	}
+}
+
+// isPublished reports whether the TCP port has a listener on any host
+// address. The caller must hold p.mutex.
+func (p *PortProxy) isPublished(port string) bool {
+	for addr := range p.activeListeners {
+		if _, listenerPort, err := net.SplitHostPort(addr); err == nil && listenerPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// waitResumed blocks while port is paused, which also keeps the accept loop
+// of listener from accepting more connections. It returns false if
+// listener is closed in the meantime.
+func (p *PortProxy) waitResumed(listener *closeNotifyListener, port string) bool {
+	p.mutex.Lock()
+	resumed, paused := p.pausedPorts[port]
+	p.mutex.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-listener.done:
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyPausePort(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	require.Error(t, portProxy.PausePort(port), "ports that are not published cannot be paused")
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	require.Error(t, portProxy.PausePort(udpPort))
+
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	require.NoError(t, marshalAndSend(localListener, portMapping))
+	addr := net.JoinHostPort("127.0.0.1", testPort)
+	existing, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer existing.Close()
+	require.NoError(t, echo(existing))
+
+	require.NoError(t, portProxy.PausePort(port))
+	require.Equal(t, []nat.Port{port}, portProxy.ActivePorts(), "a paused port stays published")
+	require.NoError(t, echo(existing), "existing connections are still relayed")
+
+	// The kernel still completes the handshake, but the connection is not
+	// relayed until the port is resumed.
+	waiting, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer waiting.Close()
+	_, err = waiting.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, waiting.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = waiting.Read(make([]byte, 4))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	portProxy.ResumePort(port)
+	require.NoError(t, waiting.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(waiting, make([]byte, 4))
+	require.NoError(t, err)
+
+	// Removing a paused port resumes it, so that it starts afresh when
+	// it is published again.
+	require.NoError(t, portProxy.PausePort(port))
+	portMapping.Remove = true
+	require.NoError(t, marshalAndSend(localListener, portMapping))
+	portMapping.Remove = false
+	require.NoError(t, marshalAndSend(localListener, portMapping))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
@@ -0,0 +1,193 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package portproxytest provides a fake of the port proxy control server
+// for testing the clients that send it port mappings.
+package portproxytest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+)
+
+// FakeServer accepts control messages on a unix socket like the port
+// proxy does, and records the port mappings it receives instead of
+// publishing them. Each message is answered with a successful response,
+// unless SetResponse says otherwise.
+type FakeServer struct {
+	// SocketPath is the path of the unix socket the server listens on.
+	SocketPath string
+
+	listener net.Listener
+	dir      string
+	wg       sync.WaitGroup
+
+	mutex        sync.Mutex
+	portMappings []types.PortMapping
+	respond      func(types.ControlMessage) types.PortMappingResponse
+}
+
+// NewFakeServer starts a FakeServer listening on a unix socket in a new
+// temporary directory. The caller should call Close when finished, to
+// shut it down and remove the directory. Like httptest.NewServer, it
+// panics if the socket cannot be listened on.
+func NewFakeServer() *FakeServer {
+	dir, err := os.MkdirTemp("", "portproxytest")
+	if err != nil {
+		panic("portproxytest: failed to create socket directory: " + err.Error())
+	}
+	socketPath := filepath.Join(dir, "portproxy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic("portproxytest: failed to listen on " + socketPath + ": " + err.Error())
+	}
+	s := &FakeServer{
+		SocketPath: socketPath,
+		listener:   listener,
+		dir:        dir,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops accepting control messages, waits for the ones in progress
+// and removes the socket.
+func (s *FakeServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+}
+
+// PortMappings returns the port mappings received so far, in the order
+// they were received. The port mappings of a batch are listed one by one.
+func (s *FakeServer) PortMappings() []types.PortMapping {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]types.PortMapping(nil), s.portMappings...)
+}
+
+// Reset forgets the port mappings received so far.
+func (s *FakeServer) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.portMappings = nil
+}
+
+// SetResponse makes the server answer the control messages it receives
+// from now on with the response returned by respond, e.g. to report
+// failed port bindings. A nil respond restores the default successful
+// response.
+func (s *FakeServer) SetResponse(respond func(types.ControlMessage) types.PortMappingResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.respond = respond
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle records the control messages read from conn and writes back
+// their responses, the same way the port proxy does.
+func (s *FakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	dec := portproxy.NewControlDecoder(conn)
+	for first := true; ; first = false {
+		msg, err := dec.Decode()
+		if err != nil {
+			if !first && errors.Is(err, io.EOF) {
+				return
+			}
+			_ = json.NewEncoder(conn).Encode(types.PortMappingResponse{
+				Error:   "failed to decode port mapping: " + err.Error(),
+				Results: []types.PortBindingResult{},
+			})
+			return
+		}
+		s.record(conn, msg)
+		if !msg.KeepOpen {
+			return
+		}
+	}
+}
+
+// record records msg and writes back its response on conn.
+func (s *FakeServer) record(conn net.Conn, msg types.ControlMessage) {
+	s.mutex.Lock()
+	if msg.PortMapping != nil {
+		s.portMappings = append(s.portMappings, *msg.PortMapping)
+	}
+	s.portMappings = append(s.portMappings, msg.PortMappings...)
+	respond := s.respond
+	s.mutex.Unlock()
+
+	if respond == nil {
+		respond = successResponse
+	}
+	_ = json.NewEncoder(conn).Encode(respond(msg))
+}
+
+// successResponse reports every port binding of msg as applied.
+func successResponse(msg types.ControlMessage) types.PortMappingResponse {
+	response := types.PortMappingResponse{
+		Version: msg.Version,
+		Success: true,
+		Results: []types.PortBindingResult{},
+	}
+	portMappings := msg.PortMappings
+	if msg.PortMapping != nil {
+		portMappings = []types.PortMapping{*msg.PortMapping}
+	}
+	for _, pm := range portMappings {
+		result := types.PortMappingResult{Success: true, Results: []types.PortBindingResult{}}
+		for port, bindings := range pm.Ports {
+			for _, binding := range bindings {
+				result.Results = append(result.Results, types.PortBindingResult{
+					Port:     port,
+					HostIP:   binding.HostIP,
+					HostPort: binding.HostPort,
+					Success:  true,
+				})
+			}
+		}
+		response.Results = append(response.Results, result.Results...)
+		if msg.PortMappings != nil {
+			response.Mappings = append(response.Mappings, result)
+		}
+	}
+	return response
+}
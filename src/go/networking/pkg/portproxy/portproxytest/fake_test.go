@@ -0,0 +1,125 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxytest_test
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy/portproxytest"
+	"github.com/stretchr/testify/require"
+)
+
+func send(t *testing.T, socketPath string, msg types.ControlMessage) types.PortMappingResponse {
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, portproxy.EncodeControlMessage(conn, msg))
+	var response types.PortMappingResponse
+	require.NoError(t, json.NewDecoder(conn).Decode(&response))
+	return response
+}
+
+func TestFakeServer(t *testing.T) {
+	server := portproxytest.NewFakeServer()
+	defer server.Close()
+
+	web := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		},
+	}
+	dns := types.PortMapping{
+		Remove: true,
+		Ports: nat.PortMap{
+			"53/udp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "53"}},
+		},
+	}
+
+	response := send(t, server.SocketPath, types.ControlMessage{PortMapping: &web})
+	require.True(t, response.Success)
+	require.Equal(t, []types.PortBindingResult{
+		{Port: "80/tcp", HostIP: "127.0.0.1", HostPort: "8080", Success: true},
+	}, response.Results)
+	require.Empty(t, response.Mappings)
+
+	response = send(t, server.SocketPath, types.ControlMessage{Version: 1, PortMappings: []types.PortMapping{dns, web}})
+	require.Equal(t, 1, response.Version)
+	require.True(t, response.Success)
+	require.Len(t, response.Results, 2)
+	require.Len(t, response.Mappings, 2)
+
+	require.Equal(t, []types.PortMapping{web, dns, web}, server.PortMappings())
+	server.Reset()
+	require.Empty(t, server.PortMappings())
+}
+
+func TestFakeServerSetResponse(t *testing.T) {
+	server := portproxytest.NewFakeServer()
+	defer server.Close()
+
+	failure := types.PortMappingResponse{Error: "failed", Results: []types.PortBindingResult{}}
+	server.SetResponse(func(types.ControlMessage) types.PortMappingResponse {
+		return failure
+	})
+	pm := types.PortMapping{}
+	require.Equal(t, failure, send(t, server.SocketPath, types.ControlMessage{PortMapping: &pm}))
+	require.Equal(t, []types.PortMapping{pm}, server.PortMappings())
+
+	server.SetResponse(nil)
+	require.True(t, send(t, server.SocketPath, types.ControlMessage{PortMapping: &pm}).Success)
+}
+
+func TestFakeServerMalformed(t *testing.T) {
+	server := portproxytest.NewFakeServer()
+	defer server.Close()
+
+	conn, err := net.Dial("unix", server.SocketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("not json"))
+	require.NoError(t, err)
+	var response types.PortMappingResponse
+	require.NoError(t, json.NewDecoder(conn).Decode(&response))
+	require.False(t, response.Success)
+	require.NotEmpty(t, response.Error)
+	require.Empty(t, server.PortMappings())
+}
+
+func TestFakeServerKeepOpen(t *testing.T) {
+	server := portproxytest.NewFakeServer()
+	defer server.Close()
+
+	web := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		},
+	}
+	conn, err := net.Dial("unix", server.SocketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	for _, keepOpen := range []bool{true, false} {
+		require.NoError(t, portproxy.EncodeControlMessage(conn, types.ControlMessage{Version: 1, PortMapping: &web, KeepOpen: keepOpen}))
+		var response types.PortMappingResponse
+		require.NoError(t, dec.Decode(&response))
+		require.True(t, response.Success)
+	}
+	require.Equal(t, []types.PortMapping{web, web}, server.PortMappings())
+}
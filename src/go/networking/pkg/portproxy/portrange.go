@@ -0,0 +1,73 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// portBindingSpec is a port binding for a single host port along with
+// the container port it belongs to.
+type portBindingSpec struct {
+	port    nat.Port
+	binding nat.PortBinding
+}
+
+// expandPortRange turns a port binding whose HostPort is a range, e.g.
+// 30000-30100, into one binding per host port. The container port is
+// either a single port shared by all of them, or a range of the same
+// size whose ports are paired with the host ports in order. Bindings for
+// a single host port are returned as they are.
+func expandPortRange(containerPort nat.Port, portBinding nat.PortBinding) ([]portBindingSpec, error) {
+	if !strings.Contains(portBinding.HostPort, "-") {
+		return []portBindingSpec{{port: containerPort, binding: portBinding}}, nil
+	}
+	hostStart, hostEnd, err := nat.ParsePortRangeToInt(portBinding.HostPort)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPort, err)
+	}
+	containerStart, containerEnd, err := containerPort.Range()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPort, err)
+	}
+	pairPorts := containerStart != containerEnd
+	if pairPorts && containerEnd-containerStart != hostEnd-hostStart {
+		return nil, fmt.Errorf("%w: host port range %s does not match container port range %s",
+			ErrInvalidPort, portBinding.HostPort, containerPort.Port())
+	}
+
+	specs := make([]portBindingSpec, 0, hostEnd-hostStart+1)
+	for i := 0; i <= hostEnd-hostStart; i++ {
+		port := containerPort
+		if pairPorts {
+			port, err = nat.NewPort(containerPort.Proto(), strconv.Itoa(containerStart+i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		specs = append(specs, portBindingSpec{
+			port: port,
+			binding: nat.PortBinding{
+				HostIP:   portBinding.HostIP,
+				HostPort: strconv.Itoa(hostStart + i),
+			},
+		})
+	}
+	return specs, nil
+}
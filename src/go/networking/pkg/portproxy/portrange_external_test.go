@@ -0,0 +1,73 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyPortRange(t *testing.T) {
+	localListener, portProxy := startPortProxy(t, "127.0.0.1")
+
+	// The range is below the ephemeral ports so that other tests do not
+	// use any of them. Take a port in the middle of the range so that it
+	// cannot be published.
+	const first, last = 21000, 21999
+	inUse, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(first+500)))
+	if err != nil {
+		t.Skipf("port %d is not available: %s", first+500, err)
+	}
+	defer inUse.Close()
+
+	hostPorts := fmt.Sprintf("%d-%d", first, last)
+	port, err := nat.NewPort("tcp", hostPorts)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPorts}},
+		},
+	}
+	start := time.Now()
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	require.False(t, response.Success)
+	require.Len(t, response.Results, last-first+1)
+	var failed []types.PortBindingResult
+	for _, result := range response.Results {
+		if !result.Success {
+			failed = append(failed, result)
+		}
+	}
+	require.Len(t, failed, 1)
+	require.Equal(t, strconv.Itoa(first+500), failed[0].HostPort)
+	require.Equal(t, nat.Port(fmt.Sprintf("%d/tcp", first+500)), failed[0].Port)
+	require.Len(t, portProxy.ActivePorts(), last-first)
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Empty(t, portProxy.ActivePorts())
+}
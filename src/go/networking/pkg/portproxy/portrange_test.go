@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPortRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		containerPort nat.Port
+		hostPort      string
+		expected      []portBindingSpec
+	}{
+		{
+			name:          "single port",
+			containerPort: "80/tcp",
+			hostPort:      "8080",
+			expected: []portBindingSpec{
+				{port: "80/tcp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8080"}},
+			},
+		},
+		{
+			name:          "paired ranges",
+			containerPort: "80-82/udp",
+			hostPort:      "8080-8082",
+			expected: []portBindingSpec{
+				{port: "80/udp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8080"}},
+				{port: "81/udp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8081"}},
+				{port: "82/udp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8082"}},
+			},
+		},
+		{
+			name:          "host range for a single container port",
+			containerPort: "80/tcp",
+			hostPort:      "8080-8081",
+			expected: []portBindingSpec{
+				{port: "80/tcp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8080"}},
+				{port: "80/tcp", binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8081"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := expandPortRange(tt.containerPort, nat.PortBinding{HostIP: "127.0.0.1", HostPort: tt.hostPort})
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, specs)
+		})
+	}
+}
+
+func TestExpandPortRangeErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		containerPort nat.Port
+		hostPort      string
+	}{
+		{name: "reversed range", containerPort: "80/tcp", hostPort: "8081-8080"},
+		{name: "invalid range", containerPort: "80/tcp", hostPort: "8080-http"},
+		{name: "mismatched ranges", containerPort: "80-81/tcp", hostPort: "8080-8082"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := expandPortRange(tt.containerPort, nat.PortBinding{HostPort: tt.hostPort})
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// connProgress counts the bytes relayed in each direction of a connection
+// as they are written, and reports them to the connection hook as
+// ConnProgress events every interval until it is stopped.
+type connProgress struct {
+	toUpstream atomic.Int64
+	toClient   atomic.Int64
+	// closed to stop reporting, and once the reporting goroutine is done
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startProgress starts reporting the progress of the connection event
+// describes when WithConnectionProgress is used, and returns nil
+// otherwise.
+func (p *PortProxy) startProgress(event ConnEvent) *connProgress {
+	if p.connHook == nil || p.connProgressInterval == 0 {
+		return nil
+	}
+	progress := &connProgress{done: make(chan struct{}), stopped: make(chan struct{})}
+	event.Type = ConnProgress
+	go func() {
+		defer close(progress.stopped)
+		ticker := time.NewTicker(p.connProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progress.done:
+				return
+			case <-ticker.C:
+				event.BytesIn, event.BytesOut = progress.toUpstream.Load(), progress.toClient.Load()
+				p.emitConnEvent(event)
+			}
+		}
+	}()
+	return progress
+}
+
+// stop stops reporting, and returns once the last report is done, so
+// that none comes after the connection is reported closed.
+func (c *connProgress) stop() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	<-c.stopped
+}
+
+// wrap returns conn and upstream counting the bytes written to them.
+func (c *connProgress) wrap(conn, upstream net.Conn) (net.Conn, net.Conn) {
+	return &countingConn{halfCloser: halfCloser{conn}, written: &c.toClient}, &countingConn{halfCloser: halfCloser{upstream}, written: &c.toUpstream}
+}
+
+// countingConn adds the number of bytes written to it to written.
+type countingConn struct {
+	halfCloser
+	written *atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyConnectionProgress(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	events := make(chan portproxy.ConnEvent, 100)
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) { events <- event }),
+		portproxy.WithConnectionProgress(20*time.Millisecond))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	err = marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}}},
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// The bytes relayed so far are reported while the connection is open.
+	timeout := time.After(5 * time.Second)
+	for progressed := false; !progressed; {
+		select {
+		case event := <-events:
+			progressed = event.Type == portproxy.ConnProgress && event.BytesIn == 4 && event.BytesOut == 4
+		case <-timeout:
+			require.FailNow(t, "the progress of the connection was not reported")
+		}
+	}
+
+	require.NoError(t, conn.Close())
+	for closed := false; !closed; {
+		select {
+		case event := <-events:
+			closed = event.Type == portproxy.ConnClosed
+			if closed {
+				require.Equal(t, int64(4), event.BytesIn)
+				require.Equal(t, int64(4), event.BytesOut)
+			}
+		case <-timeout:
+			require.FailNow(t, "connection closed event was not reported")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, events, "no progress should be reported once the connection is closed")
+}
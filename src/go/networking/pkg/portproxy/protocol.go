@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// protocol publishes the port bindings of a transport protocol. Relaying
+// another protocol takes registering it in protocols, without changing
+// how port mappings are applied.
+type protocol struct {
+	// check rejects the features of pm that the protocol cannot relay.
+	check func(pm types.PortMapping, containerPort nat.Port) error
+	// exec publishes a port binding listened on addr and relayed to
+	// upstreamPort, or removes it when pm.Remove is set, and returns the
+	// host port it is published on. The caller must hold p.mutex.
+	exec func(p *PortProxy, pm types.PortMapping, addr string, portBinding nat.PortBinding, upstreamPort string) (string, error)
+	// listening returns the addresses the protocol listens on. The caller
+	// must hold p.mutex.
+	listening func(p *PortProxy) []string
+	// listenAddr returns the address the listener for addr is bound to,
+	// or nil when there is none. The caller must hold p.mutex.
+	listenAddr func(p *PortProxy, addr string) net.Addr
+}
+
+// protocols are the protocols ports can be published for, keyed by the
+// name nat.Port.Proto returns. SCTP is not among them since the standard
+// library has no SCTP sockets.
+var protocols = map[string]protocol{
+	"tcp": {
+		check:     func(types.PortMapping, nat.Port) error { return nil },
+		exec:      (*PortProxy).execTCPListener,
+		listening: func(p *PortProxy) []string { return mapKeys(p.activeListeners) },
+		listenAddr: func(p *PortProxy, addr string) net.Addr {
+			if l, ok := p.activeListeners[addr]; ok {
+				return l.Addr()
+			}
+			return nil
+		},
+	},
+	"udp": {
+		check:     checkUDPMapping,
+		exec:      (*PortProxy).execUDPListener,
+		listening: func(p *PortProxy) []string { return mapKeys(p.activeUDPListeners) },
+		listenAddr: func(p *PortProxy, addr string) net.Addr {
+			if u, ok := p.activeUDPListeners[addr]; ok {
+				return u.conn.LocalAddr()
+			}
+			return nil
+		},
+	},
+}
+
+// lookupProtocol returns the protocol of containerPort.
+func lookupProtocol(containerPort nat.Port) (protocol, error) {
+	proto, ok := protocols[containerPort.Proto()]
+	if !ok {
+		return protocol{}, fmt.Errorf("%w: protocol %s of port %s is not supported", ErrInvalidPort, containerPort.Proto(), containerPort)
+	}
+	return proto, nil
+}
+
+// checkUDPMapping rejects the features that only apply to connections.
+func checkUDPMapping(pm types.PortMapping, containerPort nat.Port) error {
+	if pm.Target != "" {
+		return fmt.Errorf("target %q is not supported for UDP port %s", pm.Target, containerPort)
+	}
+	if len(pm.AllowedSources) > 0 {
+		return fmt.Errorf("allowed sources are not supported for UDP port %s", containerPort)
+	}
+	return nil
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
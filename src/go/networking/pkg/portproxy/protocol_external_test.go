@@ -0,0 +1,46 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyUnsupportedProtocol(t *testing.T) {
+	localListener, _ := startPortProxy(t, "127.0.0.1")
+
+	testPort := freePort(t)
+	port, err := nat.NewPort("sctp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Len(t, response.Results, 1)
+	require.Contains(t, response.Results[0].Error, "not supported")
+
+	// The port is not published over another protocol instead.
+	_, err = net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", testPort), time.Second)
+	require.Error(t, err)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupProtocol(t *testing.T) {
+	for _, port := range []nat.Port{"80/tcp", "80", "53/udp"} {
+		_, err := lookupProtocol(port)
+		require.NoErrorf(t, err, "port %s", port)
+	}
+	_, err := lookupProtocol("9899/sctp")
+	require.ErrorContains(t, err, "protocol sctp of port 9899/sctp is not supported")
+}
+
+func TestProtocolCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		port  nat.Port
+		pm    types.PortMapping
+		valid bool
+	}{
+		{name: "plain TCP", port: "80/tcp", valid: true},
+		{name: "TCP target", port: "80/tcp", pm: types.PortMapping{Target: "unix:///run/app.sock"}, valid: true},
+		{name: "TCP allowed sources", port: "80/tcp", pm: types.PortMapping{AllowedSources: []string{"127.0.0.1"}}, valid: true},
+		{name: "plain UDP", port: "53/udp", valid: true},
+		{name: "UDP target", port: "53/udp", pm: types.PortMapping{Target: "unix:///run/app.sock"}},
+		{name: "UDP allowed sources", port: "53/udp", pm: types.PortMapping{AllowedSources: []string{"127.0.0.1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, err := lookupProtocol(tt.port)
+			require.NoError(t, err)
+			err = proto.check(tt.pm, tt.port)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
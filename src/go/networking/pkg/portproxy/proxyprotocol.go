@@ -0,0 +1,110 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol versions, as described in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	proxyProtocolV1 = 1
+	proxyProtocolV2 = 2
+)
+
+const (
+	// proxyV2VersionCommand is version 2 with the PROXY command.
+	proxyV2VersionCommand = 0x21
+	// Address family and transport protocol bytes.
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxyV2Signature starts every version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes a PROXY protocol header describing a
+// connection from src to dst.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case proxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case proxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+	return writeFull(w, header)
+}
+
+// proxyHeaderV1 returns the human-readable (version 1) header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n". When either address is
+// not a TCP address the connection is reported as "PROXY UNKNOWN".
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK || srcAddr.IP == nil || dstAddr.IP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+			srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+		ipv6String(srcAddr.IP), ipv6String(dstAddr.IP), srcAddr.Port, dstAddr.Port))
+}
+
+// ipv6String formats ip as an IPv6 address. Both addresses in a header
+// must be of the same family, so an IPv4 address paired with an IPv6 one
+// is sent in its IPv4-mapped form, which net.IP.String would otherwise
+// print in dotted decimal.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// proxyHeaderV2 returns the binary (version 2) header: the 16-byte
+// preamble followed by the address block, without any TLVs. When either
+// address is not a TCP address the address family is left unspecified.
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK || srcAddr.IP == nil || dstAddr.IP == nil {
+		return append(header, proxyV2VersionCommand, proxyV2Unspec, 0, 0)
+	}
+	family := byte(proxyV2TCP4)
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family = proxyV2TCP6
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+	}
+	addrLen := 2*len(srcIP) + 4
+	header = append(header, proxyV2VersionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(addrLen))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcAddr.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstAddr.Port))
+	return header
+}
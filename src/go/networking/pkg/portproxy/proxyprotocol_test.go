@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      net.Addr
+		dst      net.Addr
+		expected string
+	}{
+		{
+			name:     "IPv4",
+			src:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:      &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+			expected: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		},
+		{
+			name:     "IPv6",
+			src:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:      &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:     "mixed address families",
+			src:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:      &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			expected: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:     "unknown client address",
+			src:      &net.UnixAddr{Name: "@", Net: "unix"},
+			dst:      &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+			expected: "PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, string(proxyHeaderV1(tt.src, tt.dst)))
+		})
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	signature := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	tests := []struct {
+		name     string
+		src      net.Addr
+		dst      net.Addr
+		expected []byte
+	}{
+		{
+			name: "IPv4",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+			expected: append(append([]byte{}, signature...),
+				0x21, 0x11, 0x00, 0x0C,
+				192, 0, 2, 1,
+				192, 0, 2, 2,
+				0xDC, 0x04,
+				0x01, 0xBB),
+		},
+		{
+			name: "IPv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			expected: append(append([]byte{}, signature...),
+				0x21, 0x21, 0x00, 0x24,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xDC, 0x04,
+				0x01, 0xBB),
+		},
+		{
+			name: "unknown client address",
+			src:  &net.UnixAddr{Name: "@", Net: "unix"},
+			dst:  &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+			expected: append(append([]byte{}, signature...),
+				0x21, 0x00, 0x00, 0x00),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, proxyHeaderV2(tt.src, tt.dst))
+		})
+	}
+}
+
+// shortWriter accepts at most one byte per Write call.
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return w.Buffer.Write(b[:1])
+}
+
+func TestWriteProxyHeaderShortWrites(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	var w shortWriter
+	require.NoError(t, writeProxyHeader(&w, proxyProtocolV2, src, dst))
+	require.Equal(t, proxyHeaderV2(src, dst), w.Bytes())
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"math"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimit caps the throughput of a published port. The limiters
+// are shared by all the connections to the port, each direction having
+// its own token bucket.
+type bandwidthLimit struct {
+	toUpstream *rate.Limiter
+	toClient   *rate.Limiter
+}
+
+// newBandwidthLimit returns a limit of bytesPerSec in each direction,
+// or nil when bytesPerSec is not positive. Up to a second worth of
+// traffic can be sent in a burst.
+func newBandwidthLimit(bytesPerSec int64) *bandwidthLimit {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(min(bytesPerSec, math.MaxInt32))
+	return &bandwidthLimit{
+		toUpstream: rate.NewLimiter(rate.Limit(bytesPerSec), burst),
+		toClient:   rate.NewLimiter(rate.Limit(bytesPerSec), burst),
+	}
+}
+
+// wrap returns the client and upstream connections with their reads
+// throttled; waiting stops once ctx is done.
+func (l *bandwidthLimit) wrap(ctx context.Context, conn, upstream net.Conn) (net.Conn, net.Conn) {
+	return &rateLimitedConn{halfCloser: halfCloser{conn}, ctx: ctx, limiter: l.toUpstream},
+		&rateLimitedConn{halfCloser: halfCloser{upstream}, ctx: ctx, limiter: l.toClient}
+}
+
+type rateLimitedConn struct {
+	halfCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	// Reading more than the burst at once could never be allowed.
+	if burst := c.limiter.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if waitErr := c.limiter.WaitN(c.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyRateLimit(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	const rateBytesPerSec = 50000
+	// Twice the rate: the first half goes out in a burst and the second
+	// half takes about a second.
+	payload := make([]byte, 2*rateBytesPerSec)
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = c.Write(payload)
+			}()
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	localListener, _ := startPortProxy(t, testServerIP)
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		RateBytesPerSec: rateBytesPerSec,
+	}
+
+	download := func() time.Duration {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		start := time.Now()
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Len(t, b, len(payload))
+		return time.Since(start)
+	}
+
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.GreaterOrEqual(t, download(), 800*time.Millisecond)
+
+	// Publishing the port again without a rate lifts the limit.
+	portMapping.RateBytesPerSec = 0
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Less(t, download(), 500*time.Millisecond)
+}
@@ -0,0 +1,190 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// halfCloseTimeout is how long a relay keeps copying in one direction
+// once the other direction is done, e.g. because the client closed its
+// write side, before both connections are closed.
+const halfCloseTimeout = 30 * time.Second
+
+// relay copies data in both directions between the client connection
+// and the upstream connection until both directions are done, closing
+// both connections. When one direction reaches the end of its stream,
+// the write side of its destination is closed so that the peer sees it
+// too, and the other direction is given linger to finish; when it fails,
+// both connections are closed right away. It returns the
+// number of bytes copied to the upstream and to the client, along with
+// any error that interrupted the copy. Copy buffers are taken from pool
+// when it is not nil. Cancelling ctx aborts both directions right away.
+func relay(ctx context.Context, logger *logrus.Entry, conn, upstream net.Conn, pool *sync.Pool, linger time.Duration) (toUpstream, toClient int64, err error) {
+	var upstreamErr, clientErr error
+	closeBoth := func() {
+		_ = conn.Close()
+		_ = upstream.Close()
+	}
+	// A deadline in the past fails blocked reads and writes at once, even
+	// on connections wrapping others, before they are closed.
+	stop := context.AfterFunc(ctx, func() {
+		logger.Debugf("aborting relay: %s", context.Cause(ctx))
+		expired := time.Unix(1, 0)
+		_ = conn.SetDeadline(expired)
+		_ = upstream.SetDeadline(expired)
+		closeBoth()
+	})
+	defer stop()
+	// Buffered so that the copies never block once they are done.
+	done := make(chan struct{}, 2)
+	go pprof.Do(ctx, pprof.Labels(labelDirection, directionToUpstream), func(context.Context) {
+		var err error
+		toUpstream, err = copyWithPool(upstream, conn, pool)
+		upstreamErr = relayError(ctx, err)
+		if err != nil {
+			logger.Debugf("Error copying to upstream: %s", err)
+			closeBoth()
+		} else if err := closeWrite(upstream); err != nil {
+			logger.Debugf("error closing the write side of the upstream: %s", err)
+		}
+		done <- struct{}{}
+	})
+	go pprof.Do(ctx, pprof.Labels(labelDirection, directionToClient), func(context.Context) {
+		var err error
+		toClient, err = copyWithPool(conn, upstream, pool)
+		clientErr = relayError(ctx, err)
+		if err != nil {
+			logger.Debugf("Error copying from upstream: %s", err)
+			closeBoth()
+		} else if err := closeWrite(conn); err != nil {
+			logger.Debugf("error closing the write side of the client: %s", err)
+		}
+		done <- struct{}{}
+	})
+
+	<-done
+	timer := time.NewTimer(linger)
+	select {
+	case <-done:
+		timer.Stop()
+	case <-timer.C:
+		logger.Debugf("closing relay, one direction is still busy %s after the other one is done", linger)
+		// Unblock the direction that is still copying.
+		closeBoth()
+		<-done
+	}
+	if err := upstream.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debugf("error closing connection: %s", err)
+	}
+	_ = conn.Close()
+
+	return toUpstream, toClient, errors.Join(upstreamErr, clientErr)
+}
+
+// writeFull writes all of b to w, even if w accepts it in several short
+// writes. Bytes the proxy injects ahead of the relayed stream, like the
+// PROXY protocol header, must all go out before any payload.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// halfCloser is embedded by the wrappers of relayed connections in place
+// of net.Conn, which alone would hide the CloseWrite method of the wrapped
+// connection, so that half-closing them stays possible.
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite closes the write side of conn when it supports half-closing,
+// like TCP connections do, and closes conn entirely otherwise.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// relayError returns the error that interrupted a copy, ignoring the
+// ones caused by the relay closing the connection itself once the other
+// direction is done or ctx is cancelled.
+func relayError(ctx context.Context, err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	if ctx.Err() != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// newBufferPool returns a pool of copy buffers of the given size.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// spliceable reports whether io.Copy between conn and upstream can leave
+// the copy to the kernel, with splice(2) on Linux, which only the bare
+// connections, and not the ones wrapped by the proxy, allow for.
+func spliceable(conn, upstream net.Conn) bool {
+	if _, ok := conn.(*net.TCPConn); !ok {
+		return false
+	}
+	switch upstream.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// copyWithPool copies from src to dst like io.Copy, using a buffer from
+// pool when one is given. The connections are wrapped so that io.CopyBuffer
+// cannot bypass the buffer through io.ReaderFrom or io.WriterTo.
+func copyWithPool(dst io.Writer, src io.Reader, pool *sync.Pool) (int64, error) {
+	if pool == nil {
+		return io.Copy(dst, src)
+	}
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
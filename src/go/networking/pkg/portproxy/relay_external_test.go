@@ -0,0 +1,204 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyLinger(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// The upstream resets the connection when asked to, and otherwise
+	// reports how the client side of its connection ended.
+	upstreamErrs := make(chan error, 1)
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(c, buf); err == nil && string(buf) == "rset" {
+				_ = c.(*net.TCPConn).SetLinger(0)
+				c.Close()
+				continue
+			}
+			_, err = io.Copy(io.Discard, c)
+			upstreamErrs <- err
+			c.Close()
+		}
+	}()
+
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithLinger(0))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	addr := net.JoinHostPort("127.0.0.1", testPort)
+
+	t.Run("client side", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("rset"))
+		require.NoError(t, err)
+
+		// Without a linger of 0, the proxy would end the connection with
+		// a FIN once the upstream is gone.
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = io.ReadAll(conn)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+	})
+
+	t.Run("upstream side", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("wait"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, conn.Close())
+
+		select {
+		case err := <-upstreamErrs:
+			require.ErrorIs(t, err, syscall.ECONNRESET)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the upstream connection was not closed")
+		}
+	})
+}
+
+func TestPortProxySplice(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+
+	// Each proxy publishes the same port, so it is closed along with its
+	// subtest.
+	spliced := func(t *testing.T, opts ...portproxy.Option) bool {
+		logger, hook := logrustest.NewNullLogger()
+		logger.SetLevel(logrus.DebugLevel)
+		opts = append(opts, portproxy.WithLogger(logrus.NewEntry(logger)), portproxy.WithSplice(), portproxy.WithBufferSize(64*1024))
+		localListener, _ := startPortProxy(t, testServerIP, opts...)
+
+		response, err := sendPortMapping(localListener, types.PortMapping{
+			Ports: nat.PortMap{
+				port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			},
+		})
+		require.NoError(t, err)
+		require.True(t, response.Success)
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, echo(conn))
+
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "relaying with splice" {
+				return true
+			}
+		}
+		return false
+	}
+	t.Run("bare connections", func(t *testing.T) {
+		require.True(t, spliced(t), "bare connections should be spliced")
+	})
+	t.Run("wrapped connections", func(t *testing.T) {
+		require.False(t, spliced(t, portproxy.WithIdleTimeout(time.Minute)),
+			"connections wrapped for the idle timeout should be copied through a buffer")
+	})
+}
+
+func TestPortProxyHalfClose(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// The upstream only answers once the request is over, as HTTP/1.0
+	// servers reading the request until EOF do.
+	reply := bytes.Repeat([]byte("pong"), 64*1024)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			return
+		}
+		_, _ = conn.Write(reply)
+	}()
+
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	// The idle timeout and the rate limit wrap the relayed connections,
+	// which must keep them half-closable.
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithIdleTimeout(time.Minute))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		RateBytesPerSec: 64 * 1024 * 1024,
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	received, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, reply, received)
+}
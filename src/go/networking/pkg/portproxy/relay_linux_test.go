@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BenchmarkRelayCPU reports the CPU time the proxy process spends relaying,
+// which splicing keeps down by not copying the data through user space.
+func BenchmarkRelayCPU(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		pool *sync.Pool
+	}{
+		{name: "splice", pool: nil},
+		{name: "buffered", pool: newBufferPool(64 * 1024)},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			client, conn := tcpPair(b)
+			upstream, server := tcpPair(b)
+			go func() {
+				_, _ = io.Copy(io.Discard, server)
+				server.Close()
+			}()
+			done := make(chan struct{})
+			go func() {
+				relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, bm.pool, halfCloseTimeout)
+				close(done)
+			}()
+
+			chunk := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(chunk)))
+			start := cpuTime(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			_ = client.(*net.TCPConn).CloseWrite()
+			<-done
+			b.StopTimer()
+			b.ReportMetric(float64(cpuTime(b)-start)/float64(b.N), "cpu-ns/op")
+			client.Close()
+		})
+	}
+}
+
+// cpuTime returns the CPU time used by the process so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,384 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// readSizeRecorder records the size of the buffers it is asked to read into.
+type readSizeRecorder struct {
+	io.Reader
+	sizes []int
+}
+
+func (r *readSizeRecorder) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.Reader.Read(p)
+}
+
+// shortWriteConn writes at most 3 bytes per call to its connection.
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c *shortWriteConn) Write(p []byte) (int, error) {
+	return c.Conn.Write(p[:min(len(p), 3)])
+}
+
+func TestWriteFull(t *testing.T) {
+	data := []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+
+	var w shortWriter
+	require.NoError(t, writeFull(&w, data))
+	require.Equal(t, data, w.Bytes())
+
+	require.ErrorIs(t, writeFull(stalledWriter{}, data), io.ErrShortWrite)
+}
+
+// stalledWriter never writes anything, without failing.
+type stalledWriter struct{}
+
+func (stalledWriter) Write([]byte) (int, error) {
+	return 0, nil
+}
+
+func TestSpliceable(t *testing.T) {
+	client, conn := tcpPair(t)
+	defer client.Close()
+	defer conn.Close()
+	upstream, server := tcpPair(t)
+	defer upstream.Close()
+	defer server.Close()
+	require.True(t, spliceable(conn, upstream))
+
+	unixUpstream, unixServer := unixPair(t)
+	defer unixUpstream.Close()
+	defer unixServer.Close()
+	require.True(t, spliceable(conn, unixUpstream))
+
+	// Connections wrapped by the proxy have to be copied through a buffer.
+	idle := newIdleTimeout(logrus.NewEntry(logrus.StandardLogger()), time.Minute, conn, upstream)
+	defer idle.stop()
+	require.False(t, spliceable(idle.wrap(conn), upstream))
+	require.False(t, spliceable(conn, idle.wrap(upstream)))
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	require.False(t, spliceable(pipe, upstream))
+}
+
+// unixPair returns both ends of a unix socket connection.
+func unixPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("unix", filepath.Join(tb.TempDir(), "relay.sock"))
+	require.NoError(tb, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("unix", l.Addr().String())
+	require.NoError(tb, err)
+	conn, ok := <-accepted
+	require.True(tb, ok, "failed to accept connection")
+	return dialed, conn
+}
+
+func TestCopyWithPool(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100000)
+	src := &readSizeRecorder{Reader: bytes.NewReader(data)}
+	var dst bytes.Buffer
+
+	// bytes.Buffer implements io.ReaderFrom, which must not bypass the buffer.
+	n, err := copyWithPool(&dst, src, newBufferPool(1024))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, dst.Bytes())
+	for _, size := range src.sizes {
+		require.Equal(t, 1024, size)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	client, conn := tcpPair(t)
+	defer client.Close()
+	upstream, server := tcpPair(t)
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, nil, time.Minute)
+		close(done)
+	}()
+
+	// The client is done sending, the upstream must see the end of the
+	// stream and still be able to answer.
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	received, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(received))
+
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.NoError(t, server.Close())
+	received, err = io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(received))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return once both directions were done")
+	}
+}
+
+// requireGoroutinesReturn fails the test unless the number of goroutines
+// drops back to baseline within timeout. It polls on the test goroutine, as
+// the goroutine of require.Eventually would be counted too.
+func requireGoroutinesReturn(t *testing.T, baseline int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked by relay: %d running, want at most %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayLinger(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+	upstream, server := tcpPair(t)
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, nil, 100*time.Millisecond)
+		close(done)
+	}()
+
+	// The client is done sending, but the upstream never answers nor
+	// closes the connection.
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return after lingering")
+	}
+	_, err := io.ReadAll(client)
+	require.NoError(t, err, "the client connection should have been closed")
+	_, err = io.ReadAll(server)
+	require.NoError(t, err, "the upstream connection should have been closed")
+
+	requireGoroutinesReturn(t, baseline, 5*time.Second)
+}
+
+func TestRelayCancel(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+	upstream, server := tcpPair(t)
+	defer server.Close()
+
+	// Neither the client nor the upstream ever sends anything, so both
+	// directions are blocked reading.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := relay(ctx, logrus.NewEntry(logrus.StandardLogger()), conn, upstream, nil, time.Minute)
+		done <- err
+	}()
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 4))
+	require.NoError(t, err)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err, "aborting the relay is not an error of the relay")
+	case <-time.After(time.Second):
+		t.Fatal("relay did not return once cancelled")
+	}
+	_, err = io.ReadAll(server)
+	require.NoError(t, err, "the upstream connection should have been closed")
+
+	// Both directions of the relay return promptly once cancelled.
+	requireGoroutinesReturn(t, baseline, time.Second)
+}
+
+func TestRelayWithoutHalfClose(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	// net.Pipe does not support half-closing, so the end of one direction
+	// closes the connections entirely.
+	client, conn := net.Pipe()
+	upstream, server := net.Pipe()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, nil, time.Minute)
+		close(done)
+	}()
+	require.NoError(t, client.Close())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return once the client was closed")
+	}
+	_, err := server.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	requireGoroutinesReturn(t, baseline, 5*time.Second)
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		pool *sync.Pool
+	}{
+		{name: "default", pool: nil},
+		{name: "64KiB", pool: newBufferPool(64 * 1024)},
+		{name: "256KiB", pool: newBufferPool(256 * 1024)},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			client, conn := tcpPair(b)
+			upstream, server := tcpPair(b)
+			go func() {
+				_, _ = io.Copy(io.Discard, server)
+				server.Close()
+			}()
+			done := make(chan struct{})
+			go func() {
+				relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, bm.pool, halfCloseTimeout)
+				close(done)
+			}()
+
+			chunk := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			require.NoError(b, client.(*net.TCPConn).CloseWrite())
+			<-done
+			b.StopTimer()
+			client.Close()
+		})
+	}
+}
+
+// BenchmarkRelayRoundTrip measures request and response round trips of
+// small messages sent in two writes, like an interactive protocol would,
+// with and without Nagle's algorithm on the relayed connections.
+func BenchmarkRelayRoundTrip(b *testing.B) {
+	for _, noDelay := range []bool{true, false} {
+		b.Run(fmt.Sprintf("nodelay=%t", noDelay), func(b *testing.B) {
+			client, conn := tcpPair(b)
+			upstream, server := tcpPair(b)
+			for _, c := range []net.Conn{conn, upstream} {
+				require.NoError(b, setNoDelay(c, noDelay))
+			}
+			// The upstream answers every request in two writes too.
+			go func() {
+				defer server.Close()
+				buf := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(server, buf); err != nil {
+						return
+					}
+					if _, err := server.Write(buf[:1]); err != nil {
+						return
+					}
+					if _, err := server.Write(buf[1:]); err != nil {
+						return
+					}
+				}
+			}()
+			done := make(chan struct{})
+			go func() {
+				relay(context.Background(), logrus.NewEntry(logrus.StandardLogger()), conn, upstream, nil, halfCloseTimeout)
+				close(done)
+			}()
+
+			buf := make([]byte, 2)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, part := range []string{"a", "b"} {
+					if _, err := client.Write([]byte(part)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := io.ReadFull(client, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			client.Close()
+			<-done
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(tb, err)
+	conn, ok := <-accepted
+	require.True(tb, ok, "failed to accept connection")
+	return dialed, conn
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// NewReversePortProxy returns a proxy relaying the other way around: ports
+// listened on in the guest are relayed by the guest to this proxy, which
+// relays them to services on the host. The port mappings received on
+// listener describe the guest listeners: the container port is the port
+// listened on in the guest, which the proxy listens on at listenAddr, the
+// address the guest reaches the host on, and the host port of each binding
+// is the port of the host service on hostAddr it is relayed to. The host IP
+// of the bindings, the upstream port and the target of the port mappings
+// are not supported. Everything else, e.g. limits, allowed sources and
+// options, works as with NewPortProxy, with hostAddr as the upstream, and
+// listenAddr taking precedence over WithBindAddress.
+func NewReversePortProxy(listener net.Listener, listenAddr, hostAddr string, opts ...Option) (*PortProxy, error) {
+	listenAddr = strings.Trim(listenAddr, "[]")
+	if net.ParseIP(listenAddr) == nil {
+		return nil, fmt.Errorf("invalid listen address %q", listenAddr)
+	}
+	portProxy, err := NewPortProxy(listener, hostAddr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	portProxy.reverse = true
+	portProxy.bindAddress = listenAddr
+	return portProxy, nil
+}
+
+// reverseBinding returns the port mapping and port binding a binding
+// received by a reverse proxy is applied as: the container port is
+// published, on the bind address, and relayed to the host port of the
+// binding on the upstream.
+func reverseBinding(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (types.PortMapping, nat.PortBinding, error) {
+	switch {
+	case portBinding.HostIP != "":
+		return pm, portBinding, errors.New("host IP is not supported by a reverse port proxy, the host service is reached on its host address")
+	case pm.UpstreamPort != 0:
+		return pm, portBinding, errors.New("upstream port is not supported by a reverse port proxy, the host port is the port relayed to")
+	case pm.Target != "":
+		return pm, portBinding, errors.New("target is not supported by a reverse port proxy")
+	}
+	hostPort, err := strconv.Atoi(portBinding.HostPort)
+	if err != nil || hostPort < 1 || hostPort > 65535 {
+		return pm, portBinding, fmt.Errorf("%w: host port %q, a reverse port proxy relays to the host port, which must be given",
+			ErrInvalidPort, portBinding.HostPort)
+	}
+	pm.UpstreamPort = hostPort
+	return pm, nat.PortBinding{HostPort: containerPort.Port()}, nil
+}
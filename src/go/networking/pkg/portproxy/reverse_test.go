@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func TestReversePortProxy(t *testing.T) {
+	hostIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	hostPort := startEchoServer(t, hostIP)
+	guestPort, err := nat.NewPort("tcp", freePort(t))
+	require.NoError(t, err)
+
+	_, err = portproxy.NewReversePortProxy(nil, "localhost", hostIP)
+	require.Error(t, err, "the listen address must be an IP address")
+
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	t.Cleanup(func() { localListener.Close() })
+	portProxy, err := portproxy.NewReversePortProxy(localListener, "127.0.0.1", hostIP)
+	require.NoError(t, err)
+	go portProxy.Start()
+	<-portProxy.Ready()
+	t.Cleanup(func() { portProxy.Close() })
+
+	// The container port, listened on in the guest, is relayed to the
+	// host port on the host address.
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{guestPort: []nat.PortBinding{{HostPort: hostPort}}},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing the port should succeed: %+v", response)
+	require.Len(t, response.Results, 1)
+	require.Equal(t, hostPort, response.Results[0].HostPort)
+	require.Equal(t, net.JoinHostPort("127.0.0.1", guestPort.Port()), response.Results[0].ListenAddr)
+
+	conn, err := net.Dial("tcp", response.Results[0].ListenAddr)
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	conn.Close()
+
+	for _, portBinding := range []nat.PortBinding{
+		{HostIP: hostIP, HostPort: hostPort},
+		{HostPort: "0"},
+	} {
+		response, err := sendPortMapping(localListener, types.PortMapping{
+			Ports: nat.PortMap{"9999/tcp": []nat.PortBinding{portBinding}},
+		})
+		require.NoError(t, err)
+		require.Falsef(t, response.Success, "binding %+v is not supported", portBinding)
+		require.NotEmpty(t, response.Results[0].Error)
+	}
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", guestPort.Port()))
+	require.Error(t, err, "the port should no longer be listened on")
+}
@@ -15,105 +15,1076 @@ limitations under the License.
 package portproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
+	"os"
+	"runtime/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-connections/nat"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
-	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/utils"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
+// defaultCloseGracePeriod is how long Close waits for relayed
+// connections to finish on their own.
+const defaultCloseGracePeriod = 5 * time.Second
+
+// maxParallelClose is how many published ports are closed at once while
+// shutting down.
+const maxParallelClose = 32
+
+// errClosing is reported for port bindings received while the proxy
+// is shutting down.
+var errClosing = errors.New("port proxy is closing")
+
+// errorsBuffer is how many errors the Errors channel holds before
+// further errors are dropped.
+const errorsBuffer = 16
+
+// defaultControlReadTimeout is how long a control client has to send its
+// port mapping unless WithControlReadTimeout says otherwise.
+const defaultControlReadTimeout = 10 * time.Second
+
+// defaultControlIdleTimeout is how long a control connection kept open may
+// wait for its next message unless WithControlIdleTimeout says otherwise.
+const defaultControlIdleTimeout = 5 * time.Minute
+
+// defaultMaxControlSize is how many bytes a control message may be unless
+// WithMaxControlMessageSize says otherwise.
+const defaultMaxControlSize = 4 << 20
+
+// activeConn describes a client connection that is being relayed.
+type activeConn struct {
+	// published port the connection was accepted on, and the address of
+	// its listener
+	port string
+	addr string
+	// upstream the connection is relayed to
+	target upstreamTarget
+	// set when the connection did not drain in time while closing
+	forceClosed bool
+}
+
 type PortProxy struct {
-	upstreamAddress string
-	listener        net.Listener
-	quit            chan struct{}
-	// map of port number as a key to associated listener
-	activeListeners map[int]net.Listener
-	mutex           sync.Mutex
-	wg              sync.WaitGroup
+	// addresses connections are relayed to, see WithUpstreamAddresses
+	upstreamAddresses []string
+	listener          net.Listener
+	quit              chan struct{}
+	// closed once the control listener is being accepted on
+	ready chan struct{}
+	// set while the control listener is being accepted on, see Healthy
+	controlAccepting atomic.Bool
+	// makes Close run only once
+	closeOnce sync.Once
+	// cancelled when relayed connections are force closed, which aborts
+	// upstream dials that are still being retried
+	ctx    context.Context
+	cancel context.CancelFunc
+	// map of listen address as a key to associated TCP listener; UDP
+	// relays have their own map, so that the same port number can be
+	// published over both protocols
+	activeListeners map[string]net.Listener
+	// map of listen address as a key to associated UDP relay
+	activeUDPListeners map[string]*udpProxy
+	// map of host port as a key to the TCP listener inherited for it
+	// from another process, until the port is published
+	inheritedListeners map[string]*net.TCPListener
+	// map of listen address as a key to the bandwidth limit of its port
+	bandwidthLimits map[string]*bandwidthLimit
+	// map of TCP listener address as a key to the upstream its
+	// connections are relayed to
+	upstreamTargets map[string]upstreamTarget
+	// map of TCP listener address as a key to the client addresses it
+	// accepts connections from
+	allowedSources map[string]sourceAllowlist
+	// map of TCP listener address as a key to the name of its port
+	// mapping, for the ports that have one
+	mappingNames map[string]string
+	// map of accepted client connections that are being relayed
+	// to where they are relayed
+	activeConns map[net.Conn]activeConn
+	// addresses of the host, listed once for the port mapping whose
+	// bindings are being applied
+	hostAddrs *hostAddrs
+	// set once Close starts, no new listeners are created after that
+	closing bool
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+	metrics metrics
+	// PROXY protocol version to send to the upstream, 0 disables it
+	proxyProtocolVersion int
+	// relays without any traffic for this long are closed, 0 disables it
+	idleTimeout time.Duration
+	// how long a UDP session is kept without any traffic
+	udpSessionTimeout time.Duration
+	// pool of relay copy buffers, nil uses the io.Copy default
+	bufferPool *sync.Pool
+	// relay bare connections with io.Copy even when there is a pool
+	splice bool
+	// number of upstream dial attempts and the delay before the first retry
+	dialAttempts   int
+	dialRetryDelay time.Duration
+	// number of attempts to listen on a host IP that is not available,
+	// and the delay before the first retry
+	listenAttempts   int
+	listenRetryDelay time.Duration
+	// fraction by which the delays between dial retries are randomly
+	// spread, and the source of randomness, returning values in [0, 1)
+	dialRetryJitter float64
+	jitterRand      func() float64
+	// how long a single dial to the upstream may take, unless the dialer
+	// has a timeout of its own
+	dialTimeout time.Duration
+	// how long a dialed upstream connection is watched for being closed
+	// before it is relayed, 0 disables it
+	upstreamProbe time.Duration
+	// dials every upstream connection
+	dialer *net.Dialer
+	// warns about connections piling up while the upstream is dialed
+	dialing dialingWatch
+	// maximum number of connections relayed at once per listener, 0 is unlimited
+	maxConnsPerPort int
+	// maximum number of distinct ports published at once, 0 is unlimited
+	maxPorts int
+	// limits the connections relayed at once across all ports, nil is unlimited
+	connsSemaphore *semaphore.Weighted
+	// new connections accepted per second by each published port, and
+	// how many can be accepted in a burst; zero means no limit
+	acceptRate  int
+	acceptBurst int
+	// host IP all the listeners bind to instead of the one in the port binding
+	bindAddress string
+	logger      *logrus.Entry
+	// called as relayed connections open and close, nil disables it
+	connHook func(ConnEvent)
+	// how often the progress of relayed connections is reported to
+	// connHook, 0 disables it
+	connProgressInterval time.Duration
+	// set for a proxy returned by NewReversePortProxy, see reverseBinding
+	reverse bool
+	// close the connections of TCP ports removed without draining them
+	closeOnRemove bool
+	// called once control messages changed the published ports, nil
+	// disables it
+	applyHook func(applied, removed []nat.Port)
+	// decides whether to relay connections, nil relays all of them
+	connFilter func(client net.Addr, hostPort nat.Port) error
+	// accessLog is nil unless WithAccessLog is used
+	accessLog *accessLog
+	// records spans of relayed connections, nil disables tracing
+	tracer Tracer
+	// period of TCP keep-alive probes on relayed connections, 0 keeps
+	// the system defaults
+	keepAlivePeriod time.Duration
+	// SO_LINGER of relayed connections, negative keeps the system defaults
+	linger time.Duration
+	// TCP_NODELAY of relayed connections, and of those relayed through
+	// the host ports in noDelayPorts
+	noDelay      bool
+	noDelayPorts map[string]bool
+	// backlog of the listeners of published TCP ports, 0 keeps the
+	// system default
+	listenBacklog int
+	// sets socket options of the listeners of published ports, see
+	// WithListenControl
+	listenControl func(network, address string, c syscall.RawConn) error
+	// reset client connections when the upstream cannot be dialed
+	resetOnDialFailure bool
+	// time a control client has to send its port mapping, 0 waits
+	// indefinitely
+	controlReadTimeout time.Duration
+	// time a control connection kept open may idle between messages, 0
+	// waits indefinitely
+	controlIdleTimeout time.Duration
+	// number of bytes read from a control connection at most, 0 is
+	// unlimited
+	maxControlSize int64
+	// limits the number of control connections handled at once, nil is
+	// unlimited
+	controlSemaphore *semaphore.Weighted
+	// map of host port as a key to the TLS configuration of the ports
+	// the proxy terminates TLS on
+	tlsConfigs map[string]*tls.Config
+	// host ports the first HTTP request of connections gets
+	// X-Forwarded-For injected on
+	forwardedForPorts map[string]struct{}
+	// map of host port as a key to a channel closed when the port is
+	// resumed, for the TCP ports that do not accept connections for now
+	pausedPorts map[string]chan struct{}
+	// longest time a TCP connection is relayed for, 0 means no limit
+	maxConnLifetime time.Duration
+	// longest time a write to a relayed connection may take, 0 means no
+	// limit
+	writeTimeout time.Duration
+	// listener errors for the caller, see Errors
+	errs chan error
+	// how long control messages are collected for before their net
+	// result is applied, 0 applies each of them right away
+	applyDebounce time.Duration
+	// control messages waiting for the debounce window to end, and the
+	// timer ending it
+	pendingMutex sync.Mutex
+	pending      []*pendingUpdate
+	pendingTimer *time.Timer
 }
 
-func NewPortProxy(listener net.Listener, upstreamAddr string) *PortProxy {
+// NewPortProxy returns a proxy that applies the port mappings received on
+// listener and relays the published ports to upstreamAddr. The listener is
+// usually a unix socket, but any stream listener works, e.g. TCP on the
+// loopback interface. The control protocol has no authentication of its
+// own: whoever can connect to listener can publish ports, so restricting
+// access to it, especially over TCP, is up to the caller. upstreamAddr
+// must be an IP address, and an error is returned when it is not.
+func NewPortProxy(listener net.Listener, upstreamAddr string, opts ...Option) (*PortProxy, error) {
+	// Accept bracketed IPv6 literals; they are re-bracketed by net.JoinHostPort.
+	upstreamAddr = strings.Trim(upstreamAddr, "[]")
+	if net.ParseIP(upstreamAddr) == nil {
+		return nil, fmt.Errorf("invalid upstream address %q", upstreamAddr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	portProxy := &PortProxy{
-		upstreamAddress: upstreamAddr,
-		listener:        listener,
-		quit:            make(chan struct{}),
-		activeListeners: make(map[int]net.Listener),
+		upstreamAddresses:  []string{upstreamAddr},
+		listener:           listener,
+		quit:               make(chan struct{}),
+		ready:              make(chan struct{}),
+		ctx:                ctx,
+		cancel:             cancel,
+		dialAttempts:       1,
+		listenAttempts:     defaultListenAttempts,
+		listenRetryDelay:   defaultListenRetryDelay,
+		jitterRand:         rand.Float64,
+		dialTimeout:        defaultDialTimeout,
+		dialing:            dialingWatch{threshold: defaultDialingWarnThreshold, after: defaultDialingWarnAfter},
+		linger:             -1,
+		noDelay:            true,
+		noDelayPorts:       make(map[string]bool),
+		controlReadTimeout: defaultControlReadTimeout,
+		controlIdleTimeout: defaultControlIdleTimeout,
+		maxControlSize:     defaultMaxControlSize,
+		udpSessionTimeout:  defaultUDPSessionTimeout,
+		activeListeners:    make(map[string]net.Listener),
+		activeUDPListeners: make(map[string]*udpProxy),
+		inheritedListeners: make(map[string]*net.TCPListener),
+		bandwidthLimits:    make(map[string]*bandwidthLimit),
+		upstreamTargets:    make(map[string]upstreamTarget),
+		allowedSources:     make(map[string]sourceAllowlist),
+		mappingNames:       make(map[string]string),
+		tlsConfigs:         make(map[string]*tls.Config),
+		forwardedForPorts:  make(map[string]struct{}),
+		pausedPorts:        make(map[string]chan struct{}),
+		errs:               make(chan error, errorsBuffer),
+		activeConns:        make(map[net.Conn]activeConn),
+		logger:             logrus.NewEntry(logrus.StandardLogger()),
+	}
+	for _, opt := range opts {
+		opt(portProxy)
+	}
+	if portProxy.dialer == nil {
+		portProxy.dialer = &net.Dialer{}
+	}
+	if portProxy.dialer.Timeout == 0 {
+		portProxy.dialer.Timeout = portProxy.dialTimeout
+	}
+	return portProxy, nil
+}
+
+// MustNewPortProxy is like NewPortProxy but panics if the upstream address
+// is invalid, for callers passing a constant.
+func MustNewPortProxy(listener net.Listener, upstreamAddr string, opts ...Option) *PortProxy {
+	portProxy, err := NewPortProxy(listener, upstreamAddr, opts...)
+	if err != nil {
+		panic(err)
 	}
 	return portProxy
 }
 
+// Start accepts port mappings on the control listener until the proxy
+// is closed.
 func (p *PortProxy) Start() error {
-	logrus.Infof("Proxy server started accepting on %s, forwarding to %s", p.listener.Addr(), p.upstreamAddress)
+	return p.StartContext(context.Background())
+}
+
+// StartContext accepts port mappings on the control listener until the
+// proxy is closed or ctx is cancelled. Cancelling ctx closes the proxy
+// like Close does, and StartContext returns nil once that is done.
+func (p *PortProxy) StartContext(ctx context.Context) error {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if err := p.Close(); err != nil {
+				p.logger.Errorf("failed to close port proxy: %s", err)
+			}
+		case <-p.quit:
+		case <-done:
+		}
+	}()
+
+	err := p.acceptEvents()
+	close(done)
+	<-stopped
+	return err
+}
+
+// Healthy reports whether the proxy is running as it should: the control
+// listener is being accepted on, and so is the listener of every published
+// port. It is false before Start, once the proxy is closed, and when an
+// accept loop stopped while it should still be running, e.g. because the
+// control listener failed. Published ports whose listener fails are
+// removed, and reported on Errors, rather than left unhealthy.
+func (p *PortProxy) Healthy() bool {
+	if !p.controlAccepting.Load() {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closing {
+		return false
+	}
+	for _, l := range p.activeListeners {
+		if listener, ok := l.(*closeNotifyListener); ok && !listener.accepting.Load() {
+			return false
+		}
+	}
+	for _, udpListener := range p.activeUDPListeners {
+		if !udpListener.serving.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready returns a channel that is closed once Start or StartContext is
+// accepting port mappings on the control listener.
+func (p *PortProxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+func (p *PortProxy) acceptEvents() error {
+	select {
+	case <-p.quit:
+		p.logger.Debug("port proxy is already closed, not accepting port mappings")
+		return nil
+	default:
+	}
+	p.mutex.Lock()
+	upstreamAddresses := strings.Join(p.upstreamAddresses, ", ")
+	p.mutex.Unlock()
+	p.logger.Infof("Proxy server started accepting on %s, forwarding to %s", p.listener.Addr(), upstreamAddresses)
+	p.controlAccepting.Store(true)
+	defer p.controlAccepting.Store(false)
+	close(p.ready)
 	for {
 		conn, err := p.listener.Accept()
 		if err != nil {
 			select {
 			case <-p.quit:
-				logrus.Debug("received a quit signal, exiting out of accept loop")
+				p.logger.Debug("received a quit signal, exiting out of accept loop")
 				return nil
 			default:
 				return fmt.Errorf("failed to accept connection: %w", err)
 			}
 		} else {
-			go p.handleEvent(conn)
+			if p.controlSemaphore != nil && !p.controlSemaphore.TryAcquire(1) {
+				p.metrics.controlConnsRejected.Add(1)
+				p.logger.Warnf("rejecting control connection from %s, too many control connections are being handled",
+					conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+			go func() {
+				if p.controlSemaphore != nil {
+					defer p.controlSemaphore.Release(1)
+				}
+				p.handleEvent(conn)
+			}()
 		}
 	}
 }
 
+// handleEvent applies the control messages read from conn, a single one
+// unless the sender keeps the connection open for more, and responds to
+// each of them.
 func (p *PortProxy) handleEvent(conn net.Conn) {
 	defer conn.Close()
+	// A connection kept open may wait for its next message past Close.
+	stop := context.AfterFunc(p.ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	var r io.Reader = conn
+	limited := &io.LimitedReader{R: conn, N: p.maxControlSize}
+	if p.maxControlSize > 0 {
+		r = limited
+	}
+	dec := json.NewDecoder(r)
+	for first := true; ; first = false {
+		if !p.handleControlMessage(conn, dec, limited, first) {
+			return
+		}
+	}
+}
+
+// handleControlMessage applies the next control message read from dec
+// and responds to it on conn, and reports whether the sender keeps the
+// connection open for another one. first is set for the first message of
+// the connection.
+func (p *PortProxy) handleControlMessage(conn net.Conn, dec *json.Decoder, limited *io.LimitedReader, first bool) bool {
+	// The size limit applies to each message.
+	limited.N = p.maxControlSize
+	reading := true
+	if !first {
+		// The sender may keep the connection idle up to the idle timeout
+		// between messages, the read timeout only starts once the next
+		// one does. Without a next message, decoding below reports why.
+		var deadline time.Time
+		if p.controlIdleTimeout > 0 {
+			deadline = time.Now().Add(p.controlIdleTimeout)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			p.logger.Debugf("port server failed to set idle deadline: %s", err)
+		}
+		reading = dec.More()
+	}
+	if reading && p.controlReadTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(p.controlReadTimeout)); err != nil {
+			p.logger.Debugf("port server failed to set read deadline: %s", err)
+		}
+	}
+
+	msg, err := decodeControlMessage(dec)
+	if err != nil && !first && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed)) {
+		p.logger.Debugf("port server closing control connection kept open: %s", err)
+		return false
+	}
+	if err != nil && p.maxControlSize > 0 && limited.N == 0 {
+		err = fmt.Errorf("control message is larger than %d bytes: %w", p.maxControlSize, err)
+	}
+	if err != nil {
+		// Only this control connection is dropped, the mappings that
+		// were already applied are left alone.
+		p.metrics.controlDecodeErrors.Add(1)
+		p.logger.Errorf("port server decoding received payload error: %s", err)
+		p.writeResponse(conn, types.PortMappingResponse{
+			Error:   fmt.Sprintf("failed to decode port mapping: %s", err),
+			Results: []types.PortBindingResult{},
+		})
+		return false
+	}
+	p.logger.Debugf("port server handling control message with protocol version %d", msg.version)
+	results := p.applyMappings(msg.portMappings)
+	response := types.PortMappingResponse{
+		Version: msg.version,
+		Success: true,
+		Results: []types.PortBindingResult{},
+	}
+	for _, result := range results {
+		response.Results = append(response.Results, result.Results...)
+		response.Removed += result.Removed
+		if !result.Success {
+			response.Success = false
+		}
+	}
+	if msg.batch {
+		response.Mappings = results
+	}
+	p.writeResponse(conn, response)
+	return msg.keepOpen
+}
+
+// writeResponse reports the outcome of a port mapping back to the sender.
+// This is best-effort since older clients close the connection as soon
+// as the port mapping is sent.
+func (p *PortProxy) writeResponse(conn net.Conn, response types.PortMappingResponse) {
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		p.logger.Debugf("port server failed to write response: %s", err)
+	}
+}
 
-	var pm types.PortMapping
-	if err := json.NewDecoder(conn).Decode(&pm); err != nil {
-		logrus.Errorf("port server decoding received payload error: %s", err)
+// execMappings applies the port mappings of a control message as a whole,
+// so that they do not interleave with other control messages. Removals,
+// along with replacements of every port, are processed before additions,
+// and the results are in the order given.
+func (p *PortProxy) execMappings(pms []types.PortMapping) []types.PortMappingResult {
+	p.mutex.Lock()
+	before := p.activePorts()
+	results := make([]types.PortMappingResult, len(pms))
+	for _, remove := range []bool{true, false} {
+		for i, pm := range pms {
+			if (pm.Remove || pm.RemoveAll || pm.ReplaceAll) == remove {
+				results[i] = p.execListener(pm)
+			}
+		}
+	}
+	after := p.activePorts()
+	p.mutex.Unlock()
+	p.notifyApplied(before, after)
+	return results
+}
+
+// notifyApplied calls the apply hook, if any, when the published ports
+// changed from before to after. It must be called without holding
+// p.mutex so that the hook can call back into the proxy.
+func (p *PortProxy) notifyApplied(before, after []nat.Port) {
+	if p.applyHook == nil {
 		return
 	}
-	p.execListener(pm)
+	applied, removed := diffPorts(before, after), diffPorts(after, before)
+	if len(applied) > 0 || len(removed) > 0 {
+		p.applyHook(applied, removed)
+	}
 }
 
-func (p *PortProxy) execListener(pm types.PortMapping) {
-	for _, portBindings := range pm.Ports {
+// diffPorts returns the ports of b that are not in a.
+func diffPorts(a, b []nat.Port) []nat.Port {
+	var diff []nat.Port
+	for _, port := range b {
+		if !slices.Contains(a, port) {
+			diff = append(diff, port)
+		}
+	}
+	return diff
+}
+
+// execListener applies a single port mapping. The caller must hold p.mutex.
+func (p *PortProxy) execListener(pm types.PortMapping) types.PortMappingResult {
+	if pm.DryRun {
+		return p.dryRun(pm)
+	}
+	if pm.RemoveAll {
+		return types.PortMappingResult{
+			Success: true,
+			Results: []types.PortBindingResult{},
+			Removed: p.removeAll(),
+		}
+	}
+	if pm.ReplaceAll {
+		return p.replaceAll(pm)
+	}
+	return newPortMappingResult(p.eachBinding(pm, func(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+		return p.execBinding(pm, containerPort, portBinding)
+	}))
+}
+
+// eachBinding calls fn for every port binding of pm, with port ranges
+// expanded, and returns the outcome of each. fn is passed the port mapping
+// and binding to apply, which for a reverse proxy are those of
+// reverseBinding, and returns the host port the binding is published on,
+// or an empty string to keep the requested one.
+func (p *PortProxy) eachBinding(pm types.PortMapping, fn func(types.PortMapping, nat.Port, nat.PortBinding) (string, error)) []types.PortBindingResult {
+	p.hostAddrs = &hostAddrs{}
+	defer func() { p.hostAddrs = nil }()
+	results := []types.PortBindingResult{}
+	for containerPort, portBindings := range pm.Ports {
 		for _, portBinding := range portBindings {
-			logrus.Debugf("received the following port: [%s] from portMapping: %+v", portBinding.HostPort, pm)
-			port, err := nat.ParsePort(portBinding.HostPort)
+			p.logger.Debugf("received the following port: [%s] from portMapping: %+v", portBinding.HostPort, pm)
+			specs, err := expandPortRange(containerPort, portBinding)
 			if err != nil {
-				logrus.Errorf("parsing port error: %s", err)
+				p.logger.Errorf("parsing port range error: %s", err)
+				results = append(results, types.PortBindingResult{
+					Port:     containerPort,
+					HostIP:   portBinding.HostIP,
+					HostPort: portBinding.HostPort,
+					Error:    err.Error(),
+				})
 				continue
 			}
-			if pm.Remove {
-				p.mutex.Lock()
-				if listener, exist := p.activeListeners[port]; exist {
-					logrus.Debugf("closing listener for port: %d", port)
-					if err := listener.Close(); err != nil {
-						logrus.Errorf("error closing listener for port [%s]: %s", portBinding.HostPort, err)
+			// Every port of a range is reported on its own, so that one
+			// port in use does not fail the others.
+			for _, spec := range specs {
+				result := types.PortBindingResult{
+					Port:     spec.port,
+					HostIP:   spec.binding.HostIP,
+					HostPort: spec.binding.HostPort,
+					Success:  true,
+				}
+				bindingPM, binding := pm, spec.binding
+				var hostPort string
+				var err error
+				if p.reverse {
+					bindingPM, binding, err = reverseBinding(pm, spec.port, spec.binding)
+				}
+				if err == nil {
+					hostPort, err = fn(bindingPM, spec.port, binding)
+				}
+				if err != nil {
+					result.Success = false
+					result.Error = err.Error()
+				} else if hostPort != "" {
+					binding.HostPort = hostPort
+					if !p.reverse {
+						// The host port of a reverse proxy is the one relayed to.
+						result.HostPort = hostPort
 					}
 				}
-				delete(p.activeListeners, port)
-				p.mutex.Unlock()
-				continue
+				if result.Success && !pm.Remove && !pm.DryRun {
+					result.ListenAddr = p.listenAddr(spec.port, binding.HostIP, binding.HostPort)
+				}
+				results = append(results, result)
 			}
-			addr := net.JoinHostPort(portBinding.HostIP, portBinding.HostPort)
-			l, err := net.Listen("tcp", addr)
+		}
+	}
+	return results
+}
+
+// listenAddr returns the address the binding of containerPort on hostIP
+// and hostPort is listened on, or an empty string when it is not. The
+// caller must hold p.mutex.
+func (p *PortProxy) listenAddr(containerPort nat.Port, hostIP, hostPort string) string {
+	proto, ok := protocols[containerPort.Proto()]
+	if !ok {
+		return ""
+	}
+	if p.bindAddress != "" {
+		hostIP = p.bindAddress
+	}
+	if addr := proto.listenAddr(p, net.JoinHostPort(hostIP, hostPort)); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// newPortMappingResult reports a port mapping as successful when all of
+// its bindings are.
+func newPortMappingResult(results []types.PortBindingResult) types.PortMappingResult {
+	success := true
+	for _, result := range results {
+		if !result.Success {
+			success = false
+		}
+	}
+	return types.PortMappingResult{Success: success, Results: results}
+}
+
+// CloseDataPlane removes every published port and closes the connections
+// relayed through them, like a control message with RemoveAll set, along
+// with the listeners inherited by NewPortProxyWithListeners that were not
+// published again. Unlike Close, the control listener keeps accepting
+// port mappings, so that the ports can be published again without
+// reconnecting.
+func (p *PortProxy) CloseDataPlane() {
+	removed := p.applyMappings([]types.PortMapping{{RemoveAll: true}})[0].Removed
+	p.mutex.Lock()
+	p.closeInheritedListeners()
+	p.mutex.Unlock()
+	p.logger.Infof("closed the data plane, %d listeners removed", removed)
+}
+
+// ReplaceAll publishes the ports of pm and removes every other published
+// port at once, like a control message with ReplaceAll set, and returns
+// the outcome.
+func (p *PortProxy) ReplaceAll(pm types.PortMapping) types.PortMappingResult {
+	pm.ReplaceAll = true
+	return p.applyMappings([]types.PortMapping{pm})[0]
+}
+
+// replaceAll removes the listeners pm does not list, then publishes the
+// ports of pm. The listeners of ports that are already published are kept
+// and only updated. The caller must hold p.mutex.
+func (p *PortProxy) replaceAll(pm types.PortMapping) types.PortMappingResult {
+	pm.Remove = false
+	stale := p.staleListeners(pm)
+	removed := 0
+	for proto, addrs := range stale {
+		for _, addr := range addrs {
+			hostIP, hostPort, err := net.SplitHostPort(addr)
 			if err != nil {
-				logrus.Errorf("failed creating listener for published port [%s]: %s", portBinding.HostPort, err)
 				continue
 			}
-			p.mutex.Lock()
-			p.activeListeners[port] = l
-			p.mutex.Unlock()
-			logrus.Debugf("created listener for: %s", addr)
-			go p.acceptTraffic(l, portBinding.HostPort)
+			p.logger.Debugf("removing %s listener for %s, it is not in the replacing port mapping", proto, addr)
+			remove := types.PortMapping{Remove: true}
+			if _, err := protocols[proto].exec(p, remove, addr, nat.PortBinding{HostIP: hostIP, HostPort: hostPort}, ""); err != nil {
+				p.logger.Errorf("error removing %s listener for %s: %s", proto, addr, err)
+				continue
+			}
+			removed++
+		}
+	}
+	result := newPortMappingResult(p.eachBinding(pm, func(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+		return p.execBinding(pm, containerPort, portBinding)
+	}))
+	result.Removed = removed
+	return result
+}
+
+// staleListeners returns the addresses listened on that pm does not list,
+// by protocol. The caller must hold p.mutex.
+func (p *PortProxy) staleListeners(pm types.PortMapping) map[string][]string {
+	desired := map[string]struct{}{}
+	listed := pm
+	listed.Remove = true
+	p.eachBinding(listed, func(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+		// Removals only work out the address the binding is listened on.
+		addr, err := p.checkBinding(pm, containerPort, portBinding)
+		if err == nil {
+			desired[containerPort.Proto()+" "+addr] = struct{}{}
+		}
+		return "", err
+	})
+	stale := map[string][]string{}
+	for name, proto := range protocols {
+		for _, addr := range proto.listening(p) {
+			if _, ok := desired[name+" "+addr]; !ok {
+				stale[name] = append(stale[name], addr)
+			}
+		}
+	}
+	return stale
+}
+
+// removeAll closes every listener along with the connections relayed
+// through them, and returns how many listeners there were. The caller
+// must hold p.mutex.
+func (p *PortProxy) removeAll() int {
+	removed := len(p.activeListeners) + len(p.activeUDPListeners)
+	p.logger.Debugf("removing all %d listeners", removed)
+	for addr, listener := range p.activeListeners {
+		if err := listener.Close(); err != nil {
+			p.logger.Errorf("error closing listener for %s: %s", addr, err)
+		}
+	}
+	// Closing a UDP listener also closes its sessions.
+	for addr, udpListener := range p.activeUDPListeners {
+		if err := udpListener.Close(); err != nil {
+			p.logger.Errorf("error closing UDP listener for %s: %s", addr, err)
+		}
+	}
+	for conn := range p.activeConns {
+		_ = conn.Close()
+	}
+	clear(p.activeListeners)
+	clear(p.activeUDPListeners)
+	p.countMappings()
+	clear(p.bandwidthLimits)
+	clear(p.upstreamTargets)
+	clear(p.allowedSources)
+	clear(p.mappingNames)
+	for port := range p.pausedPorts {
+		p.resume(port)
+	}
+	return removed
+}
+
+// execBinding applies a single port binding and returns the host port it
+// is published on. The caller must hold p.mutex. It is released while
+// waiting to retry a host IP that is not available yet, but every attempt
+// looks up the listeners anew under it, so an identical binding applied
+// meanwhile is taken over rather than published twice.
+//
+// The HostIP of the binding selects the host addresses the port is
+// published on: 0.0.0.0 is every IPv4 address and :: every IPv6 address,
+// an empty HostIP is every address of both families, and any other IP is
+// only that address. A HostPort of 0, or an empty one as with Docker,
+// publishes the port on a host port picked by the system, and relays it to
+// the container port number on the upstream. The UpstreamPort of the port
+// mapping overrides the port relayed to.
+func (p *PortProxy) execBinding(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+	var hostPort string
+	err := p.retryUnavailable(portBinding.HostPort, func() error {
+		addr, err := p.checkBinding(pm, containerPort, portBinding)
+		if err != nil {
+			p.logger.Errorf("invalid port binding: %s", err)
+			return err
+		}
+		listened := portBinding
+		if p.bindAddress != "" {
+			listened.HostIP = p.bindAddress
+		}
+		// The protocol was looked up by checkBinding.
+		proto := protocols[containerPort.Proto()]
+		hostPort, err = proto.exec(p, pm, addr, listened, relayedPort(pm, containerPort, listened))
+		return err
+	})
+	return hostPort, err
+}
+
+// execTCPListener applies a single TCP port binding, relayed to
+// upstreamPort unless the port mapping has a target, and returns the host
+// port it is published on. The caller must hold p.mutex.
+func (p *PortProxy) execTCPListener(pm types.PortMapping, addr string, portBinding nat.PortBinding, upstreamPort string) (string, error) {
+	if pm.Remove {
+		if listener, exist := p.activeListeners[addr]; exist {
+			p.logger.Debugf("closing listener for: %s", addr)
+			if err := listener.Close(); err != nil {
+				p.logger.Errorf("error closing listener for port [%s]: %s", portBinding.HostPort, err)
+			}
+		}
+		delete(p.activeListeners, addr)
+		p.countMappings()
+		delete(p.bandwidthLimits, addr)
+		delete(p.upstreamTargets, addr)
+		delete(p.allowedSources, addr)
+		delete(p.mappingNames, addr)
+		p.resumeIfUnpublished(portBinding.HostPort)
+		if pm.Drain {
+			p.drainConns(addr, drainTimeout(pm))
+		} else if p.closeOnRemove {
+			p.closeConns(addr)
+		}
+		return portBinding.HostPort, nil
+	}
+	target, err := parseTarget(pm.Target, p.upstreamAddresses, upstreamPort)
+	if err != nil {
+		p.logger.Errorf("parsing target error: %s", err)
+		return "", err
+	}
+	allowlist, err := parseAllowedSources(pm.AllowedSources)
+	if err != nil {
+		p.logger.Errorf("parsing allowed sources error: %s", err)
+		return "", err
+	}
+	limit := newBandwidthLimit(pm.RateBytesPerSec)
+	if _, exist := p.activeListeners[addr]; exist {
+		// Keep the listener so that relayed connections are not
+		// disturbed, only the bandwidth limit, target, allowed sources
+		// and name can change.
+		p.setBandwidthLimit(addr, limit)
+		p.upstreamTargets[addr] = target
+		p.allowedSources[addr] = allowlist
+		p.setMappingName(addr, pm.Name)
+		p.logger.Debugf("listener already exists for: %s", addr)
+		return portBinding.HostPort, nil
+	}
+	var l net.Listener
+	if inherited := p.takeInheritedListener(portBinding.HostIP, portBinding.HostPort); inherited != nil {
+		p.logger.Debugf("taking over inherited listener for: %s", addr)
+		l = inherited
+	} else if l, err = p.portListenConfig("tcp").Listen(p.ctx, networkForIP("tcp", portBinding.HostIP), addr); err != nil {
+		err = bindError(err, portBinding.HostPort)
+		reason := p.metrics.bindFailed(err)
+		p.logger.WithFields(logrus.Fields{"port": portBinding.HostPort, "reason": reason}).
+			Warnf("failed creating listener for published port [%s]: %s", portBinding.HostPort, err)
+		return "", err
+	}
+	tcpListener, _ := l.(*net.TCPListener)
+	if isEphemeralPort(portBinding.HostPort) {
+		addr, portBinding.HostPort = assignedAddr(portBinding.HostIP, l.Addr())
+	}
+	if p.listenBacklog > 0 {
+		if err := setListenBacklog(l, p.listenBacklog); err != nil {
+			p.logger.Warnf("failed to set the listen backlog of published port [%s]: %s", portBinding.HostPort, err)
+		}
+	}
+	if config, ok := p.tlsConfigs[portBinding.HostPort]; ok {
+		l = tls.NewListener(l, config)
+	}
+	listener := newCloseNotifyListener(l)
+	listener.tcp = tcpListener
+	p.activeListeners[addr] = listener
+	p.countMappings()
+	p.setBandwidthLimit(addr, limit)
+	p.upstreamTargets[addr] = target
+	p.allowedSources[addr] = allowlist
+	p.setMappingName(addr, pm.Name)
+	p.logger.Debugf("created listener for: %s", addr)
+	listener.accepting.Store(true)
+	go pprof.Do(p.ctx, pprof.Labels(labelPort, portBinding.HostPort), func(ctx context.Context) {
+		p.acceptTraffic(ctx, listener, addr, portBinding.HostPort)
+	})
+	return portBinding.HostPort, nil
+}
+
+// drainConns closes the connections accepted on the listener for addr
+// that are still relayed once timeout is over. The caller must hold
+// p.mutex.
+func (p *PortProxy) drainConns(addr string, timeout time.Duration) {
+	var conns []net.Conn
+	for conn, active := range p.activeConns {
+		if active.addr == addr {
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		return
+	}
+	p.logger.Debugf("draining %d connections of %s for %s", len(conns), addr, timeout)
+	time.AfterFunc(timeout, func() {
+		p.mutex.Lock()
+		closed := 0
+		for _, conn := range conns {
+			if _, ok := p.activeConns[conn]; ok {
+				_ = conn.Close()
+				closed++
+			}
 		}
+		p.mutex.Unlock()
+		if closed > 0 {
+			p.logger.Infof("closed %d connections of %s that did not drain within %s", closed, addr, timeout)
+		}
+	})
+}
+
+// closeConns closes the connections accepted on the listener for addr.
+// The caller must hold p.mutex.
+func (p *PortProxy) closeConns(addr string) {
+	closed := 0
+	for conn, active := range p.activeConns {
+		if active.addr == addr {
+			_ = conn.Close()
+			closed++
+		}
+	}
+	if closed > 0 {
+		p.logger.Debugf("closed %d connections of removed %s", closed, addr)
+	}
+}
+
+// drainTimeout returns how long the connections of the ports pm removes
+// are given to finish.
+func drainTimeout(pm types.PortMapping) time.Duration {
+	if pm.DrainTimeoutSeconds > 0 {
+		return time.Duration(pm.DrainTimeoutSeconds) * time.Second
+	}
+	return defaultCloseGracePeriod
+}
+
+// setMappingName records the name of the port mapping a TCP listener was
+// published for, if any. The caller must hold p.mutex.
+func (p *PortProxy) setMappingName(addr, name string) {
+	if name == "" {
+		delete(p.mappingNames, addr)
+		return
+	}
+	p.mappingNames[addr] = name
+}
+
+// noDelayFor returns whether TCP_NODELAY is set on the connections
+// relayed through the host port.
+func (p *PortProxy) noDelayFor(port string) bool {
+	if noDelay, ok := p.noDelayPorts[port]; ok {
+		return noDelay
+	}
+	return p.noDelay
+}
+
+// relayedPort returns the port a binding is relayed to on the upstream
+// addresses: the upstream port of the port mapping when it is set, else
+// the host port, or the container port when the system picks the host
+// port.
+func relayedPort(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) string {
+	switch {
+	case pm.UpstreamPort != 0:
+		return strconv.Itoa(pm.UpstreamPort)
+	case isEphemeralPort(portBinding.HostPort):
+		return containerPort.Port()
 	}
+	return portBinding.HostPort
 }
 
-func (p *PortProxy) acceptTraffic(listener net.Listener, port string) {
-	forwardAddr := net.JoinHostPort(p.upstreamAddress, port)
+// isEphemeralPort reports whether hostPort lets the system pick the port,
+// which an empty one does too since it listens on port 0.
+func isEphemeralPort(hostPort string) bool {
+	return hostPort == "0" || hostPort == ""
+}
+
+// assignedAddr returns the listen address and the host port of a listener
+// that was bound to a port picked by the system.
+func assignedAddr(hostIP string, listenAddr net.Addr) (string, string) {
+	var port int
+	switch a := listenAddr.(type) {
+	case *net.TCPAddr:
+		port = a.Port
+	case *net.UDPAddr:
+		port = a.Port
+	}
+	hostPort := strconv.Itoa(port)
+	return net.JoinHostPort(hostIP, hostPort), hostPort
+}
+
+// setBandwidthLimit applies the limit to connections accepted on addr from
+// now on; a nil limit removes it. The caller must hold p.mutex.
+func (p *PortProxy) setBandwidthLimit(addr string, limit *bandwidthLimit) {
+	if limit == nil {
+		delete(p.bandwidthLimits, addr)
+		return
+	}
+	p.bandwidthLimits[addr] = limit
+}
+
+// execUDPListener applies a single UDP port binding, relayed to
+// upstreamPort, and returns the host port it is published on. The caller
+// must hold p.mutex.
+func (p *PortProxy) execUDPListener(pm types.PortMapping, addr string, portBinding nat.PortBinding, upstreamPort string) (string, error) {
+	if pm.Remove {
+		if udpListener, exist := p.activeUDPListeners[addr]; exist {
+			p.logger.Debugf("closing UDP listener for: %s", addr)
+			if err := udpListener.Close(); err != nil {
+				p.logger.Errorf("error closing UDP listener for port [%s]: %s", portBinding.HostPort, err)
+			}
+		}
+		delete(p.activeUDPListeners, addr)
+		p.countMappings()
+		return portBinding.HostPort, nil
+	}
+	if p.closing {
+		return "", errClosing
+	}
+	if _, exist := p.activeUDPListeners[addr]; exist {
+		p.logger.Debugf("UDP listener already exists for: %s", addr)
+		return portBinding.HostPort, nil
+	}
+	conn, err := p.portListenConfig("udp").ListenPacket(p.ctx, networkForIP("udp", portBinding.HostIP), addr)
+	if err != nil {
+		err = bindError(err, portBinding.HostPort)
+		reason := p.metrics.bindFailed(err)
+		p.logger.WithFields(logrus.Fields{"port": portBinding.HostPort, "reason": reason}).
+			Warnf("failed creating UDP listener for published port [%s]: %s", portBinding.HostPort, err)
+		return "", err
+	}
+	if isEphemeralPort(portBinding.HostPort) {
+		addr, portBinding.HostPort = assignedAddr(portBinding.HostIP, conn.LocalAddr())
+	}
+	// There is no handshake to tell a dead UDP upstream apart, so only the
+	// first upstream address is used.
+	upstreamAddr := net.JoinHostPort(p.upstreamAddresses[0], upstreamPort)
+	logger := p.logger.WithField("port", portBinding.HostPort)
+	if pm.Name != "" {
+		logger = logger.WithField("name", pm.Name)
+	}
+	udpListener := newUDPProxy(conn, p.dialer, upstreamAddr, p.udpSessionTimeout, &p.metrics, logger)
+	p.activeUDPListeners[addr] = udpListener
+	p.countMappings()
+	p.logger.Debugf("created UDP listener for: %s", addr)
+	udpListener.serving.Store(true)
+	go pprof.Do(p.ctx, pprof.Labels(labelPort, portBinding.HostPort, labelDirection, directionToUpstream), udpListener.serve)
+	return portBinding.HostPort, nil
+}
+
+// acceptTraffic accepts the connections to a published port and relays
+// them. ctx derives from p.ctx and carries the pprof labels of the port.
+func (p *PortProxy) acceptTraffic(ctx context.Context, listener *closeNotifyListener, addr, port string) {
+	defer listener.accepting.Store(false)
+	logger := p.logger.WithField("port", port)
+	// Holds a slot for each connection being relayed when limited.
+	var slots chan struct{}
+	if p.maxConnsPerPort > 0 {
+		slots = make(chan struct{}, p.maxConnsPerPort)
+	}
+	var acceptLimiter *rate.Limiter
+	if p.acceptRate > 0 {
+		acceptLimiter = rate.NewLimiter(rate.Limit(p.acceptRate), p.acceptBurst)
+	}
+	var acceptDelay time.Duration
+	// number of accept errors in a row
+	var acceptFailures int
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -121,41 +1092,575 @@ func (p *PortProxy) acceptTraffic(listener net.Listener, port string) {
 			if errors.Is(err, net.ErrClosed) {
 				break
 			}
-			logrus.Errorf("port proxy listener failed to accept: %s", err)
+			if !isTemporaryAcceptError(err) {
+				logger.Errorf("port proxy listener stopped, unpublishing port [%s]: %s", port, err)
+				p.dropListener(addr, port, listener)
+				p.publishError(&ListenerError{Port: port, Addr: addr, Fatal: true, Err: err})
+				break
+			}
+			acceptDelay = min(max(2*acceptDelay, minAcceptDelay), maxAcceptDelay)
+			acceptFailures++
+			// Only the first error of a burst is worth a warning, e.g. the
+			// process running out of file descriptors fails every accept
+			// until some are closed.
+			if acceptFailures == 1 {
+				logger.Warnf("port proxy listener failed to accept, backing off: %s", err)
+			} else {
+				logger.Debugf("port proxy listener failed to accept, retrying in %s: %s", acceptDelay, err)
+			}
+			p.publishError(&ListenerError{Port: port, Addr: addr, Err: err})
+			timer := time.NewTimer(acceptDelay)
+			select {
+			case <-timer.C:
+			case <-listener.done:
+				timer.Stop()
+			}
+			continue
+		}
+		if acceptFailures > 0 {
+			logger.Infof("port proxy listener accepting again after %d failures", acceptFailures)
+		}
+		acceptDelay, acceptFailures = 0, 0
+		// The loop may already have been waiting in Accept when the port
+		// was paused; hold the connection until the port is resumed.
+		if !p.waitResumed(listener, port) {
+			_ = conn.Close()
+			break
+		}
+		p.mutex.Lock()
+		allowlist := p.allowedSources[addr]
+		name := p.mappingNames[addr]
+		p.mutex.Unlock()
+		clientLogger := logger.WithField("client", conn.RemoteAddr().String())
+		if name != "" {
+			clientLogger = clientLogger.WithField("name", name)
+		}
+		clientLogger.Debugf("port proxy accepted connection")
+		if !allowlist.allows(conn.RemoteAddr()) {
+			p.metrics.connsDenied.Add(1)
+			clientLogger.Warnf("rejecting connection, the client is not allowed on port [%s]", port)
+			_ = conn.Close()
+			continue
+		}
+		if acceptLimiter != nil && !acceptLimiter.Allow() {
+			p.metrics.rateLimitRejections.Add(1)
+			clientLogger.Warnf("rejecting connection, port [%s] is over its rate of %d connections per second",
+				port, p.acceptRate)
+			_ = conn.Close()
+			continue
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				p.metrics.portLimitRejections.Add(1)
+				clientLogger.Warnf("rejecting connection, port [%s] is at its limit of %d connections",
+					port, p.maxConnsPerPort)
+				_ = conn.Close()
+				continue
+			}
+		}
+		// Connections are rejected rather than parked on the semaphore,
+		// so there is nothing for Close to unblock.
+		if p.connsSemaphore != nil && !p.connsSemaphore.TryAcquire(1) {
+			if slots != nil {
+				<-slots
+			}
+			p.metrics.globalLimitRejections.Add(1)
+			clientLogger.Warnf("rejecting connection on port [%s], the proxy is at its connection limit", port)
+			_ = conn.Close()
 			continue
 		}
-		logrus.Debugf("port proxy accepted connection from %s", conn.RemoteAddr())
+		// Adding to p.wg must not race with Close waiting on it, so it
+		// is only done under p.mutex and until Close starts. A connection
+		// accepted right before the port was removed has no target left
+		// to be relayed to.
+		p.mutex.Lock()
+		if p.closing || p.activeListeners[addr] != listener {
+			p.mutex.Unlock()
+			if slots != nil {
+				<-slots
+			}
+			if p.connsSemaphore != nil {
+				p.connsSemaphore.Release(1)
+			}
+			_ = conn.Close()
+			break
+		}
 		p.wg.Add(1)
+		limit := p.bandwidthLimits[addr]
+		target := p.upstreamTargets[addr]
+		p.activeConns[conn] = activeConn{port: port, addr: addr, target: target}
+		p.metrics.activeConns.Add(1)
+		p.mutex.Unlock()
+		connLogger := clientLogger.WithField("upstream", target.String())
 
 		go func(conn net.Conn) {
 			defer p.wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			if p.connsSemaphore != nil {
+				defer p.connsSemaphore.Release(1)
+			}
+			defer func() {
+				p.mutex.Lock()
+				defer p.mutex.Unlock()
+				switch {
+				case p.activeConns[conn].forceClosed:
+					p.metrics.connsForceClosed.Add(1)
+				case p.closing:
+					p.metrics.connsDrained.Add(1)
+				}
+				delete(p.activeConns, conn)
+				p.metrics.activeConns.Add(-1)
+			}()
 			defer conn.Close()
-			utils.Pipe(conn, forwardAddr)
+			start := time.Now()
+			event := ConnEvent{
+				Type:     ConnOpened,
+				Port:     port,
+				Name:     name,
+				Client:   conn.RemoteAddr().String(),
+				Upstream: target.String(),
+			}
+			p.emitConnEvent(event)
+			p.logAccess(connLogger, event, start)
+			ctx, span := p.startSpan(ctx, connectionSpanName)
+			if span != nil {
+				span.SetAttributes(
+					Attribute{Key: "portproxy.port", Value: port},
+					Attribute{Key: "portproxy.client", Value: event.Client},
+					Attribute{Key: "portproxy.upstream", Value: event.Upstream},
+				)
+				if name != "" {
+					span.SetAttributes(Attribute{Key: "portproxy.name", Value: name})
+				}
+			}
+			progress := p.startProgress(event)
+			event.Type = ConnClosed
+			event.BytesIn, event.BytesOut, event.Err = p.handleConnection(ctx, connLogger, conn, port, target, limit, progress)
+			progress.stop()
+			_ = conn.Close()
+			if span != nil {
+				span.SetAttributes(
+					Attribute{Key: "portproxy.bytes_in", Value: event.BytesIn},
+					Attribute{Key: "portproxy.bytes_out", Value: event.BytesOut},
+				)
+				span.End(event.Err)
+			}
+			p.emitConnEvent(event)
+			p.logAccess(connLogger, event, start)
 		}(conn)
 	}
 }
 
+// dropListener forgets about the listener for addr after it failed,
+// unless it was replaced in the meantime.
+func (p *PortProxy) dropListener(addr, port string, listener net.Listener) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_ = listener.Close()
+	if p.activeListeners[addr] != listener {
+		return
+	}
+	delete(p.activeListeners, addr)
+	p.countMappings()
+	delete(p.bandwidthLimits, addr)
+	delete(p.upstreamTargets, addr)
+	delete(p.allowedSources, addr)
+	delete(p.mappingNames, addr)
+	p.resumeIfUnpublished(port)
+}
+
+// Errors returns a channel on which the proxy reports listeners of
+// published ports that fail, as *ListenerError. Errors are dropped when
+// the channel is full, so callers do not have to consume it. The channel
+// is never closed.
+func (p *PortProxy) Errors() <-chan error {
+	return p.errs
+}
+
+func (p *PortProxy) publishError(err error) {
+	select {
+	case p.errs <- err:
+	default:
+		p.logger.Debugf("dropping error, the errors channel is full: %s", err)
+	}
+}
+
+// handleConnection relays conn, accepted on the published host port, to
+// the upstream and returns the number of bytes relayed to the upstream and
+// back to the client. ctx carries the span of the connection, if any, and
+// progress, when not nil, counts the bytes as they are relayed.
+func (p *PortProxy) handleConnection(ctx context.Context, logger *logrus.Entry, conn net.Conn, port string, target upstreamTarget, limit *bandwidthLimit, progress *connProgress) (int64, int64, error) {
+	if p.connFilter != nil {
+		if err := p.connFilter(conn.RemoteAddr(), nat.Port(port+"/tcp")); err != nil {
+			p.metrics.connsFiltered.Add(1)
+			logger.Warnf("rejecting connection on port [%s]: %s", port, err)
+			return 0, 0, fmt.Errorf("%w: %w", ErrConnectionFiltered, err)
+		}
+	}
+	if err := p.handshake(conn); err != nil {
+		logger.Debugf("dropping client connection: %s", err)
+		return 0, 0, err
+	}
+	p.startDialing(logger)
+	upstream, err := p.dialUpstream(ctx, logger, target)
+	p.endDialing()
+	if err != nil {
+		p.metrics.upstreamDialErrors.Add(1)
+		if isDialTimeout(err) {
+			p.metrics.upstreamDialTimeouts.Add(1)
+		}
+		logger.Warnf("Failed to dial upstream %s: %s", target, err)
+		if p.resetOnDialFailure {
+			if err := resetOnClose(conn); err != nil {
+				logger.Debugf("failed to reset client connection: %s", err)
+			}
+		}
+		return 0, 0, fmt.Errorf("%w %s: %w", ErrUpstreamDial, target, err)
+	}
+	if p.keepAlivePeriod > 0 {
+		for _, c := range []net.Conn{conn, upstream} {
+			if err := setKeepAlive(c, p.keepAlivePeriod); err != nil {
+				logger.Debugf("failed to set keep-alive on connection to %s: %s", c.RemoteAddr(), err)
+			}
+		}
+	}
+	if p.linger >= 0 {
+		for _, c := range []net.Conn{conn, upstream} {
+			if err := setLinger(c, p.linger); err != nil {
+				logger.Debugf("failed to set linger on connection to %s: %s", c.RemoteAddr(), err)
+			}
+		}
+	}
+	for _, c := range []net.Conn{conn, upstream} {
+		if err := setNoDelay(c, p.noDelayFor(port)); err != nil {
+			logger.Debugf("failed to set TCP_NODELAY on connection to %s: %s", c.RemoteAddr(), err)
+		}
+	}
+	if p.proxyProtocolVersion != 0 {
+		err := writeProxyHeader(upstream, p.proxyProtocolVersion, conn.RemoteAddr(), conn.LocalAddr())
+		if err != nil {
+			logger.Errorf("failed to write PROXY protocol header to upstream %s: %s", target, err)
+			_ = upstream.Close()
+			return 0, 0, fmt.Errorf("failed to write PROXY protocol header: %w", err)
+		}
+	}
+	// Bytes read from the client before relaying.
+	var sniffed int64
+	if _, ok := p.forwardedForPorts[port]; ok {
+		conn, sniffed, err = forwardFor(conn, upstream)
+		if err != nil {
+			logger.Debugf("failed to forward the client address to upstream %s: %s", target, err)
+			_ = upstream.Close()
+			return 0, 0, fmt.Errorf("failed to forward the client address: %w", err)
+		}
+	}
+	var deadline time.Time
+	if p.maxConnLifetime > 0 {
+		deadline = time.Now().Add(p.maxConnLifetime)
+		for _, c := range []net.Conn{conn, upstream} {
+			if err := c.SetDeadline(deadline); err != nil {
+				logger.Debugf("failed to set deadline on connection to %s: %s", c.RemoteAddr(), err)
+			}
+		}
+	}
+	if p.writeTimeout > 0 {
+		conn = newWriteTimeoutConn(conn, p.writeTimeout, deadline)
+		upstream = newWriteTimeoutConn(upstream, p.writeTimeout, deadline)
+	}
+	if p.idleTimeout > 0 {
+		idle := newIdleTimeout(logger, p.idleTimeout, conn, upstream)
+		defer idle.stop()
+		conn, upstream = idle.wrap(conn), idle.wrap(upstream)
+	}
+	if limit != nil {
+		conn, upstream = limit.wrap(p.ctx, conn, upstream)
+	}
+	if progress != nil {
+		progress.toUpstream.Add(sniffed)
+		conn, upstream = progress.wrap(conn, upstream)
+	}
+	pool := p.bufferPool
+	if p.splice && spliceable(conn, upstream) {
+		logger.Debugf("relaying with splice")
+		pool = nil
+	}
+	toUpstream, toClient, err := relay(ctx, logger, conn, upstream, pool, halfCloseTimeout)
+	toUpstream += sniffed
+	p.metrics.bytesToUpstream.Add(uint64(toUpstream))
+	p.metrics.bytesToClient.Add(uint64(toClient))
+	if err != nil {
+		p.metrics.relayErrors.Add(1)
+		if errors.Is(err, ErrSlowConsumer) {
+			p.metrics.slowConsumers.Add(1)
+			logger.Warnf("closing relay: %s", err)
+		}
+		logger.Debugf("relay interrupted: %s", err)
+	}
+	return toUpstream, toClient, err
+}
+
+// resetOnClose makes closing a TCP connection send an RST instead of a
+// FIN, which clients report as the connection being reset or refused.
+func resetOnClose(conn net.Conn) error {
+	if tcpConn, ok := netConn(conn).(*net.TCPConn); ok {
+		return tcpConn.SetLinger(0)
+	}
+	return nil
+}
+
+// emitConnEvent passes event to the connection hook, if any. It must be
+// called without holding p.mutex so that the hook can call back into
+// the proxy.
+func (p *PortProxy) emitConnEvent(event ConnEvent) {
+	if p.connHook != nil {
+		p.connHook(event)
+	}
+}
+
+// logAccess writes event to the access log, if any.
+func (p *PortProxy) logAccess(logger *logrus.Entry, event ConnEvent, start time.Time) {
+	if p.accessLog == nil {
+		return
+	}
+	if err := p.accessLog.log(event, start); err != nil {
+		logger.Debugf("failed to write access log: %s", err)
+	}
+}
+
+// ActivePorts returns the published ports the proxy currently has a
+// listener for, sorted by port number and then protocol. A port bound
+// on several host IPs is only listed once.
+func (p *PortProxy) ActivePorts() []nat.Port {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.activePorts()
+}
+
+// activePorts returns the ports ActivePorts does. The caller must hold
+// p.mutex.
+func (p *PortProxy) activePorts() []nat.Port {
+	seen := make(map[nat.Port]struct{})
+	add := func(proto, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return
+		}
+		seen[nat.Port(port+"/"+proto)] = struct{}{}
+	}
+	for name, proto := range protocols {
+		for _, addr := range proto.listening(p) {
+			add(name, addr)
+		}
+	}
+
+	ports := make([]nat.Port, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Int() != ports[j].Int() {
+			return ports[i].Int() < ports[j].Int()
+		}
+		return ports[i].Proto() < ports[j].Proto()
+	})
+	return ports
+}
+
+// ConnectionsByPort returns the remote addresses of the client connections
+// each published TCP port is relaying, e.g. to tell who holds on to a port
+// that seems hung. Published TCP ports without connections are listed with
+// no addresses. The result is a snapshot that the proxy does not change
+// afterwards.
+func (p *PortProxy) ConnectionsByPort() map[nat.Port][]net.Addr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := make(map[nat.Port][]net.Addr)
+	for _, port := range p.activePorts() {
+		if port.Proto() == "tcp" {
+			conns[port] = nil
+		}
+	}
+	for conn, active := range p.activeConns {
+		port := nat.Port(active.port + "/tcp")
+		conns[port] = append(conns[port], conn.RemoteAddr())
+	}
+	for _, addrs := range conns {
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i].String() < addrs[j].String()
+		})
+	}
+	return conns
+}
+
+// networkForIP returns the network for the given protocol restricted to
+// the address family of ip, e.g. tcp6 for an IPv6 address. This keeps an
+// IPv6 wildcard listener from also claiming the IPv4 side of the port.
+// The protocol is returned unchanged when ip is empty or not a literal.
+func networkForIP(proto, ip string) string {
+	parsedIP := net.ParseIP(ip)
+	switch {
+	case parsedIP == nil:
+		return proto
+	case parsedIP.To4() != nil:
+		return proto + "4"
+	default:
+		return proto + "6"
+	}
+}
+
+// Close shuts the proxy down, giving relayed connections that are still
+// in flight a short grace period to finish before they are force closed.
 func (p *PortProxy) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseGracePeriod)
+	defer cancel()
+	return p.CloseWithTimeout(ctx)
+}
+
+// CloseWithTimeout stops accepting control messages and new connections
+// on the published ports, then waits for the relayed connections to
+// drain. Connections still open when ctx is done are force closed.
+// Only the first call closes the proxy, later ones wait for it to be
+// closed and return nil.
+func (p *PortProxy) CloseWithTimeout(ctx context.Context) error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.close(ctx)
+	})
+	return err
+}
+
+func (p *PortProxy) close(ctx context.Context) error {
 	// Close all the active listeners
 	p.cleanupListeners()
 
-	// Close the listener first to prevent new connections.
+	// Signal the quit channel first so the accept loop knows that the
+	// error from the closed listener is expected.
+	close(p.quit)
+
+	// Close the listener to prevent new connections.
 	err := p.listener.Close()
 	if err != nil {
 		return err
 	}
 
-	// Signal the quit channel to stop accepting new connections.
-	close(p.quit)
-
 	// Wait for all pending connections to finish.
-	p.wg.Wait()
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		p.logger.Warnf("force closing connections that did not drain in time: %s", ctx.Err())
+		p.cancel()
+		p.closeConnections()
+		<-drained
+	}
+	p.cancel()
+	p.logger.Infof("port proxy closed, %d connections drained and %d force closed",
+		p.metrics.connsDrained.Load(), p.metrics.connsForceClosed.Load())
 
 	return nil
 }
 
+// UpdateUpstream makes the proxy relay to ip from now on, e.g. after the VM
+// got a new address, replacing all of the upstream addresses. Ports relayed
+// to a unix socket are not affected.
+// Connections being relayed to the previous address are left alone, unless
+// drain is set, in which case they are closed so that clients reconnect.
+func (p *PortProxy) UpdateUpstream(ip string, drain bool) error {
+	ip = strings.Trim(ip, "[]")
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid upstream address %q", ip)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.logger.Infof("port proxy upstream changed from %s to %s", strings.Join(p.upstreamAddresses, ", "), ip)
+	p.upstreamAddresses = []string{ip}
+	for addr, target := range p.upstreamTargets {
+		if target.network != "tcp" {
+			continue
+		}
+		// The upstream port differs from the host port of ports
+		// published on a port picked by the system.
+		_, port, err := net.SplitHostPort(target.addresses[0])
+		if err != nil {
+			continue
+		}
+		p.upstreamTargets[addr], _ = parseTarget("", p.upstreamAddresses, port)
+	}
+	for _, udpListener := range p.activeUDPListeners {
+		_, port, err := net.SplitHostPort(udpListener.upstream())
+		if err != nil {
+			continue
+		}
+		udpListener.setUpstream(net.JoinHostPort(ip, port), drain)
+	}
+	if drain {
+		for conn, active := range p.activeConns {
+			if active.target.network == "tcp" {
+				_ = conn.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// Upstream returns the address the proxy currently relays to, as set by
+// NewPortProxy or the last UpdateUpstream. When WithUpstreamAddresses added
+// more addresses, they are all returned, separated by commas, in the order
+// they are dialed.
+func (p *PortProxy) Upstream() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return strings.Join(p.upstreamAddresses, ", ")
+}
+
+// closeConnections closes every relayed client connection, which in turn
+// tears down the matching upstream connection, and flags them as force
+// closed.
+func (p *PortProxy) closeConnections() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for conn, active := range p.activeConns {
+		_ = conn.Close()
+		active.forceClosed = true
+		p.activeConns[conn] = active
+	}
+}
+
 func (p *PortProxy) cleanupListeners() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closing = true
+	listeners := make([]io.Closer, 0, len(p.activeListeners)+len(p.activeUDPListeners))
 	for _, l := range p.activeListeners {
-		_ = l.Close()
+		listeners = append(listeners, l)
+	}
+	for _, l := range p.activeUDPListeners {
+		listeners = append(listeners, l)
+	}
+	closeAll(listeners)
+	p.closeInheritedListeners()
+}
+
+// closeAll closes closers concurrently, at most maxParallelClose at a time,
+// and returns once all of them are closed. With hundreds of published ports,
+// closing them one after the other noticeably slows down shutdown.
+func closeAll(closers []io.Closer) {
+	var g errgroup.Group
+	g.SetLimit(maxParallelClose)
+	for _, c := range closers {
+		g.Go(func() error {
+			_ = c.Close()
+			return nil
+		})
 	}
+	_ = g.Wait()
 }
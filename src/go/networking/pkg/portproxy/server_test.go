@@ -22,13 +22,22 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/nettest"
 )
@@ -61,8 +70,10 @@ func TestNewPortProxy(t *testing.T) {
 	require.NoError(t, err)
 	defer localListener.Close()
 
-	portProxy := portproxy.NewPortProxy(localListener, testServerIP)
+	portProxy, err := portproxy.NewPortProxy(localListener, testServerIP)
+	require.NoError(t, err)
 	go portProxy.Start()
+	<-portProxy.Ready()
 
 	getURL := fmt.Sprintf("http://localhost:%s", testPort)
 	resp, err := httpGetRequest(context.Background(), getURL)
@@ -79,7 +90,7 @@ func TestNewPortProxy(t *testing.T) {
 		Ports: nat.PortMap{
 			port: []nat.PortBinding{
 				{
-					HostIP:   testServerIP,
+					HostIP:   "127.0.0.1",
 					HostPort: testPort,
 				},
 			},
@@ -101,7 +112,7 @@ func TestNewPortProxy(t *testing.T) {
 		Ports: nat.PortMap{
 			port: []nat.PortBinding{
 				{
-					HostIP:   testServerIP,
+					HostIP:   "127.0.0.1",
 					HostPort: testPort,
 				},
 			},
@@ -121,36 +132,2061 @@ func TestNewPortProxy(t *testing.T) {
 	portProxy.Close()
 }
 
-func httpGetRequest(ctx context.Context, url string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
+func TestNewPortProxyUpstreamAddress(t *testing.T) {
+	tests := []struct {
+		upstreamAddr string
+		valid        bool
+	}{
+		{upstreamAddr: "192.0.2.1", valid: true},
+		{upstreamAddr: "fd00::1", valid: true},
+		{upstreamAddr: "[fd00::1]", valid: true},
+		{upstreamAddr: ""},
+		{upstreamAddr: "192.0.2.300"},
+		{upstreamAddr: "192.0.2.1:80"},
+		{upstreamAddr: "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstreamAddr, func(t *testing.T) {
+			portProxy, err := portproxy.NewPortProxy(nil, tt.upstreamAddr)
+			if !tt.valid {
+				require.ErrorContains(t, err, "invalid upstream address")
+				require.Nil(t, portProxy)
+				require.Panics(t, func() { portproxy.MustNewPortProxy(nil, tt.upstreamAddr) })
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, portProxy)
+			require.NotPanics(t, func() { portproxy.MustNewPortProxy(nil, tt.upstreamAddr) })
+		})
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+func TestPortProxyEphemeralHostPort(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	// The container port is relayed to, since the host port is not known
+	// in advance.
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	// An empty host port is picked by the system too, as with Docker.
+	for _, requested := range []string{"0", ""} {
+		t.Run(fmt.Sprintf("host port %q", requested), func(t *testing.T) {
+			response, err := sendPortMapping(localListener, types.PortMapping{
+				Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: requested}}},
+			})
+			require.NoError(t, err)
+			require.True(t, response.Success)
+			require.Len(t, response.Results, 1)
+			require.Equal(t, port, response.Results[0].Port)
+			hostPort := response.Results[0].HostPort
+			require.NotContains(t, []string{"0", ""}, hostPort)
+			require.Equal(t, []nat.Port{nat.Port(hostPort + "/tcp")}, portProxy.ActivePorts())
+
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPort))
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, echo(conn))
+
+			// The port is removed by the host port it was published on.
+			response, err = sendPortMapping(localListener, types.PortMapping{
+				Remove: true,
+				Ports:  nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}},
+			})
+			require.NoError(t, err)
+			require.True(t, response.Success)
+			require.Empty(t, portProxy.ActivePorts())
+		})
 	}
-	return resp, nil
 }
 
-func marshalAndSend(listener net.Listener, portMapping types.PortMapping) error {
-	b, err := json.Marshal(portMapping)
-	if err != nil {
-		return err
+func TestPortProxyListenAddr(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	// The host IP of the bindings is overridden.
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithBindAddress("127.0.0.1"))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port:    []nat.PortBinding{{HostPort: "0"}},
+			udpPort: []nat.PortBinding{{HostPort: "0"}},
+		},
 	}
-	c, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
-	if err != nil {
-		return err
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing the ports should succeed: %+v", response)
+	require.Len(t, response.Results, 2)
+	for _, result := range response.Results {
+		require.Equalf(t, net.JoinHostPort("127.0.0.1", result.HostPort), result.ListenAddr, "listen address of %s", result.Port)
 	}
-	_, err = c.Write(b)
+
+	// The TCP listen address is the one connections are relayed from.
+	var tcpResult types.PortBindingResult
+	for _, result := range response.Results {
+		if result.Port == port {
+			tcpResult = result
+		}
+	}
+	conn, err := net.Dial("tcp", tcpResult.ListenAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// Bindings that are removed are not listened on.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Remove: true,
+		Ports:  nat.PortMap{port: []nat.PortBinding{{HostPort: tcpResult.HostPort}}},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Empty(t, response.Results[0].ListenAddr)
+}
+
+func TestPortProxyIPv6(t *testing.T) {
+	testServerIP, err := availableIPv6()
 	if err != nil {
-		return err
+		t.Skipf("no IPv6 address available: %s", err)
+	}
+
+	expectedResponse := "called the IPv6 upstream server"
+
+	listener, err := net.Listen("tcp6", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	testServer := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, expectedResponse)
+		}),
+	}
+	defer testServer.Close()
+	testServer.SetKeepAlivesEnabled(false)
+	go testServer.Serve(listener)
+
+	_, testPort, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+
+	// Dual-stack: a v4 and a v6 binding for the same port.
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{
+				{
+					HostIP:   "127.0.0.1",
+					HostPort: testPort,
+				},
+				{
+					HostIP:   "::1",
+					HostPort: testPort,
+				},
+			},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		getURL := fmt.Sprintf("http://%s", net.JoinHostPort(host, testPort))
+		resp, err := httpGetRequest(context.Background(), getURL)
+		require.NoErrorf(t, err, "listener on %s should be available", host)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, expectedResponse, string(bodyBytes))
 	}
-	return c.Close()
+
+	// Removing the v6 binding leaves the v4 one in place.
+	portMapping.Remove = true
+	portMapping.Ports[port] = portMapping.Ports[port][1:]
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	_, err = httpGetRequest(context.Background(), fmt.Sprintf("http://[::1]:%s", testPort))
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	resp, err := httpGetRequest(context.Background(), fmt.Sprintf("http://127.0.0.1:%s", testPort))
+	require.NoError(t, err)
+	resp.Body.Close()
 }
 
-func availableIP() (string, error) {
+func TestPortProxyMaxConnLifetime(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	lifetime := 300 * time.Millisecond
+	closed := make(chan portproxy.ConnEvent, 1)
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithMaxConnLifetime(lifetime),
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+			if event.Type == portproxy.ConnClosed {
+				closed <- event
+			}
+		}))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	require.NoError(t, marshalAndSend(localListener, portMapping))
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The connection is torn down even though it never goes idle.
+	start := time.Now()
+	for {
+		if err := echo(conn); err != nil {
+			break
+		}
+		require.Less(t, time.Since(start), 5*time.Second, "the connection outlived its maximum lifetime")
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.GreaterOrEqual(t, time.Since(start), lifetime)
+
+	select {
+	case event := <-closed:
+		require.ErrorIs(t, event.Err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the connection hook did not report the connection as closed")
+	}
+}
+
+func TestPortProxyUpdateUpstream(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// The new upstream echoes too, and reports every connection it gets.
+	newUpstream, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer newUpstream.Close()
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			c, err := newUpstream.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	// The new upstream takes the port on 127.0.0.1, so listen elsewhere.
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.2", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	proxyAddr := net.JoinHostPort("127.0.0.2", testPort)
+
+	before, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer before.Close()
+	require.NoError(t, echo(before))
+	require.Equal(t, testServerIP, portProxy.Upstream())
+
+	require.Error(t, portProxy.UpdateUpstream("not an IP", false))
+	require.Equal(t, testServerIP, portProxy.Upstream())
+	require.NoError(t, portProxy.UpdateUpstream("[127.0.0.1]", false))
+	require.Equal(t, "127.0.0.1", portProxy.Upstream())
+
+	// Existing connections are kept, new ones go to the new upstream.
+	require.NoError(t, echo(before))
+	after, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer after.Close()
+	require.NoError(t, echo(after))
+	require.Len(t, accepted, 1)
+
+	// Draining closes the connections relayed so far.
+	require.NoError(t, portProxy.UpdateUpstream(testServerIP, true))
+	for _, conn := range []net.Conn{before, after} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF, "connections should be closed when draining")
+	}
+}
+
+func TestPortProxyUpstreamAddresses(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// Nothing listens on the first upstream address.
+	localListener, _ := startPortProxy(t, "127.0.0.3", portproxy.WithUpstreamAddresses(testServerIP))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
+
+func TestPortProxyConcurrentApplyClose(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	upstreamPort, err := strconv.Atoi(startEchoServer(t, testServerIP))
+	require.NoError(t, err)
+	var hostPorts []string
+	for range 3 {
+		hostPorts = append(hostPorts, freePort(t))
+	}
+	portMapping := func(i int, remove bool) types.PortMapping {
+		hostPort := hostPorts[i%len(hostPorts)]
+		return types.PortMapping{
+			Remove: remove,
+			Ports: nat.PortMap{
+				nat.Port(hostPort + "/tcp"): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}},
+			},
+			UpstreamPort: upstreamPort,
+		}
+	}
+
+	// Control messages, connections and Close race with each other, which
+	// the race detector checks, until the proxy is closed.
+	deadline := time.Now().Add(3 * time.Second)
+	for round := 0; time.Now().Before(deadline); round++ {
+		localListener, err := nettest.NewLocalListener("unix")
+		require.NoError(t, err)
+		portProxy := portproxy.MustNewPortProxy(localListener, testServerIP)
+		go portProxy.Start()
+		<-portProxy.Ready()
+
+		var wg sync.WaitGroup
+		for worker := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					_, _ = sendPortMapping(localListener, portMapping(worker+i, i%3 == 2))
+				}
+			}()
+		}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				portProxy.ReplaceAll(portMapping(i, false))
+				_ = portProxy.ActivePorts()
+				_ = portProxy.UpdateUpstream(testServerIP, i%2 == 0)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPorts[i%len(hostPorts)]))
+				if err == nil {
+					_ = echo(conn)
+					_ = conn.Close()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(round%20) * time.Millisecond)
+			_ = portProxy.Close()
+		}()
+		wg.Wait()
+		require.NoError(t, portProxy.Close())
+		for _, hostPort := range hostPorts {
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPort))
+			if err == nil {
+				conn.Close()
+			}
+			require.Errorf(t, err, "port %s should not be listened on once the proxy is closed", hostPort)
+		}
+		localListener.Close()
+	}
+}
+
+func TestPortProxyHealthy(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer localListener.Close()
+	portProxy := portproxy.MustNewPortProxy(localListener, testServerIP)
+	require.False(t, portProxy.Healthy(), "the proxy is not started yet")
+	errs := make(chan error, 1)
+	go func() {
+		errs <- portProxy.Start()
+	}()
+	<-portProxy.Ready()
+	defer portProxy.Close()
+	require.True(t, portProxy.Healthy())
+
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			tcpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.True(t, portProxy.Healthy())
+
+	// The control listener dies under the proxy.
+	require.NoError(t, localListener.Close())
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the control accept loop did not stop")
+	}
+	require.False(t, portProxy.Healthy())
+}
+
+func TestPortProxyCloseTwice(t *testing.T) {
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	portProxy := portproxy.MustNewPortProxy(localListener, "127.0.0.1")
+	started := make(chan error)
+	go func() {
+		started <- portProxy.Start()
+	}()
+	<-portProxy.Ready()
+
+	// e.g. from both a signal handler and a deferred call
+	require.NoError(t, portProxy.Close())
+	require.NoError(t, <-started)
+	require.NoError(t, portProxy.Close())
+	require.NotPanics(t, func() {
+		require.NoError(t, portProxy.Start())
+	})
+}
+
+func TestPortProxyCloseWithTimeout(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	upstream, err := net.Listen("tcp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// The upstream answers "slow" requests late and never answers "hang" ones.
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if string(buf) == "hang" {
+					_, _ = io.Copy(io.Discard, conn)
+					return
+				}
+				time.Sleep(300 * time.Millisecond)
+				_, _ = conn.Write([]byte("done"))
+			}(conn)
+		}
+	}()
+
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+
+	startProxy := func() *portproxy.PortProxy {
+		localListener, err := nettest.NewLocalListener("unix")
+		require.NoError(t, err)
+		portProxy := portproxy.MustNewPortProxy(localListener, testServerIP)
+		go portProxy.Start()
+		<-portProxy.Ready()
+		require.NoError(t, marshalAndSend(localListener, portMapping))
+		return portProxy
+	}
+
+	t.Run("in-flight connections drain", func(t *testing.T) {
+		portProxy := startProxy()
+
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("slow"))
+		require.NoError(t, err)
+		// Give the proxy a moment to accept the connection.
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed := make(chan error, 1)
+		go func() { closed <- portProxy.CloseWithTimeout(ctx) }()
+
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "done", string(b))
+		require.NoError(t, conn.Close())
+		require.NoError(t, <-closed)
+
+		expected := `
+# HELP portproxy_connections_drained_total Number of connections that finished on their own while the proxy was closing.
+# TYPE portproxy_connections_drained_total counter
+portproxy_connections_drained_total 1
+# HELP portproxy_connections_force_closed_total Number of connections closed because they did not finish within the grace period of Close.
+# TYPE portproxy_connections_force_closed_total counter
+portproxy_connections_force_closed_total 0
+`
+		require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+			"portproxy_connections_drained_total", "portproxy_connections_force_closed_total"))
+	})
+
+	t.Run("stuck connections are force closed", func(t *testing.T) {
+		portProxy := startProxy()
+
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hang"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		require.NoError(t, portProxy.CloseWithTimeout(ctx))
+		require.Less(t, time.Since(start), 5*time.Second)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		expected := `
+# HELP portproxy_connections_drained_total Number of connections that finished on their own while the proxy was closing.
+# TYPE portproxy_connections_drained_total counter
+portproxy_connections_drained_total 0
+# HELP portproxy_connections_force_closed_total Number of connections closed because they did not finish within the grace period of Close.
+# TYPE portproxy_connections_force_closed_total counter
+portproxy_connections_force_closed_total 1
+`
+		require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+			"portproxy_connections_drained_total", "portproxy_connections_force_closed_total"))
+	})
+}
+
+func TestPortProxyActivePorts(t *testing.T) {
+	localListener, portProxy := startPortProxy(t, "127.0.0.1")
+
+	require.Empty(t, portProxy.ActivePorts())
+
+	// Pick ports that are free on loopback and sort them so the expected
+	// order is known up front.
+	var hostPorts []int
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		hostPorts = append(hostPorts, l.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, l.Close())
+	}
+	if hostPorts[0] > hostPorts[1] {
+		hostPorts[0], hostPorts[1] = hostPorts[1], hostPorts[0]
+	}
+	low, high := strconv.Itoa(hostPorts[0]), strconv.Itoa(hostPorts[1])
+
+	lowTCP, err := nat.NewPort("tcp", low)
+	require.NoError(t, err)
+	lowUDP, err := nat.NewPort("udp", low)
+	require.NoError(t, err)
+	highTCP, err := nat.NewPort("tcp", high)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			highTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: high}},
+			lowUDP:  []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: low}},
+			lowTCP: []nat.PortBinding{
+				{HostIP: "127.0.0.1", HostPort: low},
+				{HostIP: "127.0.0.2", HostPort: low},
+			},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+	require.Equal(t, []nat.Port{lowTCP, lowUDP, highTCP}, portProxy.ActivePorts())
+
+	// The snapshot is a copy that callers are free to modify.
+	ports := portProxy.ActivePorts()
+	ports[0] = "1/tcp"
+	require.Equal(t, []nat.Port{lowTCP, lowUDP, highTCP}, portProxy.ActivePorts())
+
+	portMapping.Remove = true
+	portMapping.Ports = nat.PortMap{
+		lowTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: low}},
+		lowUDP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: low}},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+	// The binding on 127.0.0.2 keeps the TCP port active.
+	require.Equal(t, []nat.Port{lowTCP, highTCP}, portProxy.ActivePorts())
+}
+
+func TestPortProxyConnectionsByPort(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	require.Empty(t, portProxy.ConnectionsByPort())
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+	require.Equal(t, map[nat.Port][]net.Addr{port: nil}, portProxy.ConnectionsByPort())
+
+	var clients []net.Conn
+	for range 2 {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		// The connection is tracked once it is relayed.
+		require.NoError(t, echo(conn))
+		clients = append(clients, conn)
+	}
+	clientAddrs := func(conns ...net.Conn) []string {
+		var addrs []string
+		for _, conn := range conns {
+			addrs = append(addrs, conn.LocalAddr().String())
+		}
+		return addrs
+	}
+	remoteAddrs := func() []string {
+		var addrs []string
+		for _, addr := range portProxy.ConnectionsByPort()[port] {
+			addrs = append(addrs, addr.String())
+		}
+		return addrs
+	}
+	require.ElementsMatch(t, clientAddrs(clients...), remoteAddrs())
+
+	// The snapshot is a copy that callers are free to modify.
+	snapshot := portProxy.ConnectionsByPort()
+	snapshot[port][0] = nil
+	delete(snapshot, port)
+	require.ElementsMatch(t, clientAddrs(clients...), remoteAddrs())
+
+	require.NoError(t, clients[0].Close())
+	require.Eventually(t, func() bool {
+		return len(remoteAddrs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, clientAddrs(clients[1]), remoteAddrs())
+}
+
+func TestPortProxyResponse(t *testing.T) {
+	localListener, portProxy := startPortProxy(t, "127.0.0.1")
+
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inUse.Close()
+	_, inUsePort, err := net.SplitHostPort(inUse.Addr().String())
+	require.NoError(t, err)
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, freePort, err := net.SplitHostPort(free.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, free.Close())
+
+	inUseTCP, err := nat.NewPort("tcp", inUsePort)
+	require.NoError(t, err)
+	freeTCP, err := nat.NewPort("tcp", freePort)
+	require.NoError(t, err)
+
+	t.Run("reports the outcome of each binding", func(t *testing.T) {
+		response, err := sendPortMapping(localListener, types.PortMapping{
+			Ports: nat.PortMap{
+				inUseTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: inUsePort}},
+				freeTCP:  []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: freePort}},
+			},
+		})
+		require.NoError(t, err)
+		require.False(t, response.Success)
+		require.Empty(t, response.Error)
+		require.Len(t, response.Results, 2)
+		for _, result := range response.Results {
+			require.Equal(t, "127.0.0.1", result.HostIP)
+			switch result.Port {
+			case inUseTCP:
+				require.False(t, result.Success)
+				require.Contains(t, result.Error, syscall.EADDRINUSE.Error())
+			case freeTCP:
+				require.True(t, result.Success)
+				require.Empty(t, result.Error)
+			default:
+				require.Failf(t, "unexpected result", "%+v", result)
+			}
+		}
+
+		expected := `
+# HELP portproxy_bind_errors_total Number of published ports that could not be listened on.
+# TYPE portproxy_bind_errors_total counter
+portproxy_bind_errors_total{reason="in_use"} 1
+portproxy_bind_errors_total{reason="other"} 0
+portproxy_bind_errors_total{reason="permission_denied"} 0
+`
+		require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+			"portproxy_bind_errors_total"))
+	})
+
+	t.Run("succeeds when every binding is applied", func(t *testing.T) {
+		response, err := sendPortMapping(localListener, types.PortMapping{
+			Remove: true,
+			Ports: nat.PortMap{
+				freeTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: freePort}},
+			},
+		})
+		require.NoError(t, err)
+		require.True(t, response.Success)
+		require.Len(t, response.Results, 1)
+	})
+
+	t.Run("handles versioned control messages", func(t *testing.T) {
+		b, err := json.Marshal(types.ControlMessage{
+			Version: 1,
+			PortMapping: &types.PortMapping{
+				Remove: true,
+				Ports: nat.PortMap{
+					freeTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: freePort}},
+				},
+			},
+		})
+		require.NoError(t, err)
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write(b)
+		require.NoError(t, err)
+		var response types.PortMappingResponse
+		require.NoError(t, json.NewDecoder(c).Decode(&response))
+		require.Equal(t, 1, response.Version)
+		require.True(t, response.Success)
+		require.Len(t, response.Results, 1)
+	})
+
+	t.Run("reports payloads that cannot be decoded", func(t *testing.T) {
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("not json"))
+		require.NoError(t, err)
+		var response types.PortMappingResponse
+		require.NoError(t, json.NewDecoder(c).Decode(&response))
+		require.False(t, response.Success)
+		require.NotEmpty(t, response.Error)
+		require.Empty(t, response.Results)
+	})
+
+	t.Run("applies mappings from clients that do not wait for a response", func(t *testing.T) {
+		b, err := json.Marshal(types.PortMapping{
+			Ports: nat.PortMap{
+				freeTCP: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: freePort}},
+			},
+		})
+		require.NoError(t, err)
+		c, err := net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+		require.NoError(t, err)
+		_, err = c.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		require.Eventually(t, func() bool {
+			return slices.Contains(portProxy.ActivePorts(), freeTCP)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestPortProxyMaxConnsPerPort(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithMaxConnsPerPort(1))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	proxyAddr := net.JoinHostPort("127.0.0.1", testPort)
+
+	first, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, echo(first))
+
+	second, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer second.Close()
+	require.Error(t, echo(second), "connection over the limit should be closed")
+
+	// Ending the first relay frees its slot.
+	require.NoError(t, first.Close())
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return echo(conn) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPortProxyMaxConns(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	firstPort := startEchoServer(t, testServerIP)
+	secondPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP, portproxy.WithMaxConns(1))
+
+	portMapping := types.PortMapping{Ports: nat.PortMap{}}
+	for _, hostPort := range []string{firstPort, secondPort} {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		portMapping.Ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	first, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", firstPort))
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, echo(first))
+
+	// The limit applies across ports.
+	second, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", secondPort))
+	require.NoError(t, err)
+	defer second.Close()
+	require.Error(t, echo(second), "connection over the limit should be closed")
+
+	expected := `
+# HELP portproxy_conns_rejected_total Number of connections closed because a connection limit was reached.
+# TYPE portproxy_conns_rejected_total counter
+portproxy_conns_rejected_total{limit="global"} 1
+portproxy_conns_rejected_total{limit="port"} 0
+portproxy_conns_rejected_total{limit="rate"} 0
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_conns_rejected_total")
+	require.NoError(t, err)
+
+	require.NoError(t, first.Close())
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", secondPort))
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return echo(conn) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPortProxyConnectionFilter(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	type call struct {
+		client string
+		port   nat.Port
+	}
+	calls := make(chan call, 2)
+	closed := make(chan portproxy.ConnEvent, 2)
+	localListener, portProxy := startPortProxy(t, testServerIP,
+		portproxy.WithConnectionFilter(func(client net.Addr, hostPort nat.Port) error {
+			calls <- call{client: client.String(), port: hostPort}
+			// Only the clients dialing from 127.0.0.2 are allowed.
+			if host, _, _ := net.SplitHostPort(client.String()); host != "127.0.0.2" {
+				return errors.New("denied by policy")
+			}
+			return nil
+		}),
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+			if event.Type == portproxy.ConnClosed {
+				closed <- event
+			}
+		}))
+
+	// The filter is passed the host port, not the container port.
+	hostPort := freePort(t)
+	published, err := nat.NewPort("tcp", hostPort)
+	require.NoError(t, err)
+	upstreamPort, err := strconv.Atoi(testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}},
+		},
+		UpstreamPort: upstreamPort,
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	dialFrom := func(ip string) net.Conn {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPort))
+		require.NoError(t, err)
+		return conn
+	}
+	conn := dialFrom("127.0.0.2")
+	require.NoError(t, echo(conn), "the allowed client should be relayed")
+	require.Equal(t, call{client: conn.LocalAddr().String(), port: published}, <-calls)
+	conn.Close()
+	require.NoError(t, (<-closed).Err)
+
+	conn = dialFrom("127.0.0.1")
+	defer conn.Close()
+	require.Error(t, echo(conn), "the rejected client should be closed")
+	require.Equal(t, call{client: conn.LocalAddr().String(), port: published}, <-calls)
+	event := <-closed
+	require.ErrorIs(t, event.Err, portproxy.ErrConnectionFiltered)
+	require.ErrorContains(t, event.Err, "denied by policy")
+
+	expected := `
+# HELP portproxy_conns_filtered_total Number of connections closed because the connection filter rejected them.
+# TYPE portproxy_conns_filtered_total counter
+portproxy_conns_filtered_total 1
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_conns_filtered_total")
+	require.NoError(t, err)
+}
+
+func TestPortProxyApplyHook(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	type applied struct {
+		applied, removed, active []nat.Port
+	}
+	calls := make(chan applied, 10)
+	debounce := 100 * time.Millisecond
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	defer localListener.Close()
+	var portProxy *portproxy.PortProxy
+	portProxy = portproxy.MustNewPortProxy(localListener, testServerIP,
+		portproxy.WithApplyDebounce(debounce),
+		portproxy.WithApplyHook(func(appliedPorts, removedPorts []nat.Port) {
+			// The proxy is not locked while the hook runs.
+			calls <- applied{applied: appliedPorts, removed: removedPorts, active: portProxy.ActivePorts()}
+		}))
+	go portProxy.Start()
+	<-portProxy.Ready()
+	defer portProxy.Close()
+
+	mapping := func(remove bool, hostPort string) types.PortMapping {
+		return types.PortMapping{
+			Remove: remove,
+			Ports: nat.PortMap{
+				nat.Port(hostPort + "/tcp"): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}},
+			},
+		}
+	}
+	first, second := freePort(t), freePort(t)
+	firstPort, secondPort := nat.Port(first+"/tcp"), nat.Port(second+"/tcp")
+	send := func(pm types.PortMapping) {
+		response, err := sendPortMapping(localListener, pm)
+		require.NoError(t, err)
+		require.Truef(t, response.Success, "%+v should succeed: %+v", pm, response)
+	}
+	noCall := func(msg string) {
+		select {
+		case call := <-calls:
+			require.FailNow(t, "the apply hook should not be called", fmt.Sprintf("%s: %+v", msg, call))
+		default:
+		}
+	}
+
+	send(mapping(false, first))
+	require.Equal(t, applied{applied: []nat.Port{firstPort}, active: []nat.Port{firstPort}}, <-calls)
+
+	send(mapping(false, first))
+	noCall("publishing a port again")
+	dryRun := mapping(false, second)
+	dryRun.DryRun = true
+	send(dryRun)
+	noCall("a dry run")
+
+	// Publishing and removing a port within the debounce window cancels out.
+	var wg sync.WaitGroup
+	for _, pm := range []types.PortMapping{mapping(false, second), mapping(true, second)} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = sendPortMapping(localListener, pm)
+		}()
+		time.Sleep(debounce / 5)
+	}
+	wg.Wait()
+	noCall("debounced messages cancelling out")
+
+	result := portProxy.ReplaceAll(mapping(false, second))
+	require.True(t, result.Success)
+	require.Equal(t, applied{
+		applied: []nat.Port{secondPort},
+		removed: []nat.Port{firstPort},
+		active:  []nat.Port{secondPort},
+	}, <-calls)
+}
+
+func TestPortProxyAcceptRate(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP, portproxy.WithAcceptRate(1, 2))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	err = marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+
+	// The burst is accepted, the connection after it is not.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoErrorf(t, echo(conn), "connection %d within the burst should be relayed", i)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Error(t, echo(conn), "connection over the accept rate should be closed")
+
+	expected := `
+# HELP portproxy_conns_rejected_total Number of connections closed because a connection limit was reached.
+# TYPE portproxy_conns_rejected_total counter
+portproxy_conns_rejected_total{limit="global"} 0
+portproxy_conns_rejected_total{limit="port"} 0
+portproxy_conns_rejected_total{limit="rate"} 1
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_conns_rejected_total")
+	require.NoError(t, err)
+
+	// Connections are accepted again once the rate allows it.
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return echo(conn) == nil
+	}, 5*time.Second, 200*time.Millisecond)
+}
+
+func TestPortProxyBindAddress(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	testPort := startEchoServer(t, testServerIP)
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: testPort}},
+		},
+	}
+
+	// The echo server holds the port on testServerIP, so the wildcard
+	// address requested by the mapping cannot be bound.
+	localListener, _ := startPortProxy(t, testServerIP)
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.False(t, response.Success)
+
+	localListener, _ = startPortProxy(t, testServerIP, portproxy.WithBindAddress("127.0.0.1"))
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// Other addresses are left alone.
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", testPort))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestPortProxyHostIP(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	// Relay to a unix socket so that the upstream does not hold the port
+	// on any host address.
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	upstream, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %s", err)
+	}
+	require.NoError(t, l.Close())
+
+	localListener, _ := startPortProxy(t, testServerIP)
+	tests := []struct {
+		hostIP      string
+		reachable   []string
+		unreachable []string
+	}{
+		{
+			hostIP:      "0.0.0.0",
+			reachable:   []string{"127.0.0.1", testServerIP},
+			unreachable: []string{"::1"},
+		},
+		{
+			hostIP:      "::",
+			reachable:   []string{"::1"},
+			unreachable: []string{"127.0.0.1", testServerIP},
+		},
+		{
+			hostIP:    "",
+			reachable: []string{"127.0.0.1", testServerIP, "::1"},
+		},
+		{
+			hostIP:      "127.0.0.1",
+			reachable:   []string{"127.0.0.1"},
+			unreachable: []string{testServerIP, "::1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("HostIP %q", tt.hostIP), func(t *testing.T) {
+			testPort := freePort(t)
+			port, err := nat.NewPort("tcp", testPort)
+			require.NoError(t, err)
+			portMapping := types.PortMapping{
+				Ports: nat.PortMap{
+					port: []nat.PortBinding{{HostIP: tt.hostIP, HostPort: testPort}},
+				},
+				Target: "unix://" + socketPath,
+			}
+			response, err := sendPortMapping(localListener, portMapping)
+			require.NoError(t, err)
+			require.Truef(t, response.Success, "publishing the port should succeed: %+v", response)
+
+			for _, host := range tt.reachable {
+				conn, err := net.Dial("tcp", net.JoinHostPort(host, testPort))
+				require.NoErrorf(t, err, "port should be reachable on %s", host)
+				require.NoError(t, echo(conn))
+				conn.Close()
+			}
+			for _, host := range tt.unreachable {
+				_, err := net.Dial("tcp", net.JoinHostPort(host, testPort))
+				require.ErrorIsf(t, err, syscall.ECONNREFUSED, "port should not be reachable on %s", host)
+			}
+
+			portMapping.Remove = true
+			response, err = sendPortMapping(localListener, portMapping)
+			require.NoError(t, err)
+			require.True(t, response.Success)
+		})
+	}
+}
+
+func TestPortProxyStartContext(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	portProxy := portproxy.MustNewPortProxy(localListener, testServerIP)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	select {
+	case <-portProxy.Ready():
+		require.FailNow(t, "proxy should not be ready before it is started")
+	default:
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- portProxy.StartContext(ctx)
+	}()
+	select {
+	case <-portProxy.Ready():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "proxy did not become ready")
+	}
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+	proxyAddr := net.JoinHostPort("127.0.0.1", testPort)
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.Close())
+
+	cancel()
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "StartContext did not return after the context was cancelled")
+	}
+
+	_, err = net.Dial("tcp", proxyAddr)
+	require.ErrorIs(t, err, syscall.ECONNREFUSED, "published port should be closed")
+	_, err = net.Dial(localListener.Addr().Network(), localListener.Addr().String())
+	require.Error(t, err, "control listener should be closed")
+}
+
+func TestPortProxyWithLogger(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// Nothing listens on the upstream port, so the relay fails to dial.
+	l, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	_, testPort, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithLogger(logrus.NewEntry(logger).WithField("component", "portproxy")))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = io.ReadAll(conn)
+
+	var dialError *logrus.Entry
+	require.Eventually(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				dialError = entry
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "portproxy", dialError.Data["component"])
+	require.Equal(t, testPort, dialError.Data["port"])
+	require.Equal(t, net.JoinHostPort(testServerIP, testPort), dialError.Data["upstream"])
+	require.Equal(t, conn.LocalAddr().String(), dialError.Data["client"])
+}
+
+func TestPortProxyMappingName(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	events := make(chan portproxy.ConnEvent, 2)
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithLogger(logrus.NewEntry(logger)),
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+			events <- event
+		}))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		Name: "my-postgres",
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.Close())
+
+	for range 2 {
+		select {
+		case event := <-events:
+			require.Equalf(t, "my-postgres", event.Name, "%s event", event.Type)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the connection hook was not called")
+		}
+	}
+	var named bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["client"] == conn.LocalAddr().String() {
+			require.Equalf(t, "my-postgres", entry.Data["name"], "log entry %q", entry.Message)
+			named = true
+		}
+	}
+	require.True(t, named, "the connection should be logged with the name of the port mapping")
+}
+
+// recordingTracer records the spans that were ended.
+type recordingTracer struct {
+	mutex sync.Mutex
+	ended []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent *recordedSpan
+	attrs  map[string]any
+	err    error
+}
+
+type spanKey struct{}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, portproxy.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: r, name: name, parent: parent, attrs: make(map[string]any)}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (r *recordingTracer) spans() []*recordedSpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return slices.Clone(r.ended)
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...portproxy.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) End(err error) {
+	s.err = err
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+func TestPortProxyDuplicateMapping(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, _ := startPortProxy(t, testServerIP)
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			tcpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	proxyAddr := net.JoinHostPort("127.0.0.1", testPort)
+	relayed, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer relayed.Close()
+	require.NoError(t, echo(relayed))
+
+	// Keep connecting while the mapping is applied again; a listener
+	// that is closed and recreated would refuse some of them.
+	stop := make(chan struct{})
+	dialErrs := make(chan error, 1)
+	go func() {
+		defer close(dialErrs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				dialErrs <- err
+				return
+			}
+			conn.Close()
+		}
+	}()
+	for range 10 {
+		response, err = sendPortMapping(localListener, portMapping)
+		require.NoError(t, err)
+		require.Truef(t, response.Success, "applying the same mapping again should succeed: %+v", response)
+	}
+	close(stop)
+	require.NoError(t, <-dialErrs)
+
+	// Connections relayed before the mapping was applied again are intact.
+	require.NoError(t, echo(relayed))
+}
+
+func TestPortProxyRemapWithTimeWait(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	// The idle timeout makes the proxy close the relayed connection first,
+	// which leaves its end in TIME_WAIT on the published port.
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithIdleTimeout(100*time.Millisecond))
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "proxy should close the idle connection")
+	conn.Close()
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	// Publishing the port again must succeed straight away.
+	portMapping.Remove = false
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing the port again should succeed: %+v", response)
+
+	conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
+
+func TestPortProxyRemoveAll(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			tcpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	response, err = sendPortMapping(localListener, types.PortMapping{RemoveAll: true})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Equal(t, 2, response.Removed)
+	require.Empty(t, portProxy.ActivePorts())
+
+	// Relayed connections are closed too.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Removing everything again is fine.
+	response, err = sendPortMapping(localListener, types.PortMapping{RemoveAll: true})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Zero(t, response.Removed)
+}
+
+func TestPortProxyDrainOnRemove(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	drain := portMapping
+	drain.Remove = true
+	drain.Drain = true
+	drain.DrainTimeoutSeconds = 1
+	start := time.Now()
+	response, err = sendPortMapping(localListener, drain)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "a draining remove should succeed: %+v", response)
+
+	// The port no longer accepts connections, but the transfer in flight
+	// finishes.
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.Error(t, err)
+	buf := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// It is closed once the drain timeout is over.
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// Draining only applies to removals.
+	invalid := portMapping
+	invalid.Drain = true
+	response, err = sendPortMapping(localListener, invalid)
+	require.NoError(t, err)
+	require.False(t, response.Success)
+}
+
+func TestPortProxyCloseExistingOnRemove(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+
+	for _, closeExisting := range []bool{false, true} {
+		t.Run(fmt.Sprintf("close existing %t", closeExisting), func(t *testing.T) {
+			localListener, _ := startPortProxy(t, testServerIP, portproxy.WithCloseExistingOnRemove(closeExisting))
+			response, err := sendPortMapping(localListener, portMapping)
+			require.NoError(t, err)
+			require.True(t, response.Success)
+
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, echo(conn))
+
+			remove := portMapping
+			remove.Remove = true
+			response, err = sendPortMapping(localListener, remove)
+			require.NoError(t, err)
+			require.True(t, response.Success)
+			_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+			require.Error(t, err, "the removed port should refuse new connections")
+
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			if closeExisting {
+				_, err = conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, io.EOF, "the relayed connection should be closed")
+			} else {
+				require.NoError(t, echo(conn), "the relayed connection should survive")
+			}
+		})
+	}
+}
+
+func TestPortProxyCloseDataPlane(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	portProxy.CloseDataPlane()
+	require.Empty(t, portProxy.ActivePorts())
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "relayed connections should be closed")
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.Error(t, err, "the port should no longer be listened on")
+	require.True(t, portProxy.Healthy(), "the control plane should still be running")
+
+	// The ports are published again over the control listener.
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing the port again should succeed: %+v", response)
+	conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
+
+func TestPortProxyReplaceAll(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	upstreamPort, err := strconv.Atoi(startEchoServer(t, testServerIP))
+	require.NoError(t, err)
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	// Every host port is relayed to the echo server.
+	ports := map[string]nat.Port{}
+	portMap := func(names ...string) nat.PortMap {
+		portMap := nat.PortMap{}
+		for _, name := range names {
+			port := ports[name]
+			portMap[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port.Port()}}
+		}
+		return portMap
+	}
+	for _, name := range []string{"kept", "removed", "added"} {
+		ports[name], err = nat.NewPort("tcp", freePort(t))
+		require.NoError(t, err)
+	}
+
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports:        portMap("kept", "removed"),
+		UpstreamPort: upstreamPort,
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", ports["kept"].Port()))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// A dry run reports what would be removed, and changes nothing.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports:        portMap("kept", "added"),
+		UpstreamPort: upstreamPort,
+		ReplaceAll:   true,
+		DryRun:       true,
+	})
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "dry run should succeed: %+v", response)
+	require.Equal(t, 1, response.Removed)
+	require.ElementsMatch(t, []nat.Port{ports["kept"], ports["removed"]}, portProxy.ActivePorts())
+
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports:        portMap("kept", "added"),
+		UpstreamPort: upstreamPort,
+		ReplaceAll:   true,
+	})
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "replacing the ports should succeed: %+v", response)
+	require.Len(t, response.Results, 2)
+	require.Equal(t, 1, response.Removed)
+	require.ElementsMatch(t, []nat.Port{ports["kept"], ports["added"]}, portProxy.ActivePorts())
+
+	// The port in both sets kept its listener and its connection.
+	require.NoError(t, echo(conn))
+	for _, name := range []string{"kept", "added"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", ports[name].Port()))
+		require.NoErrorf(t, err, "port %s should be published", name)
+		require.NoError(t, echo(conn))
+		conn.Close()
+	}
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", ports["removed"].Port()))
+	require.Error(t, err, "the port not in the replacing set should be removed")
+
+	result := portProxy.ReplaceAll(types.PortMapping{
+		Ports:        portMap("added"),
+		UpstreamPort: upstreamPort,
+	})
+	require.Truef(t, result.Success, "replacing the ports should succeed: %+v", result)
+	require.Equal(t, 1, result.Removed)
+	require.Equal(t, []nat.Port{ports["added"]}, portProxy.ActivePorts())
+}
+
+func TestPortProxyUpstreamPort(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	upstreamPort, err := strconv.Atoi(startEchoServer(t, testServerIP))
+	require.NoError(t, err)
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	// Nothing listens on the host port at the upstream address, so the
+	// echo only comes back when the upstream port is dialed.
+	hostPort := freePort(t)
+	port, err := nat.NewPort("tcp", hostPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}},
+		},
+		UpstreamPort: upstreamPort,
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing a port with an upstream port should succeed: %+v", response)
+	require.Equal(t, hostPort, response.Results[0].HostPort)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	for _, invalid := range []types.PortMapping{
+		{Ports: portMapping.Ports, UpstreamPort: 65536},
+		{Ports: portMapping.Ports, UpstreamPort: 80, Target: "unix:///tmp/upstream.sock"},
+	} {
+		response, err := sendPortMapping(localListener, invalid)
+		require.NoError(t, err)
+		require.Falsef(t, response.Success, "%+v should be rejected", invalid)
+		require.NotEmpty(t, response.Results[0].Error)
+	}
+}
+
+func TestPortProxyMultipleHostPorts(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	// Each binding is relayed to its own host port on the upstream.
+	hostPorts := []string{startEchoServer(t, testServerIP), startEchoServer(t, testServerIP)}
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{
+				{HostIP: "127.0.0.1", HostPort: hostPorts[0]},
+				{HostIP: "127.0.0.1", HostPort: hostPorts[1]},
+			},
+		},
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing both host ports should succeed: %+v", response)
+	require.Len(t, response.Results, 2)
+	require.ElementsMatch(t, []nat.Port{nat.Port(hostPorts[0] + "/tcp"), nat.Port(hostPorts[1] + "/tcp")},
+		portProxy.ActivePorts())
+	for _, hostPort := range hostPorts {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", hostPort))
+		require.NoErrorf(t, err, "host port %s should be published", hostPort)
+		require.NoErrorf(t, echo(conn), "host port %s should relay", hostPort)
+		conn.Close()
+	}
+
+	portMapping.Remove = true
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Empty(t, portProxy.ActivePorts())
+}
+
+func TestPortProxyConnectionErrors(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// The upstream resets every connection once it has received something.
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Read(make([]byte, 4))
+			_ = c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+	_, resetPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	// Nothing listens on the upstream side of this port.
+	l, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	_, refusedPort, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	closed := make(chan portproxy.ConnEvent, 1)
+	localListener, portProxy := startPortProxy(t, testServerIP,
+		portproxy.WithResetOnDialFailure(),
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+			if event.Type == portproxy.ConnClosed {
+				closed <- event
+			}
+		}))
+
+	portMapping := types.PortMapping{Ports: nat.PortMap{}}
+	for _, hostPort := range []string{resetPort, refusedPort} {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		portMapping.Ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	t.Run("dial failure resets the client", func(t *testing.T) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", refusedPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.ReadAll(conn)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+
+		event := <-closed
+		require.ErrorIs(t, event.Err, portproxy.ErrUpstreamDial)
+		require.ErrorIs(t, event.Err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("mid-stream failure", func(t *testing.T) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", resetPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, _ = io.ReadAll(conn)
+
+		event := <-closed
+		require.Error(t, event.Err)
+		require.NotErrorIs(t, event.Err, portproxy.ErrUpstreamDial)
+		require.ErrorIs(t, event.Err, syscall.ECONNRESET)
+	})
+
+	expected := `
+# HELP portproxy_relay_errors_total Number of relayed connections interrupted by an error after the upstream was dialed.
+# TYPE portproxy_relay_errors_total counter
+portproxy_relay_errors_total 1
+# HELP portproxy_upstream_dial_errors_total Number of relayed connections whose upstream could not be dialed.
+# TYPE portproxy_upstream_dial_errors_total counter
+portproxy_upstream_dial_errors_total 1
+`
+	err = testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected),
+		"portproxy_relay_errors_total", "portproxy_upstream_dial_errors_total")
+	require.NoError(t, err)
+}
+
+// startEchoServer starts a TCP server on ip that echoes back everything
+// it receives, and returns the port it listens on.
+func startEchoServer(t *testing.T, ip string) string {
+	upstream, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	require.NoError(t, err)
+	t.Cleanup(func() { upstream.Close() })
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	_, port, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+	return port
+}
+
+// echo sends a message over conn and waits for it to be echoed back.
+func echo(conn net.Conn) error {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	return err
+}
+
+// startPortProxy starts a PortProxy forwarding to upstreamIP and returns
+// its control listener along with it; the proxy is closed when the test
+// finishes.
+func startPortProxy(t *testing.T, upstreamIP string, opts ...portproxy.Option) (net.Listener, *portproxy.PortProxy) {
+	localListener, err := nettest.NewLocalListener("unix")
+	require.NoError(t, err)
+	t.Cleanup(func() { localListener.Close() })
+
+	portProxy := portproxy.MustNewPortProxy(localListener, upstreamIP, opts...)
+	go portProxy.Start()
+	<-portProxy.Ready()
+	t.Cleanup(func() { portProxy.Close() })
+
+	return localListener, portProxy
+}
+
+func httpGetRequest(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func marshalAndSend(listener net.Listener, portMapping types.PortMapping) error {
+	_, err := sendPortMapping(listener, portMapping)
+	return err
+}
+
+// sendPortMapping sends the port mapping to the proxy and returns the
+// response it writes back once the mapping is applied.
+func sendPortMapping(listener net.Listener, portMapping types.PortMapping) (types.PortMappingResponse, error) {
+	return sendControlMessage(listener, types.ControlMessage{PortMapping: &portMapping})
+}
+
+// sendControlMessage sends message to the proxy and returns its response.
+func sendControlMessage(listener net.Listener, message types.ControlMessage) (types.PortMappingResponse, error) {
+	var response types.PortMappingResponse
+	c, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		return response, err
+	}
+	defer c.Close()
+	if err := portproxy.EncodeControlMessage(c, message); err != nil {
+		return response, err
+	}
+	if err := json.NewDecoder(c).Decode(&response); err != nil {
+		return response, err
+	}
+	// The server closes the connection after responding.
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// freePort returns a port nothing listens on at 127.0.0.1.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	return port
+}
+
+func availableIP() (string, error) {
+	return findAvailableIP(false)
+}
+
+func availableIPv6() (string, error) {
+	return findAvailableIP(true)
+}
+
+func findAvailableIP(ipv6 bool) (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
@@ -174,12 +2210,11 @@ func availableIP() (string, error) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			if ip == nil || ip.IsLoopback() {
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
+			if (ip.To4() == nil) != ipv6 {
+				continue // not the requested address family
 			}
 			return ip.String(), nil
 		}
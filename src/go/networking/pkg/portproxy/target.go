@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// upstreamTarget is where connections accepted on a published port are
+// relayed to.
+type upstreamTarget struct {
+	network string
+	// addresses are dialed concurrently, the first one to connect wins
+	addresses []string
+}
+
+func (t upstreamTarget) String() string {
+	if t.network == "unix" {
+		return "unix://" + t.addresses[0]
+	}
+	return strings.Join(t.addresses, ",")
+}
+
+// parseTarget returns the upstream for the target of a port mapping. An
+// empty target relays to the same port on the upstream addresses;
+// otherwise the target must be a unix socket, written as
+// unix:///path/to/socket.
+func parseTarget(target string, upstreamAddrs []string, port string) (upstreamTarget, error) {
+	if target == "" {
+		addresses := make([]string, len(upstreamAddrs))
+		for i, upstreamAddr := range upstreamAddrs {
+			addresses[i] = net.JoinHostPort(upstreamAddr, port)
+		}
+		return upstreamTarget{network: "tcp", addresses: addresses}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return upstreamTarget{}, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if u.Scheme != "unix" {
+		return upstreamTarget{}, fmt.Errorf("unsupported target %q, only unix sockets are supported", target)
+	}
+	if u.Host != "" || u.Path == "" {
+		return upstreamTarget{}, fmt.Errorf("invalid target %q, expected unix:///path/to/socket", target)
+	}
+	return upstreamTarget{network: "unix", addresses: []string{u.Path}}, nil
+}
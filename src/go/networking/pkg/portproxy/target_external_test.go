@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyUnixSocketTarget(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	upstream, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	// The local address of the dialer only applies to TCP upstreams.
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	localListener, _ := startPortProxy(t, testServerIP, portproxy.WithDialer(dialer))
+
+	testPort := freePort(t)
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			tcpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+		Target: "unix://" + socketPath,
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.Truef(t, response.Success, "publishing a port for a unix socket should succeed: %+v", response)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+
+	// UDP ports cannot be relayed to a unix socket.
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	portMapping.Ports = nat.PortMap{
+		udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+	}
+	response, err = sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Len(t, response.Results, 1)
+	require.NotEmpty(t, response.Results[0].Error)
+}
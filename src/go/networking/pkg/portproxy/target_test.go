@@ -0,0 +1,65 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		expected upstreamTarget
+	}{
+		{
+			name:     "empty target relays to the upstream addresses",
+			target:   "",
+			expected: upstreamTarget{network: "tcp", addresses: []string{"192.0.2.1:8080", "[2001:db8::1]:8080"}},
+		},
+		{
+			name:     "unix socket",
+			target:   "unix:///var/run/docker.sock",
+			expected: upstreamTarget{network: "unix", addresses: []string{"/var/run/docker.sock"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := parseTarget(tt.target, []string{"192.0.2.1", "2001:db8::1"}, "8080")
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, target)
+		})
+	}
+}
+
+func TestParseTargetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{name: "unsupported scheme", target: "tcp://192.0.2.1:80"},
+		{name: "no scheme", target: "/var/run/docker.sock"},
+		{name: "host instead of path", target: "unix://docker.sock"},
+		{name: "missing path", target: "unix://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTarget(tt.target, []string{"192.0.2.1"}, "8080")
+			require.Error(t, err)
+		})
+	}
+}
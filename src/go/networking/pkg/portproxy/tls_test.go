@@ -0,0 +1,134 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyTLS(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	tlsPort, sniPort, plainPort := freePort(t), freePort(t), freePort(t)
+
+	// The upstream answers in plaintext on every port.
+	hostPorts := []string{tlsPort, sniPort, plainPort}
+	for _, hostPort := range hostPorts {
+		l, err := net.Listen("tcp", net.JoinHostPort(testServerIP, hostPort))
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					_, _ = io.Copy(c, c)
+				}()
+			}
+		}()
+	}
+
+	cert, roots := selfSignedCert(t, "localhost", "example.test")
+	serverNames := make(chan string, 1)
+	tlsNatPort, err := nat.NewPort("tcp", tlsPort)
+	require.NoError(t, err)
+	sniNatPort, err := nat.NewPort("tcp", sniPort)
+	require.NoError(t, err)
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithTLS(tlsNatPort, cert),
+		portproxy.WithTLSGetCertificate(sniNatPort, func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNames <- hello.ServerName
+			return &cert, nil
+		}))
+
+	portMapping := types.PortMapping{Ports: nat.PortMap{}}
+	for _, hostPort := range hostPorts {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		portMapping.Ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}
+	}
+	response, err := sendPortMapping(localListener, portMapping)
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	t.Run("terminates TLS", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", tlsPort), &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, echo(conn))
+	})
+
+	t.Run("picks the certificate by server name", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", sniPort), &tls.Config{
+			RootCAs:    roots,
+			ServerName: "example.test",
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, "example.test", <-serverNames)
+		require.NoError(t, echo(conn))
+	})
+
+	t.Run("leaves other ports alone", func(t *testing.T) {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", plainPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, echo(conn))
+	})
+}
+
+// selfSignedCert returns a certificate for hosts along with a pool that
+// trusts it.
+func selfSignedCert(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
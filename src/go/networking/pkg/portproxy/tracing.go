@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import "context"
+
+// Tracer starts the spans WithTracer records relayed TCP connections
+// with. It mirrors the subset of an OpenTelemetry tracer the proxy needs,
+// so that one can be adapted in a few lines without the proxy depending
+// on OpenTelemetry.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx if
+	// any, and returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// End ends the span, with an error status when err is not nil.
+	End(err error)
+}
+
+// Attribute is a span attribute; Value is a string or an int64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Names of the spans recorded for each relayed connection. Dialing the
+// upstream is a child of the connection, and each dial attempt, retries
+// included, a child of the dial.
+const (
+	connectionSpanName  = "portproxy.connection"
+	dialSpanName        = "portproxy.dial"
+	dialAttemptSpanName = "portproxy.dial.attempt"
+)
+
+// startSpan starts a span when a tracer is configured. Otherwise the span
+// is nil and ctx is returned as is, so that callers only pay for checking
+// the span when tracing is disabled.
+func (p *PortProxy) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if p.tracer == nil {
+		return ctx, nil
+	}
+	return p.tracer.Start(ctx, name)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyTracer(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	// Nothing listens on the refused port once it is closed.
+	refused, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	_, refusedPort, err := net.SplitHostPort(refused.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, refused.Close())
+
+	tracer := &recordingTracer{}
+	localListener, _ := startPortProxy(t, testServerIP,
+		portproxy.WithTracer(tracer), portproxy.WithDialRetry(2, time.Millisecond))
+	ports := nat.PortMap{}
+	for _, hostPort := range []string{testPort, refusedPort} {
+		port, err := nat.NewPort("tcp", hostPort)
+		require.NoError(t, err)
+		ports[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}
+	}
+	response, err := sendPortMapping(localListener, types.PortMapping{Ports: ports})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return len(tracer.spans()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Spans end children first.
+	spans := tracer.spans()
+	attempt, dial, connection := spans[0], spans[1], spans[2]
+	require.Equal(t, "portproxy.connection", connection.name)
+	require.Nil(t, connection.parent)
+	require.NoError(t, connection.err)
+	require.Equal(t, map[string]any{
+		"portproxy.port":      testPort,
+		"portproxy.client":    conn.LocalAddr().String(),
+		"portproxy.upstream":  net.JoinHostPort(testServerIP, testPort),
+		"portproxy.bytes_in":  int64(4),
+		"portproxy.bytes_out": int64(4),
+	}, connection.attrs)
+	require.Equal(t, "portproxy.dial", dial.name)
+	require.True(t, dial.parent == connection)
+	require.NoError(t, dial.err)
+	require.Equal(t, "portproxy.dial.attempt", attempt.name)
+	require.True(t, attempt.parent == dial)
+	require.Equal(t, int64(1), attempt.attrs["portproxy.dial.attempt"])
+
+	// Every attempt at dialing the refused upstream is recorded, and the
+	// error is reported up to the connection.
+	conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", refusedPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return len(tracer.spans()) == 7
+	}, 5*time.Second, 10*time.Millisecond)
+	spans = tracer.spans()[3:]
+	for i, span := range spans[:2] {
+		require.Equal(t, "portproxy.dial.attempt", span.name)
+		require.Equal(t, int64(i+1), span.attrs["portproxy.dial.attempt"])
+		require.ErrorIs(t, span.err, syscall.ECONNREFUSED)
+	}
+	require.Equal(t, "portproxy.dial", spans[2].name)
+	require.ErrorIs(t, spans[2].err, syscall.ECONNREFUSED)
+	require.Equal(t, "portproxy.connection", spans[3].name)
+	require.ErrorIs(t, spans[3].err, portproxy.ErrUpstreamDial)
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultUDPSessionTimeout is how long a UDP session is kept around
+	// without any traffic in either direction, unless
+	// WithUDPSessionTimeout says otherwise.
+	defaultUDPSessionTimeout = 30 * time.Second
+	// maxDatagramSize is large enough to hold any UDP payload.
+	maxDatagramSize = 65535
+)
+
+// udpProxy relays datagrams received on a published UDP port to the
+// upstream. Since UDP is connectionless, a dedicated upstream socket is
+// kept for each client address so that replies can be routed back.
+type udpProxy struct {
+	conn    net.PacketConn
+	dialer  *net.Dialer
+	metrics *metrics
+	logger  *logrus.Entry
+	// address new sessions are relayed to, guarded by mutex
+	upstreamAddr string
+	// sessions without any traffic for this long are closed
+	timeout time.Duration
+	// map of client address as a key to associated upstream connection
+	sessions map[string]net.Conn
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	// set while datagrams are read from conn, see Healthy
+	serving atomic.Bool
+}
+
+func newUDPProxy(conn net.PacketConn, dialer *net.Dialer, upstreamAddr string, timeout time.Duration, metrics *metrics, logger *logrus.Entry) *udpProxy {
+	return &udpProxy{
+		conn:         conn,
+		dialer:       udpDialer(dialer),
+		upstreamAddr: upstreamAddr,
+		timeout:      timeout,
+		metrics:      metrics,
+		logger:       logger,
+		sessions:     make(map[string]net.Conn),
+	}
+}
+
+// udpDialer returns dialer, or a copy of it dialing from the IP of its
+// local address if that is a TCP one, which UDP sockets cannot use.
+func udpDialer(dialer *net.Dialer) *net.Dialer {
+	local, ok := dialer.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		return dialer
+	}
+	d := *dialer
+	d.LocalAddr = &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+	return &d
+}
+
+// serve reads datagrams from the published port until the
+// underlying connection is closed. ctx carries the pprof labels of the
+// port, which the sessions' goroutines are labelled with.
+func (u *udpProxy) serve(ctx context.Context) {
+	defer u.serving.Store(false)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			u.logger.Errorf("port proxy failed to read datagram: %s", err)
+			continue
+		}
+		upstream, err := u.session(ctx, clientAddr)
+		if err != nil {
+			u.metrics.upstreamDialErrors.Add(1)
+			u.logger.WithField("client", clientAddr.String()).Errorf("failed to dial upstream: %s", err)
+			continue
+		}
+		written, err := upstream.Write(buf[:n])
+		if err != nil {
+			u.logger.WithField("client", clientAddr.String()).Debugf("error writing datagram to upstream: %s", err)
+		}
+		u.metrics.bytesToUpstream.Add(uint64(written))
+	}
+	u.closeSessions()
+	u.wg.Wait()
+}
+
+// session returns the upstream connection for the given client,
+// creating it when this is the first datagram from that client.
+func (u *udpProxy) session(ctx context.Context, clientAddr net.Addr) (net.Conn, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	upstream, exist := u.sessions[clientAddr.String()]
+	if !exist {
+		var err error
+		upstream, err = u.dialer.DialContext(ctx, "udp", u.upstreamAddr)
+		if err != nil {
+			return nil, err
+		}
+		u.logger.WithFields(logrus.Fields{
+			"client":   clientAddr.String(),
+			"upstream": u.upstreamAddr,
+		}).Debugf("port proxy created UDP session")
+		u.sessions[clientAddr.String()] = upstream
+		u.wg.Add(1)
+		go pprof.Do(ctx, pprof.Labels(labelDirection, directionToClient), func(context.Context) {
+			u.reply(upstream, clientAddr)
+		})
+	}
+	// Any traffic from the client keeps the session alive.
+	_ = upstream.SetReadDeadline(time.Now().Add(u.timeout))
+	return upstream, nil
+}
+
+// reply relays datagrams from the upstream back to the client until
+// the session is idle for longer than its timeout.
+func (u *udpProxy) reply(upstream net.Conn, clientAddr net.Addr) {
+	defer u.wg.Done()
+	logger := u.logger.WithFields(logrus.Fields{
+		"client":   clientAddr.String(),
+		"upstream": upstream.RemoteAddr().String(),
+	})
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				logger.Debugf("UDP session timed out")
+			}
+			break
+		}
+		_ = upstream.SetReadDeadline(time.Now().Add(u.timeout))
+		written, err := u.conn.WriteTo(buf[:n], clientAddr)
+		if err != nil {
+			logger.Debugf("error writing datagram to client: %s", err)
+		}
+		u.metrics.bytesToClient.Add(uint64(written))
+	}
+
+	u.mutex.Lock()
+	if u.sessions[clientAddr.String()] == upstream {
+		delete(u.sessions, clientAddr.String())
+	}
+	u.mutex.Unlock()
+	_ = upstream.Close()
+}
+
+// upstream returns the address new sessions are relayed to.
+func (u *udpProxy) upstream() string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.upstreamAddr
+}
+
+// setUpstream relays new sessions to addr, and closes the existing
+// sessions when drain is set.
+func (u *udpProxy) setUpstream(addr string, drain bool) {
+	u.mutex.Lock()
+	u.upstreamAddr = addr
+	u.mutex.Unlock()
+	if drain {
+		u.closeSessions()
+	}
+}
+
+func (u *udpProxy) closeSessions() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, upstream := range u.sessions {
+		_ = upstream.Close()
+	}
+}
+
+func (u *udpProxy) Close() error {
+	return u.conn.Close()
+}
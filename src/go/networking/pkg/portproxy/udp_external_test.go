@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyUDP(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	// The upstream echoes every datagram back to the sender.
+	upstream, err := net.ListenPacket("udp", fmt.Sprintf("%s:", testServerIP))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	_, testPort, err := net.SplitHostPort(upstream.LocalAddr().String())
+	require.NoError(t, err)
+
+	localListener, _ := startPortProxy(t, testServerIP)
+
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+
+	// A single mapping can carry both TCP and UDP ports.
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			udpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+			tcpPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	}
+	err = marshalAndSend(localListener, portMapping)
+	require.NoError(t, err)
+
+	require.Eventuallyf(t, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "TCP listener for port: %s should be available", testPort)
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	expected := "hello over udp"
+	_, err = conn.Write([]byte(expected))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(buf[:n]))
+}
+
+func TestPortProxySamePortTCPAndUDP(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	testPort := startEchoServer(t, testServerIP)
+	upstream, err := net.ListenPacket("udp", net.JoinHostPort(testServerIP, testPort))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	tcpPort, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	udpPort, err := nat.NewPort("udp", testPort)
+	require.NoError(t, err)
+	bindings := []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}}
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{tcpPort: bindings, udpPort: bindings},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Len(t, response.Results, 2)
+	require.Equal(t, []nat.Port{tcpPort, udpPort}, portProxy.ActivePorts())
+
+	addr := net.JoinHostPort("127.0.0.1", testPort)
+	udpEcho := func() error {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			return err
+		}
+		_, err = conn.Read(make([]byte, 4))
+		return err
+	}
+	tcpConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	require.NoError(t, echo(tcpConn))
+	require.NoError(t, udpEcho())
+
+	// Removing the TCP port leaves the UDP one, and the TCP connection
+	// relayed so far, alone.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Remove: true,
+		Ports:  nat.PortMap{tcpPort: bindings},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Equal(t, []nat.Port{udpPort}, portProxy.ActivePorts())
+	_, err = net.Dial("tcp", addr)
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	require.NoError(t, echo(tcpConn))
+	require.NoError(t, udpEcho())
+
+	// And the other way around.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{tcpPort: bindings},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Remove: true,
+		Ports:  nat.PortMap{udpPort: bindings},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Equal(t, []nat.Port{tcpPort}, portProxy.ActivePorts())
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+}
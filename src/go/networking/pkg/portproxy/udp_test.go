@@ -0,0 +1,133 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPSessionTimeout(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = upstream.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+	_, upstreamPort, err := net.SplitHostPort(upstream.LocalAddr().String())
+	require.NoError(t, err)
+
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := MustNewPortProxy(control, "127.0.0.1", WithUDPSessionTimeout(500*time.Millisecond))
+	t.Cleanup(func() { _ = p.Close() })
+
+	p.mutex.Lock()
+	hostPort, err := p.execBinding(types.PortMapping{}, nat.Port(upstreamPort+"/udp"), nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	udpListener := p.activeUDPListeners[net.JoinHostPort("127.0.0.1", hostPort)]
+	p.mutex.Unlock()
+	require.NoError(t, err)
+	require.NotNil(t, udpListener)
+	sessions := func() int {
+		udpListener.mutex.Lock()
+		defer udpListener.mutex.Unlock()
+		return len(udpListener.sessions)
+	}
+
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", hostPort))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+	require.Equal(t, 1, sessions())
+
+	// Once idle for longer than the timeout, the session is freed.
+	require.Eventually(t, func() bool {
+		return sessions() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWithUDPSessionTimeout(t *testing.T) {
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = control.Close() })
+
+	p := MustNewPortProxy(control, "127.0.0.1")
+	require.Equal(t, defaultUDPSessionTimeout, p.udpSessionTimeout)
+	p = MustNewPortProxy(control, "127.0.0.1", WithUDPSessionTimeout(time.Second))
+	require.Equal(t, time.Second, p.udpSessionTimeout)
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		p = MustNewPortProxy(control, "127.0.0.1", WithUDPSessionTimeout(timeout))
+		require.Equal(t, defaultUDPSessionTimeout, p.udpSessionTimeout)
+	}
+}
+
+func TestUDPWithDialer(t *testing.T) {
+	// The upstream answers with the address the datagram comes from.
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = upstream.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(addr.String())
+			_, _ = upstream.WriteTo([]byte(host), addr)
+		}
+	}()
+	_, upstreamPort, err := net.SplitHostPort(upstream.LocalAddr().String())
+	require.NoError(t, err)
+
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.5")}}
+	p := MustNewPortProxy(control, "127.0.0.1", WithDialer(dialer))
+	t.Cleanup(func() { _ = p.Close() })
+	p.mutex.Lock()
+	hostPort, err := p.execBinding(types.PortMapping{}, nat.Port(upstreamPort+"/udp"), nat.PortBinding{HostIP: "127.0.0.1", HostPort: "0"})
+	p.mutex.Unlock()
+	require.NoError(t, err)
+
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", hostPort))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.5", string(buf[:n]))
+}
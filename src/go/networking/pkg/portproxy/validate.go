@@ -0,0 +1,281 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// Validate runs the checks applying pm would, without binding or removing
+// anything, and returns the problems found with its port bindings. It
+// also reports bindings that conflict with a published port or with each
+// other, e.g. 0.0.0.0 and 127.0.0.1 for the same port, which would fail
+// to listen.
+func (p *PortProxy) Validate(pm types.PortMapping) []error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var errs []error
+	for _, result := range p.dryRun(pm).Results {
+		if !result.Success {
+			errs = append(errs, fmt.Errorf("port %s on %s for %s: %s",
+				result.HostPort, result.HostIP, result.Port, result.Error))
+		}
+	}
+	return errs
+}
+
+// dryRun validates pm like Validate, reporting the outcome as applying it
+// would. The caller must hold p.mutex.
+func (p *PortProxy) dryRun(pm types.PortMapping) types.PortMappingResult {
+	if pm.RemoveAll {
+		return types.PortMappingResult{
+			Success: true,
+			Results: []types.PortBindingResult{},
+			Removed: len(p.activeListeners) + len(p.activeUDPListeners),
+		}
+	}
+	removed := 0
+	var stale map[string][]string
+	if pm.ReplaceAll {
+		pm.Remove = false
+		stale = p.staleListeners(pm)
+		for _, addrs := range stale {
+			removed += len(addrs)
+		}
+	}
+	// Addresses the mapping would listen on so far, by protocol.
+	pending := map[string][]string{}
+	result := newPortMappingResult(p.eachBinding(pm, func(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+		addr, err := p.checkBinding(pm, containerPort, portBinding)
+		if err != nil || pm.Remove {
+			return "", err
+		}
+		proto := containerPort.Proto()
+		active := protocols[proto].listening(p)
+		if pm.ReplaceAll {
+			// The listeners that are replaced are out of the way.
+			active = slices.DeleteFunc(active, func(addr string) bool {
+				return slices.Contains(stale[proto], addr)
+			})
+		}
+		for _, other := range append(active, pending[proto]...) {
+			if addrsConflict(addr, other) {
+				return "", fmt.Errorf("listening on %s conflicts with listening on %s", addr, other)
+			}
+		}
+		pending[proto] = append(pending[proto], addr)
+		return "", nil
+	}))
+	result.Removed = removed
+	return result
+}
+
+// checkBinding runs the checks of a port binding that do not need to bind
+// it, and returns the address it is to be listened on. The caller must
+// hold p.mutex.
+func (p *PortProxy) checkBinding(pm types.PortMapping, containerPort nat.Port, portBinding nat.PortBinding) (string, error) {
+	if _, err := nat.ParsePort(portBinding.HostPort); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidPort, err)
+	}
+	hostIP := portBinding.HostIP
+	if p.bindAddress != "" {
+		hostIP = p.bindAddress
+	}
+	hostAddr, err := netip.ParseAddr(hostIP)
+	if hostIP != "" && err != nil {
+		return "", fmt.Errorf("invalid host IP %q", hostIP)
+	}
+	proto, err := lookupProtocol(containerPort)
+	if err != nil {
+		return "", err
+	}
+	// A v4 and a v6 binding for the same port are distinct listeners.
+	addr := net.JoinHostPort(hostIP, portBinding.HostPort)
+	if pm.DrainTimeoutSeconds < 0 {
+		return "", fmt.Errorf("invalid drain timeout %d", pm.DrainTimeoutSeconds)
+	}
+	if pm.Remove {
+		return addr, nil
+	}
+	if pm.Drain {
+		return "", errors.New("drain only applies to removing ports")
+	}
+	if err := proto.check(pm, containerPort); err != nil {
+		return "", err
+	}
+	if _, err := parseAllowedSources(pm.AllowedSources); err != nil {
+		return "", err
+	}
+	if pm.UpstreamPort < 0 || pm.UpstreamPort > 65535 {
+		return "", fmt.Errorf("%w: upstream port %d", ErrInvalidPort, pm.UpstreamPort)
+	}
+	if pm.UpstreamPort != 0 && pm.Target != "" {
+		return "", fmt.Errorf("upstream port %d cannot be combined with target %q", pm.UpstreamPort, pm.Target)
+	}
+	if _, err := parseTarget(pm.Target, p.upstreamAddresses, portBinding.HostPort); err != nil {
+		return "", err
+	}
+	relayed := pm.Target == "" && relayedPort(pm, containerPort, portBinding) == portBinding.HostPort
+	if err := p.checkHostIP(hostAddr, portBinding.HostPort, relayed); err != nil {
+		return "", err
+	}
+	if p.closing {
+		return "", errClosing
+	}
+	if err := p.checkMaxPorts(containerPort.Proto(), portBinding.HostPort); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// checkMaxPorts fails when publishing hostPort would exceed the limit on
+// published ports. The caller must hold p.mutex.
+func (p *PortProxy) checkMaxPorts(proto, hostPort string) error {
+	if p.maxPorts == 0 {
+		return nil
+	}
+	active := p.activePorts()
+	if !isEphemeralPort(hostPort) && slices.Contains(active, nat.Port(hostPort+"/"+proto)) {
+		return nil
+	}
+	if len(active) >= p.maxPorts {
+		return fmt.Errorf("%w: cannot publish port %s/%s, %d ports are published already",
+			ErrTooManyPorts, hostPort, proto, len(active))
+	}
+	return nil
+}
+
+// checkHostIP catches host IPs that look like they were meant for the
+// upstream: the host IP is where the port is published, and the upstream
+// is configured on the proxy. A host IP the host does not have cannot be
+// listened on, so it fails the binding. Listening on the upstream address,
+// and on the upstream port too, which relays the port back to the proxy,
+// is only warned about since the upstream may legitimately be local, e.g.
+// while testing. relayed is set when the port is relayed to the same port
+// on the upstream addresses rather than to a target or port of its own.
+func (p *PortProxy) checkHostIP(hostIP netip.Addr, hostPort string, relayed bool) error {
+	upstream := func(ip netip.Addr) bool {
+		for _, upstreamAddr := range p.upstreamAddresses {
+			if upstreamIP, err := netip.ParseAddr(upstreamAddr); err == nil && upstreamIP.Unmap() == ip.Unmap() {
+				return true
+			}
+		}
+		return false
+	}
+	if hostIP.IsValid() && !hostIP.IsUnspecified() {
+		if !p.hostAddrs.has(hostIP) {
+			if upstream(hostIP) {
+				return fmt.Errorf("host IP %s is the upstream address, which is not an address of this host; "+
+					"the host IP is the address the port is published on", hostIP)
+			}
+			return fmt.Errorf("host IP %s is not an address of this host", hostIP)
+		}
+		if upstream(hostIP) {
+			p.logger.Warnf("host IP %s of port [%s] is also the upstream address; "+
+				"the host IP is the address the port is published on", hostIP, hostPort)
+		}
+	}
+	if !relayed || isEphemeralPort(hostPort) {
+		return nil
+	}
+	host := ""
+	if hostIP.IsValid() {
+		host = hostIP.String()
+	}
+	for _, upstreamAddr := range p.upstreamAddresses {
+		upstreamIP, err := netip.ParseAddr(upstreamAddr)
+		if err != nil || !p.hostAddrs.has(upstreamIP) {
+			continue
+		}
+		if host == upstreamIP.String() || covers(host, upstreamIP.String()) {
+			p.logger.Warnf("host IP %q of port [%s] includes the upstream address %s, "+
+				"connections to the port would be relayed back to it", host, hostPort, upstreamAddr)
+		}
+	}
+	return nil
+}
+
+// hostAddrs lists the addresses of the network interfaces on first use,
+// so that a port range checks them once rather than for every port. A nil
+// hostAddrs lists them on every use.
+type hostAddrs struct {
+	addrs  []net.Addr
+	err    error
+	listed bool
+}
+
+// has reports whether ip can be listened on, because it is a loopback
+// address or an address of one of the network interfaces. When the
+// interfaces cannot be listed, it assumes ip can be listened on and leaves
+// it to listening to fail.
+func (h *hostAddrs) has(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+	if h == nil {
+		h = &hostAddrs{}
+	}
+	if !h.listed {
+		h.addrs, h.err = net.InterfaceAddrs()
+		h.listed = true
+	}
+	if h.err != nil {
+		return true
+	}
+	for _, addr := range h.addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ifaceIP, ok := netip.AddrFromSlice(ipNet.IP); ok && ifaceIP.Unmap() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addrsConflict reports whether listening on both a and b fails because
+// one is a wildcard address covering the other for the same port. The
+// same address does not conflict, publishing it again updates the port,
+// and neither do ports picked by the system.
+func addrsConflict(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB || hostA == hostB || isEphemeralPort(portA) {
+		return false
+	}
+	return covers(hostA, hostB) || covers(hostB, hostA)
+}
+
+// covers reports whether listening on wildcard also listens on host. The
+// IPv6 wildcard is bound to IPv6 only, see networkForIP.
+func covers(wildcard, host string) bool {
+	if wildcard == "" {
+		return true
+	}
+	wildcardIP, err := netip.ParseAddr(wildcard)
+	if err != nil || !wildcardIP.IsUnspecified() {
+		return false
+	}
+	hostIP, err := netip.ParseAddr(host)
+	return err == nil && hostIP.Is4() == wildcardIP.Is4()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyValidate(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+
+	localListener, portProxy := startPortProxy(t, testServerIP)
+
+	published := freePort(t)
+	publishedPort, err := nat.NewPort("tcp", published)
+	require.NoError(t, err)
+	require.NoError(t, marshalAndSend(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			publishedPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: published}},
+		},
+	}))
+
+	free := freePort(t)
+	freeTCP, err := nat.NewPort("tcp", free)
+	require.NoError(t, err)
+	freeUDP, err := nat.NewPort("udp", free)
+	require.NoError(t, err)
+	valid := types.PortMapping{
+		Ports: nat.PortMap{
+			freeTCP:       []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: free}},
+			freeUDP:       []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: free}},
+			publishedPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: published}},
+		},
+	}
+	require.Empty(t, portProxy.Validate(valid))
+
+	invalid := types.PortMapping{
+		Ports: nat.PortMap{
+			freeTCP: []nat.PortBinding{
+				{HostIP: "not an IP", HostPort: free},
+				{HostIP: "0.0.0.0", HostPort: free},
+				{HostIP: "127.0.0.1", HostPort: free},
+			},
+			publishedPort: []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: published}},
+		},
+	}
+	errs := portProxy.Validate(invalid)
+	require.Len(t, errs, 3)
+
+	// A dry run reports the same problems over the control socket.
+	invalid.DryRun = true
+	response, err := sendPortMapping(localListener, invalid)
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Len(t, response.Results, 4)
+	failed := 0
+	for _, result := range response.Results {
+		if !result.Success {
+			failed++
+		}
+	}
+	require.Equal(t, 3, failed)
+
+	// Neither validating nor a dry run publishes or removes anything.
+	require.Equal(t, []nat.Port{publishedPort}, portProxy.ActivePorts())
+	response, err = sendPortMapping(localListener, types.PortMapping{RemoveAll: true, DryRun: true})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.Equal(t, 1, response.Removed)
+	require.Equal(t, []nat.Port{publishedPort}, portProxy.ActivePorts())
+}
+
+func TestPortProxyHostIPMismatch(t *testing.T) {
+	port, err := nat.NewPort("tcp", "8080")
+	require.NoError(t, err)
+	mapping := func(hostIP string) types.PortMapping {
+		return types.PortMapping{
+			Ports: nat.PortMap{port: []nat.PortBinding{{HostIP: hostIP, HostPort: "8080"}}},
+		}
+	}
+
+	// The upstream is not an address of this host, as with a VM.
+	portProxy := portproxy.MustNewPortProxy(nil, "198.51.100.1")
+	errs := portProxy.Validate(mapping("198.51.100.1"))
+	require.Len(t, errs, 1)
+	require.ErrorContains(t, errs[0], "host IP 198.51.100.1 is the upstream address")
+	errs = portProxy.Validate(mapping("203.0.113.9"))
+	require.Len(t, errs, 1)
+	require.ErrorContains(t, errs[0], "host IP 203.0.113.9 is not an address of this host")
+	require.Empty(t, portProxy.Validate(mapping("127.0.0.1")))
+
+	// A local upstream can be listened on, which is only warned about.
+	logger, hook := logrustest.NewNullLogger()
+	portProxy = portproxy.MustNewPortProxy(nil, "127.0.0.1", portproxy.WithLogger(logrus.NewEntry(logger)))
+	require.Empty(t, portProxy.Validate(mapping("0.0.0.0")))
+	require.Len(t, hook.AllEntries(), 1)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	require.Contains(t, hook.LastEntry().Message, "relayed back")
+}
+
+func TestPortProxyMaxPorts(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	localListener, portProxy := startPortProxy(t, testServerIP, portproxy.WithMaxPorts(2))
+
+	var ports []nat.Port
+	for range 3 {
+		port, err := nat.NewPort("tcp", freePort(t))
+		require.NoError(t, err)
+		ports = append(ports, port)
+	}
+	binding := func(port nat.Port) []nat.PortBinding {
+		return []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port.Port()}}
+	}
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{ports[0]: binding(ports[0])},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	// Only one of the two new ports fits under the limit.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			ports[1]: binding(ports[1]),
+			ports[2]: binding(ports[2]),
+		},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+	require.Len(t, response.Results, 2)
+	var published, rejected nat.Port
+	for _, result := range response.Results {
+		if result.Success {
+			published = nat.Port(result.Port)
+		} else {
+			rejected = nat.Port(result.Port)
+			require.Contains(t, result.Error, portproxy.ErrTooManyPorts.Error())
+		}
+	}
+	require.NotEmpty(t, published)
+	require.NotEmpty(t, rejected)
+	require.ElementsMatch(t, []nat.Port{ports[0], published}, portProxy.ActivePorts())
+
+	// Publishing a port on another host IP does not count against the
+	// limit, a new port does.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			ports[0]: []nat.PortBinding{{HostIP: "127.0.0.2", HostPort: ports[0].Port()}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{rejected: binding(rejected)},
+	})
+	require.NoError(t, err)
+	require.False(t, response.Success)
+
+	// Removing a port makes room for another one.
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Remove: true,
+		Ports:  nat.PortMap{published: binding(published)},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	response, err = sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{rejected: binding(rejected)},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+	require.ElementsMatch(t, []nat.Port{ports[0], rejected}, portProxy.ActivePorts())
+}
@@ -0,0 +1,60 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrsConflict(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		conflict bool
+	}{
+		{a: "127.0.0.1:80", b: "127.0.0.1:80", conflict: false},
+		{a: "127.0.0.1:80", b: "127.0.0.2:80", conflict: false},
+		{a: "0.0.0.0:80", b: "127.0.0.1:80", conflict: true},
+		{a: "127.0.0.1:80", b: "0.0.0.0:80", conflict: true},
+		{a: "0.0.0.0:80", b: "127.0.0.1:81", conflict: false},
+		{a: "0.0.0.0:80", b: "[::1]:80", conflict: false},
+		{a: "0.0.0.0:80", b: "[::]:80", conflict: false},
+		{a: "[::]:80", b: "[::1]:80", conflict: true},
+		{a: ":80", b: "0.0.0.0:80", conflict: true},
+		{a: ":80", b: "[::1]:80", conflict: true},
+	}
+	for _, tt := range tests {
+		require.Equalf(t, tt.conflict, addrsConflict(tt.a, tt.b), "%s and %s", tt.a, tt.b)
+	}
+}
+
+func TestHostAddrs(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, and not assigned.
+	unassigned := netip.MustParseAddr("192.0.2.1")
+	h := &hostAddrs{}
+	require.True(t, h.has(netip.MustParseAddr("127.0.0.1")))
+	require.False(t, h.listed, "loopback addresses need no listing")
+	require.False(t, h.has(unassigned))
+	require.True(t, h.listed)
+
+	// The addresses are listed once.
+	h.addrs = append(h.addrs, &net.IPNet{IP: unassigned.AsSlice(), Mask: net.CIDRMask(24, 32)})
+	require.True(t, h.has(unassigned))
+	require.True(t, h.has(netip.MustParseAddr("::ffff:192.0.2.1")))
+	require.False(t, (*hostAddrs)(nil).has(unassigned))
+}
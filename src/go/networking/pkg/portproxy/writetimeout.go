@@ -0,0 +1,55 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// writeTimeoutConn fails writes that the peer does not take in within the
+// write timeout, e.g. because it stopped reading and the socket buffers are
+// full, with ErrSlowConsumer.
+type writeTimeoutConn struct {
+	halfCloser
+	timeout time.Duration
+	// deadline of the whole connection, which writes must not extend;
+	// zero when there is none
+	deadline time.Time
+}
+
+func newWriteTimeoutConn(conn net.Conn, timeout time.Duration, deadline time.Time) net.Conn {
+	return &writeTimeoutConn{halfCloser: halfCloser{conn}, timeout: timeout, deadline: deadline}
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	// A deadline set to abort the relay, or the one of the whole
+	// connection, is not the peer being slow.
+	if errors.Is(err, os.ErrDeadlineExceeded) && deadline != c.deadline && !time.Now().Before(deadline) {
+		return n, fmt.Errorf("%w: writing to %s for %s: %w", ErrSlowConsumer, c.RemoteAddr(), c.timeout, err)
+	}
+	return n, err
+}
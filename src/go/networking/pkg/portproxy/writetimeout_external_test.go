@@ -0,0 +1,92 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/networking/pkg/portproxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortProxyWriteTimeout(t *testing.T) {
+	testServerIP, err := availableIP()
+	require.NoError(t, err, "cannot continue with the test since there are no available IP addresses")
+	// The upstream sends as fast as it can to a client that never reads.
+	upstream, err := net.Listen("tcp", net.JoinHostPort(testServerIP, "0"))
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64*1024)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	_, testPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	closed := make(chan portproxy.ConnEvent, 1)
+	localListener, portProxy := startPortProxy(t, testServerIP,
+		portproxy.WithWriteTimeout(200*time.Millisecond),
+		portproxy.WithConnectionHook(func(event portproxy.ConnEvent) {
+			if event.Type == portproxy.ConnClosed {
+				closed <- event
+			}
+		}))
+
+	port, err := nat.NewPort("tcp", testPort)
+	require.NoError(t, err)
+	response, err := sendPortMapping(localListener, types.PortMapping{
+		Ports: nat.PortMap{
+			port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: testPort}},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", testPort))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case event := <-closed:
+		require.ErrorIs(t, event.Err, portproxy.ErrSlowConsumer)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "the relay to a client that does not read was not closed")
+	}
+	expected := `
+# HELP portproxy_slow_consumer_total Number of connections closed because a write to the client or the upstream timed out.
+# TYPE portproxy_slow_consumer_total counter
+portproxy_slow_consumer_total 1
+`
+	require.NoError(t, testutil.CollectAndCompare(portProxy.Collector(), strings.NewReader(expected), "portproxy_slow_consumer_total"))
+}
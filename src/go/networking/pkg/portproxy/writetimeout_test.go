@@ -0,0 +1,60 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package portproxy
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fill writes to conn until it fails, which needs its peer to not read.
+func fill(conn io.Writer) error {
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWriteTimeoutConn(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	err := fill(newWriteTimeoutConn(server, 100*time.Millisecond, time.Time{}))
+	require.ErrorIs(t, err, ErrSlowConsumer)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWriteTimeoutConnDeadline(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// The deadline of the connection comes first, which is not the peer
+	// being slow.
+	deadline := time.Now().Add(100 * time.Millisecond)
+	require.NoError(t, server.SetDeadline(deadline))
+	err := fill(newWriteTimeoutConn(server, time.Minute, deadline))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NotErrorIs(t, err, ErrSlowConsumer)
+}